@@ -0,0 +1,194 @@
+package metricshipper
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/zenoss/glog"
+)
+
+// Flushed windows are remembered this long to drop late datapoints for them.
+const aggregateFlushedFor = 1 * time.Hour
+
+var aggregateFunctions = map[string]func(*aggregateBucket) float64{
+	"min":   func(b *aggregateBucket) float64 { return b.min },
+	"max":   func(b *aggregateBucket) float64 { return b.max },
+	"avg":   func(b *aggregateBucket) float64 { return b.sum / float64(b.count) },
+	"sum":   func(b *aggregateBucket) float64 { return b.sum },
+	"count": func(b *aggregateBucket) float64 { return float64(b.count) },
+	"last":  func(b *aggregateBucket) float64 { return b.last },
+}
+
+// AggregateRule selects metrics that should be rolled up over a window
+// instead of being shipped point by point.
+type AggregateRule struct {
+	Pattern   string   // Regular expression matched against the metric name
+	Window    int      // Window size in seconds
+	Functions []string // Any of min, max, avg, sum, count and last; defaults to avg
+}
+
+type aggregateRule struct {
+	AggregateRule
+	pattern *regexp.Regexp
+	window  float64
+}
+
+type aggregateBucket struct {
+	rule     *aggregateRule
+	metric   Metric // Name and tags of the series
+	start    float64
+	updated  time.Time
+	count    int
+	min      float64
+	max      float64
+	sum      float64
+	last     float64
+	lastTime float64
+}
+
+func (b *aggregateBucket) add(metric Metric, now time.Time) {
+	if b.count == 0 || metric.Value < b.min {
+		b.min = metric.Value
+	}
+	if b.count == 0 || metric.Value > b.max {
+		b.max = metric.Value
+	}
+	if b.count == 0 || metric.Timestamp >= b.lastTime {
+		b.last = metric.Value
+		b.lastTime = metric.Timestamp
+	}
+	b.sum += metric.Value
+	b.count++
+	b.updated = now
+}
+
+// metrics returns one metric per configured function, named after the
+// original metric if only one function is configured and suffixed with the
+// function name otherwise.
+func (b *aggregateBucket) metrics() []Metric {
+	out := make([]Metric, 0, len(b.rule.Functions))
+	for _, fn := range b.rule.Functions {
+		m := b.metric
+		m.Timestamp = b.start
+		m.Value = aggregateFunctions[fn](b)
+		if len(b.rule.Functions) > 1 {
+			m.Metric += "_" + fn
+		}
+		out = append(out, m)
+	}
+	return out
+}
+
+// AggregateStage rolls datapoints up into fixed windows per series. A window
+// is emitted when the first point of a later window arrives, or by Flush once
+// the series has been quiet for a whole window. Datapoints for windows that
+// were already emitted are dropped. It must only be used from a single
+// goroutine.
+type AggregateStage struct {
+	rules   []*aggregateRule
+	buckets map[string]*aggregateBucket
+	flushed map[string]flushedWindow
+}
+
+// flushedWindow is the start of the last window Flush emitted for a series
+type flushedWindow struct {
+	start float64
+	at    time.Time
+}
+
+func NewAggregateStage(rules []AggregateRule) (*AggregateStage, error) {
+	stage := &AggregateStage{
+		buckets: make(map[string]*aggregateBucket),
+		flushed: make(map[string]flushedWindow),
+	}
+	for _, r := range rules {
+		pattern, err := regexp.Compile(r.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid aggregate pattern %q: %s", r.Pattern, err)
+		}
+		if r.Window <= 0 {
+			return nil, fmt.Errorf("Invalid window for aggregate pattern %q: %d", r.Pattern, r.Window)
+		}
+		if len(r.Functions) == 0 {
+			r.Functions = []string{"avg"}
+		}
+		functions := make([]string, len(r.Functions))
+		for i, fn := range r.Functions {
+			functions[i] = strings.ToLower(fn)
+			if _, ok := aggregateFunctions[functions[i]]; !ok {
+				return nil, fmt.Errorf("Invalid function for aggregate pattern %q: %s", r.Pattern, fn)
+			}
+		}
+		r.Functions = functions
+		stage.rules = append(stage.rules, &aggregateRule{
+			AggregateRule: r,
+			pattern:       pattern,
+			window:        float64(r.Window),
+		})
+	}
+	return stage, nil
+}
+
+func (s *AggregateStage) match(name string) *aggregateRule {
+	for _, rule := range s.rules {
+		if rule.pattern.MatchString(name) {
+			return rule
+		}
+	}
+	return nil
+}
+
+func (s *AggregateStage) Process(metric Metric) ([]Metric, error) {
+	rule := s.match(metric.Metric)
+	if rule == nil {
+		return []Metric{metric}, nil
+	}
+
+	var out []Metric
+	key := metric.SeriesKey()
+	start := math.Floor(metric.Timestamp/rule.window) * rule.window
+	bucket, ok := s.buckets[key]
+	if ok && start < bucket.start {
+		glog.V(2).Infof("Dropping late datapoint for %s at %f", key, metric.Timestamp)
+		return nil, nil
+	}
+	if ok && start > bucket.start {
+		out = bucket.metrics()
+		ok = false
+	}
+	if !ok {
+		if flushed, seen := s.flushed[key]; seen {
+			if start <= flushed.start {
+				glog.V(2).Infof("Dropping late datapoint for %s at %f", key, metric.Timestamp)
+				return out, nil
+			}
+			delete(s.flushed, key)
+		}
+		bucket = &aggregateBucket{rule: rule, metric: metric, start: start}
+		s.buckets[key] = bucket
+	}
+	bucket.add(metric, time.Now())
+	return out, nil
+}
+
+// Flush emits every window that has not received a datapoint for at least
+// the length of the window.
+func (s *AggregateStage) Flush(now time.Time) []Metric {
+	var out []Metric
+	for key, bucket := range s.buckets {
+		if now.Sub(bucket.updated).Seconds() >= bucket.rule.window {
+			out = append(out, bucket.metrics()...)
+			delete(s.buckets, key)
+			s.flushed[key] = flushedWindow{start: bucket.start, at: now}
+		}
+	}
+	for key, flushed := range s.flushed {
+		if now.Sub(flushed.at) > aggregateFlushedFor {
+			delete(s.flushed, key)
+		}
+	}
+	return out
+}
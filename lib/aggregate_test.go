@@ -0,0 +1,137 @@
+package metricshipper
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAggregateStage(t *testing.T) {
+	stage, err := NewAggregateStage([]AggregateRule{{
+		Pattern:   "^cpu",
+		Window:    60,
+		Functions: []string{"min", "max", "avg", "sum", "count", "last"},
+	}})
+	if err != nil {
+		t.Fatalf("unable to create aggregate stage: %s", err)
+	}
+
+	out := processAll(t, stage,
+		counter("cpu", 60, 4),
+		counter("cpu", 61, 2),
+		counter("cpu", 119, 6),
+		counter("memory", 100, 1),
+	)
+	if len(out) != 1 || out[0].Metric != "memory" {
+		t.Fatalf("expected only unmatched metric to pass through, got %+v", out)
+	}
+
+	// The first point of the next window releases the previous one
+	out = processAll(t, stage, counter("cpu", 120, 10))
+	expected := map[string]float64{
+		"cpu_min":   2,
+		"cpu_max":   6,
+		"cpu_avg":   4,
+		"cpu_sum":   12,
+		"cpu_count": 3,
+		"cpu_last":  6,
+	}
+	if len(out) != len(expected) {
+		t.Fatalf("expected %d aggregates, got %+v", len(expected), out)
+	}
+	for _, m := range out {
+		if m.Timestamp != 60 {
+			t.Errorf("expected timestamp at start of window, got %+v", m)
+		}
+		if m.Tags["device"] != "dev1" {
+			t.Errorf("expected tags to be kept, got %+v", m)
+		}
+		if v, ok := expected[m.Metric]; !ok || v != m.Value {
+			t.Errorf("unexpected aggregate %+v", m)
+		}
+	}
+}
+
+func TestAggregateStageSingleFunction(t *testing.T) {
+	stage, _ := NewAggregateStage([]AggregateRule{{Pattern: "cpu", Window: 10}})
+	out := processAll(t, stage,
+		counter("cpu", 0, 1),
+		counter("cpu", 5, 3),
+		counter("cpu", 10, 1),
+	)
+	if len(out) != 1 || out[0].Metric != "cpu" || out[0].Value != 2 {
+		t.Errorf("expected a single average named after the metric, got %+v", out)
+	}
+}
+
+func TestAggregateStageLateDatapoint(t *testing.T) {
+	stage, _ := NewAggregateStage([]AggregateRule{{Pattern: "cpu", Window: 10}})
+	out := processAll(t, stage,
+		counter("cpu", 10, 1),
+		counter("cpu", 20, 2),
+		counter("cpu", 15, 3),
+	)
+	if len(out) != 1 || out[0].Value != 1 {
+		t.Errorf("expected late datapoint to be dropped, got %+v", out)
+	}
+}
+
+func TestAggregateStageFlush(t *testing.T) {
+	stage, _ := NewAggregateStage([]AggregateRule{{Pattern: "cpu", Window: 10, Functions: []string{"MAX"}}})
+	processAll(t, stage, counter("cpu", 0, 1), counter("cpu", 1, 5))
+
+	if out := stage.Flush(time.Now()); len(out) != 0 {
+		t.Errorf("flushed an active window: %+v", out)
+	}
+	out := stage.Flush(time.Now().Add(10 * time.Second))
+	if len(out) != 1 || out[0].Value != 5 {
+		t.Errorf("expected idle window to be flushed, got %+v", out)
+	}
+	if out := stage.Flush(time.Now().Add(20 * time.Second)); len(out) != 0 {
+		t.Errorf("window was flushed twice: %+v", out)
+	}
+}
+
+func TestAggregateStageLateDatapointAfterFlush(t *testing.T) {
+	stage, _ := NewAggregateStage([]AggregateRule{{Pattern: "cpu", Window: 10}})
+	processAll(t, stage, counter("cpu", 10, 1), counter("cpu", 11, 3))
+	if out := stage.Flush(time.Now().Add(10 * time.Second)); len(out) != 1 || out[0].Value != 2 {
+		t.Fatalf("expected idle window to be flushed, got %+v", out)
+	}
+
+	out := processAll(t, stage, counter("cpu", 15, 10), counter("cpu", 25, 4))
+	if len(out) != 0 {
+		t.Errorf("expected the flushed window not to be emitted again, got %+v", out)
+	}
+	if out := stage.Flush(time.Now().Add(10 * time.Second)); len(out) != 1 || out[0].Value != 4 || out[0].Timestamp != 20 {
+		t.Errorf("expected only the later window to be flushed, got %+v", out)
+	}
+}
+
+func TestAggregateStageInvalidRule(t *testing.T) {
+	rules := []AggregateRule{
+		{Pattern: "(", Window: 10},
+		{Pattern: "cpu"},
+		{Pattern: "cpu", Window: 10, Functions: []string{"median"}},
+	}
+	for _, rule := range rules {
+		if _, err := NewAggregateStage([]AggregateRule{rule}); err == nil {
+			t.Errorf("expected rule %+v to be rejected", rule)
+		}
+	}
+}
+
+func TestProcessorFlushRunsLaterStages(t *testing.T) {
+	aggregates, _ := NewAggregateStage([]AggregateRule{{Pattern: "octets", Window: 10, Functions: []string{"last"}}})
+	rates, _ := NewRateStage([]RateRule{{Pattern: "octets"}})
+	p := &MetricProcessor{Stages: []MetricStage{aggregates, rates}}
+
+	for _, m := range []Metric{counter("octets", 0, 100), counter("octets", 10, 200)} {
+		if _, err := p.Process(&m); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+	out := p.Flush(time.Now().Add(time.Minute))
+	if len(out) != 1 || out[0].Value != 10 {
+		t.Errorf("expected flushed aggregate to be converted to a rate, got %+v", out)
+	}
+}
@@ -0,0 +1,199 @@
+package metricshipper
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zenoss/glog"
+	"github.com/zenoss/websocket"
+)
+
+// How long to wait for the OAuth2 token endpoint
+const tokenRequestTimeout = 10 * time.Second
+
+// Authenticator supplies the Authorization header for new connections to the
+// consumer, and when connections made with it have to be replaced, or the
+// zero time if they can be kept.
+type Authenticator interface {
+	Authorization() (header string, renew time.Time, err error)
+}
+
+// BasicAuth authenticates with a username and password
+type BasicAuth struct {
+	Username string
+	Password string
+}
+
+func (a BasicAuth) Authorization() (string, time.Time, error) {
+	data := []byte(a.Username + ":" + a.Password)
+	return "basic " + base64.StdEncoding.EncodeToString(data), time.Time{}, nil
+}
+
+// BearerToken authenticates with a static token
+type BearerToken string
+
+func (a BearerToken) Authorization() (string, time.Time, error) {
+	return "Bearer " + string(a), time.Time{}, nil
+}
+
+// TokenFile authenticates with a bearer token read from a file, such as a
+// Kubernetes projected service account token. The file is read again when
+// it changes.
+type TokenFile struct {
+	sync.Mutex
+	path     string
+	modified time.Time
+	token    string
+}
+
+func NewTokenFile(path string) (*TokenFile, error) {
+	a := &TokenFile{path: path}
+	if _, _, err := a.Authorization(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *TokenFile) Authorization() (string, time.Time, error) {
+	a.Lock()
+	defer a.Unlock()
+	info, err := os.Stat(a.path)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	if a.token == "" || info.ModTime().After(a.modified) {
+		data, err := ioutil.ReadFile(a.path)
+		if err != nil {
+			return "", time.Time{}, err
+		}
+		token := strings.TrimSpace(string(data))
+		if token == "" {
+			return "", time.Time{}, fmt.Errorf("Token file %s is empty", a.path)
+		}
+		a.token = token
+		a.modified = info.ModTime()
+	}
+	return "Bearer " + a.token, time.Time{}, nil
+}
+
+// OAuth2ClientCredentials authenticates with tokens from an OAuth2 client
+// credentials grant. A new token is requested once four fifths of the
+// lifetime of the current one have passed, and connections made with the old
+// token are replaced then.
+type OAuth2ClientCredentials struct {
+	sync.Mutex
+	TokenURL     string
+	ClientID     string
+	ClientSecret string
+	Scopes       []string
+	client       *http.Client
+	token        string
+	refresh      time.Time
+}
+
+type oauth2Token struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int64  `json:"expires_in"`
+}
+
+func (a *OAuth2ClientCredentials) Authorization() (string, time.Time, error) {
+	a.Lock()
+	defer a.Unlock()
+	if a.token == "" || (!a.refresh.IsZero() && !time.Now().Before(a.refresh)) {
+		if err := a.fetch(); err != nil {
+			return "", time.Time{}, err
+		}
+	}
+	return "Bearer " + a.token, a.refresh, nil
+}
+
+func (a *OAuth2ClientCredentials) fetch() error {
+	if a.client == nil {
+		a.client = &http.Client{Timeout: tokenRequestTimeout}
+	}
+	form := url.Values{"grant_type": {"client_credentials"}}
+	if len(a.Scopes) > 0 {
+		form.Set("scope", strings.Join(a.Scopes, " "))
+	}
+	req, err := http.NewRequest("POST", a.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(a.ClientID), url.QueryEscape(a.ClientSecret))
+
+	issued := time.Now()
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Token request to %s failed: %s", a.TokenURL, resp.Status)
+	}
+	var token oauth2Token
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return err
+	}
+	if token.AccessToken == "" {
+		return fmt.Errorf("No access token in response from %s", a.TokenURL)
+	}
+	a.token = token.AccessToken
+	a.refresh = time.Time{}
+	if token.ExpiresIn > 0 {
+		lifetime := time.Duration(token.ExpiresIn) * time.Second
+		a.refresh = issued.Add(lifetime * 4 / 5)
+	}
+	glog.V(1).Infof("Obtained access token from %s, valid for %d seconds", a.TokenURL, token.ExpiresIn)
+	return nil
+}
+
+// NewAuthenticator creates the authenticator for the configured scheme
+func NewAuthenticator(config *ShipperConfig) (Authenticator, error) {
+	switch strings.ToLower(config.AuthScheme) {
+	case "", "basic":
+		return BasicAuth{Username: config.Username, Password: config.Password}, nil
+	case "bearer":
+		if config.AuthToken == "" {
+			return nil, fmt.Errorf("Bearer authentication needs a token")
+		}
+		return BearerToken(config.AuthToken), nil
+	case "token-file":
+		return NewTokenFile(config.AuthTokenFile)
+	case "oauth2":
+		if config.OAuthTokenURL == "" {
+			return nil, fmt.Errorf("OAuth2 authentication needs a token URL")
+		}
+		return &OAuth2ClientCredentials{
+			TokenURL:     config.OAuthTokenURL,
+			ClientID:     config.OAuthClientID,
+			ClientSecret: config.OAuthClientSecret,
+			Scopes:       strings.Fields(config.OAuthScopes),
+		}, nil
+	}
+	return nil, fmt.Errorf("Unknown authentication scheme %q", config.AuthScheme)
+}
+
+// WithAuthenticator authenticates connections to the consumer with auth
+// instead of the username and password
+func WithAuthenticator(auth Authenticator) PublisherOption {
+	return func(w *WebsocketPublisher) {
+		w.dialHooks = append(w.dialHooks, func(config *websocket.Config) (time.Time, error) {
+			header, renew, err := auth.Authorization()
+			if err != nil {
+				return renew, err
+			}
+			config.Header.Set("Authorization", header)
+			return renew, nil
+		})
+	}
+}
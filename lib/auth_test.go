@@ -0,0 +1,139 @@
+package metricshipper
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/zenoss/websocket"
+)
+
+func authorization(t *testing.T, auth Authenticator) (string, time.Time) {
+	header, renew, err := auth.Authorization()
+	if err != nil {
+		t.Fatalf("unable to authenticate: %s", err)
+	}
+	return header, renew
+}
+
+func TestStaticAuthenticators(t *testing.T) {
+	if header, _ := authorization(t, BasicAuth{Username: "admin", Password: "zenoss"}); header != "basic YWRtaW46emVub3Nz" {
+		t.Errorf("unexpected basic authorization %q", header)
+	}
+	if header, renew := authorization(t, BearerToken("abc")); header != "Bearer abc" || !renew.IsZero() {
+		t.Errorf("unexpected bearer authorization %q", header)
+	}
+}
+
+func TestTokenFile(t *testing.T) {
+	f, _ := ioutil.TempFile("", "token")
+	defer os.Remove(f.Name())
+	f.WriteString("first\n")
+	f.Close()
+
+	auth, err := NewTokenFile(f.Name())
+	if err != nil {
+		t.Fatalf("unable to read token file: %s", err)
+	}
+	if header, _ := authorization(t, auth); header != "Bearer first" {
+		t.Errorf("unexpected authorization %q", header)
+	}
+	ioutil.WriteFile(f.Name(), []byte("second"), 0600)
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(f.Name(), later, later)
+	if header, _ := authorization(t, auth); header != "Bearer second" {
+		t.Errorf("expected the rotated token, got %q", header)
+	}
+
+	if _, err := NewTokenFile(f.Name() + ".missing"); err == nil {
+		t.Error("expected a missing token file to be rejected")
+	}
+}
+
+func TestOAuth2ClientCredentials(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, secret, _ := r.BasicAuth()
+		if r.FormValue("grant_type") != "client_credentials" || id != "shipper" || secret != "s3cret" ||
+			r.FormValue("scope") != "metrics.write" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		n := atomic.AddInt32(&requests, 1)
+		fmt.Fprintf(w, `{"access_token":"token%d","token_type":"bearer","expires_in":1}`, n)
+	}))
+	defer server.Close()
+
+	auth, err := NewAuthenticator(&ShipperConfig{
+		AuthScheme:        "oauth2",
+		OAuthTokenURL:     server.URL,
+		OAuthClientID:     "shipper",
+		OAuthClientSecret: "s3cret",
+		OAuthScopes:       "metrics.write",
+	})
+	if err != nil {
+		t.Fatalf("unable to create authenticator: %s", err)
+	}
+	header, renew := authorization(t, auth)
+	if header != "Bearer token1" || renew.IsZero() || renew.After(time.Now().Add(time.Second)) {
+		t.Errorf("unexpected authorization %q, renewed at %s", header, renew)
+	}
+	if header, _ := authorization(t, auth); header != "Bearer token1" {
+		t.Errorf("expected the token to be reused, got %q", header)
+	}
+	time.Sleep(renew.Sub(time.Now()))
+	if header, _ := authorization(t, auth); header != "Bearer token2" {
+		t.Errorf("expected the token to be refreshed, got %q", header)
+	}
+
+	failing := &OAuth2ClientCredentials{TokenURL: server.URL, ClientID: "other"}
+	if _, _, err := failing.Authorization(); err == nil {
+		t.Error("expected a refused token request to fail")
+	}
+}
+
+func TestNewAuthenticatorErrors(t *testing.T) {
+	for _, config := range []ShipperConfig{
+		{AuthScheme: "kerberos"},
+		{AuthScheme: "bearer"},
+		{AuthScheme: "oauth2"},
+		{AuthScheme: "token-file", AuthTokenFile: "/nonexistent"},
+	} {
+		if _, err := NewAuthenticator(&config); err == nil {
+			t.Errorf("expected %+v to be rejected", config)
+		}
+	}
+}
+
+func TestAuthenticatedConnections(t *testing.T) {
+	headers := make(chan string, 10)
+	server := httptest.NewServer(websocket.Handler(func(ws *websocket.Conn) {
+		headers <- ws.Request().Header.Get("Authorization")
+		ws.Read(make([]byte, 1))
+	}))
+	defer server.Close()
+
+	var w WebsocketPublisher
+	WithAuthenticator(BearerToken("abc"))(&w)
+	config := serverConfig(t, server)
+	config.Header.Set("Authorization", "basic YWRtaW46emVub3Nz")
+	pool := NewWebSocketConnPool(1, ReconnectPolicy{InitialDelay: time.Millisecond}, 0, Failover, w.dialHooks, nil, config)
+	conn := pool.Get()
+	if header := <-headers; header != "Bearer abc" {
+		t.Errorf("expected the authenticator to replace the basic credentials, got %q", header)
+	}
+
+	// Connections are replaced once their credentials expire
+	conn.renew = time.Now().Add(-time.Second)
+	pool.Put(conn)
+	select {
+	case <-headers:
+	case <-time.After(time.Second):
+		t.Error("expected the connection to be replaced")
+	}
+}
@@ -14,6 +14,8 @@ type Backoff struct {
         maxDelay    float64
         base        float64
 	collisions  float64
+	total       uint64    // Collisions ever seen
+	until       time.Time // Wait at least until then
 	sync.Mutex
 }
 
@@ -29,6 +31,7 @@ func NewBackoff(window, maxCollisions, maxDelay int) *Backoff {
 func (b *Backoff) Collision() {
 	b.Lock()
 	defer b.Unlock()
+	b.total++
 	if b.collisions >= float64(b.max) {
 		return
 	}
@@ -41,7 +44,32 @@ func (b *Backoff) Collision() {
 	}()
 }
 
+// Total returns the number of collisions seen, including those that have
+// left the window
+func (b *Backoff) Total() uint64 {
+	b.Lock()
+	defer b.Unlock()
+	return b.total
+}
+
+// Pause makes Wait block until at least d from now, such as when the
+// consumer asks to be retried later
+func (b *Backoff) Pause(d time.Duration) {
+	b.Lock()
+	defer b.Unlock()
+	if until := time.Now().Add(d); until.After(b.until) {
+		b.until = until
+	}
+}
+
 func (b *Backoff) Wait() {
+	b.Lock()
+	pause := b.until.Sub(time.Now())
+	b.Unlock()
+	if pause > 0 {
+		glog.V(2).Infof("Waiting %s as asked by the consumer", pause)
+		time.Sleep(pause)
+	}
 	if b.collisions == 0 {
 		return
 	}
@@ -0,0 +1,111 @@
+package metricshipper
+
+import (
+	"sync"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/zenoss/glog"
+)
+
+// Estimated bytes of a metric in a JSON batch besides its name and tags: the
+// keys, the timestamp, the value and the punctuation
+const (
+	metricOverhead = 80
+	tagOverhead    = 6
+	tagValueSize   = 20 // Tag values other than strings
+)
+
+// metricSize estimates the size of a metric in a JSON batch, which is also an
+// upper bound for the binary encodings, without encoding it
+func metricSize(m *Metric) int {
+	size := metricOverhead + len(m.Metric)
+	for key, value := range m.Tags {
+		size += tagOverhead + len(key)
+		if s, ok := value.(string); ok {
+			size += len(s)
+		} else {
+			size += tagValueSize
+		}
+	}
+	return size
+}
+
+// WithMaxBatchBytes ends a batch before the estimated size of its metrics
+// exceeds limit bytes, in addition to the limit on their number. A metric
+// larger than limit is sent in a batch of its own.
+func WithMaxBatchBytes(limit int) PublisherOption {
+	return func(w *WebsocketPublisher) {
+		w.maxBatchBytes = limit
+	}
+}
+
+// WithAdaptiveBatching varies the number of metrics per batch between min and
+// the batch size of the publisher. Batches shrink by half whenever sending
+// one takes longer than target or the consumer asks to slow down, and grow
+// again while batches are sent within half of target.
+func WithAdaptiveBatching(min int, target time.Duration) PublisherOption {
+	return func(w *WebsocketPublisher) {
+		w.sizer = &batchSizer{
+			min:    min,
+			target: target,
+			Size:   metrics.GetOrRegisterGauge("adaptiveBatchSize", StatsRegistry),
+		}
+	}
+}
+
+// batchSizer decides the size of batches from how quickly the consumer
+// takes them, increasing it additively and decreasing it multiplicatively
+type batchSizer struct {
+	sync.Mutex
+	min    int
+	max    int
+	size   int
+	target time.Duration
+	Size   metrics.Gauge
+}
+
+// start begins at the largest size, which is also the one without adapting
+func (s *batchSizer) start(max int) {
+	if s.min < 1 {
+		s.min = 1
+	}
+	if s.min > max {
+		s.min = max
+	}
+	s.max, s.size = max, max
+	s.Size.Update(int64(s.size))
+}
+
+func (s *batchSizer) current() int {
+	s.Lock()
+	defer s.Unlock()
+	return s.size
+}
+
+// observe adjusts the size after a batch was sent in latency, or was refused
+// because the consumer is busy if collided
+func (s *batchSizer) observe(latency time.Duration, collided bool) {
+	s.Lock()
+	defer s.Unlock()
+	size := s.size
+	switch {
+	case collided || latency > s.target:
+		if size /= 2; size < s.min {
+			size = s.min
+		}
+	case latency < s.target/2:
+		step := (s.max - s.min) / 16
+		if step < 1 {
+			step = 1
+		}
+		if size += step; size > s.max {
+			size = s.max
+		}
+	}
+	if size != s.size {
+		glog.V(2).Infof("Batch size changed from %d to %d after sending in %s", s.size, size, latency)
+		s.size = size
+		s.Size.Update(int64(size))
+	}
+}
@@ -0,0 +1,76 @@
+package metricshipper
+
+import (
+	"testing"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+func TestGetBatchMaxBytes(t *testing.T) {
+	w := &WebsocketPublisher{Outgoing: make(chan Metric, 10), batch_size: 10, batch_timeout: 0.01}
+	small := taggedMetric("load", 1, map[string]interface{}{"device": "sw01"})
+	size := metricSize(&small)
+	w.maxBatchBytes = 2*size + size/2
+	for i := 0; i < 4; i++ {
+		w.Outgoing <- small
+	}
+
+	num, _, _, held := w.getBatch(nil)
+	if num != 2 || held == nil {
+		t.Fatalf("expected 2 metrics and one held over, got %d and %v", num, held)
+	}
+	num, _, _, held = w.getBatch(held)
+	if num != 2 || held != nil {
+		t.Fatalf("expected the held metric and the last one, got %d and %v", num, held)
+	}
+
+	// A metric over the limit is sent on its own
+	w.maxBatchBytes = size - 1
+	w.Outgoing <- small
+	w.Outgoing <- small
+	if num, _, _, held = w.getBatch(nil); num != 1 || held == nil {
+		t.Errorf("expected an oversized metric in a batch of its own, got %d", num)
+	}
+}
+
+func TestSubSecondBatchTimeout(t *testing.T) {
+	w := &WebsocketPublisher{Outgoing: make(chan Metric, 10), batch_size: 10, batch_timeout: 0.05}
+	w.Outgoing <- taggedMetric("load", 1, nil)
+	start := time.Now()
+	num, _, _, _ := w.getBatch(nil)
+	if elapsed := time.Since(start); num != 1 || elapsed < 50*time.Millisecond || elapsed > 500*time.Millisecond {
+		t.Errorf("expected 1 metric after 50ms, got %d after %s", num, elapsed)
+	}
+}
+
+func TestBatchSizer(t *testing.T) {
+	s := &batchSizer{min: 4, target: 100 * time.Millisecond, Size: metrics.NewGauge()}
+	s.start(36)
+	if s.current() != 36 {
+		t.Fatalf("expected to start at the maximum, got %d", s.current())
+	}
+	s.observe(200*time.Millisecond, false)
+	if s.current() != 18 {
+		t.Errorf("expected a slow batch to halve the size, got %d", s.current())
+	}
+	s.observe(10*time.Millisecond, true)
+	s.observe(10*time.Millisecond, true)
+	if s.current() != 4 {
+		t.Errorf("expected collisions to shrink the size to the minimum, got %d", s.current())
+	}
+	s.observe(75*time.Millisecond, false)
+	if s.current() != 4 {
+		t.Errorf("expected a batch close to the target to keep the size, got %d", s.current())
+	}
+	s.observe(10*time.Millisecond, false)
+	if s.current() != 6 || s.Size.Value() != 6 {
+		t.Errorf("expected a fast batch to grow the size by 2, got %d", s.current())
+	}
+	for i := 0; i < 20; i++ {
+		s.observe(10*time.Millisecond, false)
+	}
+	if s.current() != 36 {
+		t.Errorf("expected the size to stop at the maximum, got %d", s.current())
+	}
+}
@@ -0,0 +1,99 @@
+package metricshipper
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"code.google.com/p/snappy-go/snappy"
+	"github.com/rcrowley/go-metrics"
+)
+
+// Request header declaring the compression of websocket messages to the
+// consumer. The websocket library doesn't support permessage-deflate, so
+// compressed JSON batches are sent as binary messages instead.
+const compressionHeader = "X-Metricshipper-Compression"
+
+// Bytes sent to the consumer before compression, by every output. Compare
+// with txBytes for the compression ratio.
+var uncompressedBytes = metrics.GetOrRegisterMeter("txUncompressedBytes", StatsRegistry)
+
+// Compression codecs
+const (
+	codecNone    = "none"
+	codecSnappy  = "snappy"
+	codecGzip    = "gzip"
+	codecDeflate = "deflate"
+)
+
+// Codec compresses messages to the consumer
+type Codec struct {
+	Name  string // none, snappy, gzip or deflate
+	Level int    // Compression level for gzip and deflate, from 1 to 9, or -1 for the default
+}
+
+// ParseCodec returns the codec with the given name and level
+func ParseCodec(name string, level int) (Codec, error) {
+	codec := Codec{Name: strings.ToLower(name), Level: level}
+	switch codec.Name {
+	case codecNone, codecSnappy:
+	case codecGzip, codecDeflate:
+		if level < flate.DefaultCompression || level > flate.BestCompression {
+			return codec, fmt.Errorf("Invalid %s compression level %d", codec.Name, level)
+		}
+	default:
+		return codec, fmt.Errorf("Unknown compression %q", name)
+	}
+	return codec, nil
+}
+
+// Compress returns data compressed with the codec
+func (c Codec) Compress(data []byte) ([]byte, error) {
+	var (
+		buf    bytes.Buffer
+		writer io.WriteCloser
+		err    error
+	)
+	switch c.Name {
+	case codecSnappy:
+		return snappy.Encode(nil, data)
+	case codecGzip:
+		writer, err = gzip.NewWriterLevel(&buf, c.Level)
+	case codecDeflate:
+		writer, err = flate.NewWriter(&buf, c.Level)
+	default:
+		return data, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	writer.Write(data)
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Decompress reverses Compress
+func (c Codec) Decompress(data []byte) ([]byte, error) {
+	var reader io.ReadCloser
+	switch c.Name {
+	case codecSnappy:
+		return snappy.Decode(nil, data)
+	case codecGzip:
+		var err error
+		if reader, err = gzip.NewReader(bytes.NewReader(data)); err != nil {
+			return nil, err
+		}
+	case codecDeflate:
+		reader = flate.NewReader(bytes.NewReader(data))
+	default:
+		return data, nil
+	}
+	defer reader.Close()
+	return ioutil.ReadAll(reader)
+}
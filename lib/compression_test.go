@@ -0,0 +1,37 @@
+package metricshipper
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestCodecs(t *testing.T) {
+	data := []byte(strings.Repeat(`{"metric":"cpu","value":1}`, 100))
+	for _, name := range []string{"none", "snappy", "gzip", "deflate", "GZIP"} {
+		for _, level := range []int{-1, 1, 9} {
+			codec, err := ParseCodec(name, level)
+			if err != nil {
+				t.Fatalf("unable to parse %s: %s", name, err)
+			}
+			compressed, err := codec.Compress(data)
+			if err != nil {
+				t.Fatalf("unable to compress with %s: %s", name, err)
+			}
+			if codec.Name != codecNone && len(compressed) >= len(data)/4 {
+				t.Errorf("expected %s to compress %d bytes, got %d", name, len(data), len(compressed))
+			}
+			decompressed, err := codec.Decompress(compressed)
+			if err != nil || !bytes.Equal(data, decompressed) {
+				t.Errorf("expected %s to round trip, got %v", name, err)
+			}
+		}
+	}
+
+	if _, err := ParseCodec("lz4", -1); err == nil {
+		t.Error("expected an unknown codec to be rejected")
+	}
+	if _, err := ParseCodec("gzip", 10); err == nil {
+		t.Error("expected an invalid level to be rejected")
+	}
+}
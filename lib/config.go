@@ -9,7 +9,9 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math"
 	"os"
+	"reflect"
 	"strings"
 )
 
@@ -17,23 +19,82 @@ type ShipperConfig struct {
 	ConfigFilePath         string  `long:"config" short:"c" description:"Path to configuration file"`
 	RedisUrl               string  `long:"redis-url" description:"Redis URL to subscribe to" default:"redis://localhost:6379/0/metrics"`
 	Readers                int     `long:"readers" description:"Maximum number of simultaneous readers from Redis" default:"2"`
-	ConsumerUrl            string  `long:"consumer-url" description:"WebSocket URL of consumer to publish to" default:"ws://localhost:8080/ws/metrics/store"`
+	ConsumerUrl            string  `long:"consumer-url" description:"WebSocket URL of consumer to publish to, or a comma-separated list of consumers" default:"ws://localhost:8080/ws/metrics/store"`
+	ConsumerBalancing      string  `long:"consumer-balancing" description:"How to spread connections over several consumers (valid values are 'failover', 'round-robin' or 'least-outstanding')" default:"failover"`
+	Output                 string  `long:"output" description:"How to send metrics to the consumer (valid values are 'websocket', 'http', 'opentsdb', 'graphite', 'influxdb', 'prometheus', 'file' or 'stdout')" default:"websocket"`
+	OutputFile             string  `long:"output-file" description:"File to write metrics to as newline-delimited JSON with the file output"`
+	OutputFileMaxSize      int     `long:"output-file-max-size" description:"Size in megabytes to rotate the output file at (0 disables)" default:"100"`
+	OutputFileMaxAge       int     `long:"output-file-max-age" description:"Age in seconds to rotate the output file at (0 disables)" default:"0"`
+	OutputFileGzip         bool    `long:"output-file-gzip" description:"Compress rotated output files with gzip"`
+	HTTPGzip               bool    `long:"http-gzip" description:"Compress the bodies of HTTP requests to the consumer with gzip; same as --compression=gzip"`
+	Compression            string  `long:"compression" description:"How to compress batches to the consumer (valid values are 'none', 'snappy', 'gzip' or 'deflate'); binary batches are compressed with snappy and JSON batches are not compressed if not set"`
+	CompressionLevel       int     `long:"compression-level" description:"Level of gzip and deflate compression, from 1 (fastest) to 9 (smallest), or -1 for the default" default:"-1"`
+	HTTPTimeout            int     `long:"http-timeout-seconds" description:"Seconds to wait for the consumer to respond to an HTTP request" default:"30"`
+	GraphiteTags           bool    `long:"graphite-tags" description:"Send tags to Graphite as tags rather than flattening their values into the path"`
 	Writers                int     `long:"writers" description:"Maximum number of simultaneous writers to the consumer" default:"1"`
+	TLSCAFile              string  `long:"tls-ca-file" description:"PEM bundle of CAs to trust for wss:// consumers instead of the system ones"`
+	TLSCertFile            string  `long:"tls-cert-file" description:"PEM client certificate to present to wss:// consumers"`
+	TLSKeyFile             string  `long:"tls-key-file" description:"PEM key of the client certificate"`
+	TLSServerName          string  `long:"tls-server-name" description:"Name to verify the consumer certificate against instead of the host in the URL"`
+	TLSMinVersion          string  `long:"tls-min-version" description:"Minimum TLS version to accept (valid values are '1.0', '1.1', '1.2' or '1.3')"`
+	ProxyURL               string  `long:"proxy-url" description:"HTTP proxy to reach the consumer through; HTTPS_PROXY, HTTP_PROXY and NO_PROXY are used if not set"`
+	ProxyUsername          string  `long:"proxy-username" description:"Username to authenticate with the proxy"`
+	ProxyPassword          string  `long:"proxy-password" description:"Password to authenticate with the proxy"`
 	MaxBufferSize          int     `long:"max-buffer-size" description:"Maximum number of messages to keep in the internal buffer" default:"1024"`
 	MaxBatchSize           int     `long:"max-batch-size" description:"Number of messages to send to the consumer in a single web socket call. This should be smaller than the buffer size." default:"64"`
 	BatchTimeout           float64 `long:"batch-timeout-seconds" description:"Maximum time in seconds to wait for messages from the internal buffer to be ready before making a web socket call with current metrics." default:"1"`
-	Encoding               string  `long:"encoding" description:"Encoding for metric publishing (valid values are 'json' or 'binary')" default:"binary"`
+	MaxBatchBytes          int     `long:"max-batch-bytes" description:"Estimated size in bytes to end a batch at, in addition to the maximum batch size (0 disables)" default:"0"`
+	AdaptiveBatching       bool    `long:"adaptive-batching" description:"Vary the number of messages per batch between the minimum and maximum batch size according to how quickly the consumer takes them"`
+	MinBatchSize           int     `long:"min-batch-size" description:"Smallest number of messages per batch with adaptive batching" default:"1"`
+	TargetBatchLatency     int     `long:"target-batch-latency-ms" description:"Milliseconds sending a batch should take with adaptive batching; batches shrink when it takes longer" default:"100"`
+	Encoding               string  `long:"encoding" description:"Encoding for metric publishing (valid values are 'json', 'binary', 'protobuf' or 'msgpack')" default:"binary"`
+	BinaryVersion          int     `long:"binary-version" description:"Highest binary encoding version to offer the consumer (0 or 1); websocket consumers that don't pick version 1 get version 0" default:"0"`
+	BinaryXOR              bool    `long:"binary-xor" description:"Compress values with XOR encoding in binary encoding version 1"`
+	DictionaryMaxEntries   int     `long:"dictionary-max-entries" description:"Entries of the binary encoding dictionary of a connection to reset it at (0 disables)" default:"0"`
 	BackoffWindow          int     `long:"backoff-window-seconds" description:"Rolling time period in seconds to consider collision messages from the consumer." default:"60"`
 	MaxBackoffSteps        int     `long:"max-backoff-steps" description:"Maximum number of collisions to consider for exponential backoff." default:"1200"`
 	MaxBackoffDelay        int     `long:"max-backoff-delay" description:"Maximum milliseconds per request to wait due to backoff (worst case)." default:"10000"`
 	RetryConnectionTimeout int     `long:"retry-connection-timeout" description:"Sleep time between connection retry in seconds" default:"1"`
+	ReconnectMaxDelay      int     `long:"reconnect-max-delay" description:"Maximum seconds between attempts to reconnect to a consumer; the delay doubles from retry-connection-timeout with every failure" default:"32"`
+	ReconnectJitter        float64 `long:"reconnect-jitter" description:"Fraction of each reconnection delay to shorten it by at random, from 0 to 1" default:"0.5"`
+	HealthAddress          string  `long:"health-address" description:"Address to serve the health of the shipper on, at /health (such as ':8088'); disabled if not set"`
+	HealthInterval         int     `long:"health-interval" description:"Seconds between reports of the health of the shipper (0 disables logging them)" default:"5"`
+	HealthMarkerFile       string  `long:"health-marker-file" description:"File to create while no consumer can be reached, and remove once one can; disabled if not set"`
 	MaxConnectionAge       int     `long:"max-connection-age" description:"Max lifespan of a websocket connection in seconds" default:"600"`
+	KeepaliveInterval      int     `long:"keepalive-interval-seconds" description:"Seconds a websocket connection may be idle before it is pinged (0 disables)" default:"30"`
+	PongTimeout            int     `long:"pong-timeout-seconds" description:"Seconds to wait for the consumer to answer a ping before replacing the connection" default:"10"`
+	WriteTimeout           int     `long:"write-timeout-seconds" description:"Seconds sending a batch on a websocket connection may take before the connection is replaced (0 disables)" default:"30"`
 	Verbosity              int     `long:"verbosity" short:"v" description:"Set the glog logging verbosity" default:"0"`
 	Username               string  `long:"username" description:"Username to use when connecting to the consumer"`
 	Password               string  `long:"password" description:"Password to use when connecting to the consumer"`
+	AuthScheme             string  `long:"auth" description:"How to authenticate with the consumer (valid values are 'basic', 'bearer', 'token-file' or 'oauth2')" default:"basic"`
+	AuthToken              string  `long:"auth-token" description:"Token for bearer authentication"`
+	AuthTokenFile          string  `long:"auth-token-file" description:"File to read the bearer token from; read again when it changes"`
+	OAuthTokenURL          string  `long:"oauth-token-url" description:"OAuth2 token endpoint for client credentials authentication"`
+	OAuthClientID          string  `long:"oauth-client-id" description:"OAuth2 client id"`
+	OAuthClientSecret      string  `long:"oauth-client-secret" description:"OAuth2 client secret"`
+	OAuthScopes            string  `long:"oauth-scopes" description:"Space-separated OAuth2 scopes to request"`
 	CPUs                   int     `long:"num-cpus" description:"Number of CPUs to use." default:"4"`
 	StatsInterval          int     `long:"stats-interval" description:"Number of seconds between publishing stats" default:"30"`
 	MtraceEnabled          bool    `long:"mtrace-enabled" description:"Enables metric traces in conjunction with traceMetricName traceMetricKey settings on collector" default:"false"`
+	SpoolDir               string  `long:"spool-dir" description:"Directory to spool batches to while the consumer is unavailable; spooling is disabled if not set"`
+	SpoolSegmentSize       int     `long:"spool-segment-size" description:"Maximum size in megabytes of each spool segment file" default:"16"`
+	SpoolMaxSize           int     `long:"spool-max-size" description:"Maximum total size in megabytes of the spool; the oldest segments are discarded beyond this" default:"1024"`
+	SpoolAfter             int     `long:"spool-after-seconds" description:"Seconds to wait for a consumer connection before spooling a batch" default:"5"`
+	AckTimeout             int     `long:"ack-timeout-seconds" description:"Seconds to wait for the consumer to acknowledge each batch before sending it again (0 disables acknowledged delivery)" default:"0"`
+	RetryAttempts          int     `long:"retry-attempts" description:"Attempts to send a batch the consumer can't accept before isolating and dead-lettering the metrics responsible, at least 1 (1 disables retries)" default:"3"`
+	RetryDelay             int     `long:"retry-delay-ms" description:"Milliseconds to wait before sending a failed batch again; doubled with every attempt" default:"100"`
+	MaxRetryDelay          int     `long:"max-retry-delay-ms" description:"Maximum milliseconds to wait before sending a failed batch again" default:"10000"`
+	DeadLetterFile         string  `long:"dead-letter-file" description:"File to record metrics that could not be delivered in; they are only logged if not set"`
+	ProcessorWorkers       int     `long:"processor-workers" description:"Number of workers processing metrics; each series is always handled by the same worker" default:"1"`
+	DedupWindow            int     `long:"dedup-window-seconds" description:"Suppress datapoints with the same metric, tags and timestamp seen within this many seconds (0 disables)" default:"0"`
+	DedupMaxEntries        int     `long:"dedup-max-entries" description:"Maximum number of datapoints remembered for duplicate suppression" default:"100000"`
+
+	// Processing rules are only available from the configuration file
+	Scripts    []ScriptRule
+	Rates      []RateRule
+	Aggregates []AggregateRule
+	Taps       []TapRule
 }
 
 func LoadYAMLConfig(reader io.Reader, cfg *ShipperConfig) error {
@@ -48,12 +109,67 @@ func LoadYAMLConfig(reader io.Reader, cfg *ShipperConfig) error {
 	return nil
 }
 
+// zeroableOptions are the options for which 0 is a setting of its own, such
+// as disabling a feature, rather than the default. Merging only takes
+// non-zero values, so these are marked unset before parsing and resolved
+// after merging.
+var zeroableOptions = []string{"KeepaliveInterval", "WriteTimeout", "OutputFileMaxSize", "ReconnectJitter", "HealthInterval"}
+
+// unsetOption marks a zeroable option that wasn't set
+const unsetOption = math.MinInt32
+
+func optionValue(field reflect.Value) float64 {
+	if field.Kind() == reflect.Float64 {
+		return field.Float()
+	}
+	return float64(field.Int())
+}
+
+func setOptionValue(field reflect.Value, value float64) {
+	if field.Kind() == reflect.Float64 {
+		field.SetFloat(value)
+	} else {
+		field.SetInt(int64(value))
+	}
+}
+
+// markUnset marks the zeroable options of cfg unset before parsing into it
+func markUnset(cfg *ShipperConfig) {
+	v := reflect.ValueOf(cfg).Elem()
+	for _, name := range zeroableOptions {
+		setOptionValue(v.FieldByName(name), unsetOption)
+	}
+}
+
+// MergeShipperConfig overrides the defaults with the non-zero values of the
+// config file, then with those of the command line. Zeroable options are
+// taken from the last of them that sets them, even to 0.
+func MergeShipperConfig(defaults, cfgfile, commandline *ShipperConfig) *ShipperConfig {
+	runtimeopts := *defaults
+	mergo.Merge(&runtimeopts, *cfgfile)
+	mergo.Merge(&runtimeopts, *commandline)
+
+	runtime := reflect.ValueOf(&runtimeopts).Elem()
+	for _, name := range zeroableOptions {
+		value := optionValue(reflect.ValueOf(defaults).Elem().FieldByName(name))
+		for _, cfg := range []*ShipperConfig{cfgfile, commandline} {
+			if v := optionValue(reflect.ValueOf(cfg).Elem().FieldByName(name)); v != unsetOption {
+				value = v
+			}
+		}
+		setOptionValue(runtime.FieldByName(name), value)
+	}
+	return &runtimeopts
+}
+
 func ParseShipperConfig() (*ShipperConfig, error) {
 
 	// Create the structs to be merged together later
 	defaultopts := &ShipperConfig{}
 	cfgfileopts := &ShipperConfig{}
 	commandlineopts := &ShipperConfig{}
+	markUnset(cfgfileopts)
+	markUnset(commandlineopts)
 
 	// Parse command-line options with no defaults
 	parser := flags.NewParser(commandlineopts, flags.Default|flags.IgnoreDefaults)
@@ -70,20 +186,17 @@ func ParseShipperConfig() (*ShipperConfig, error) {
 	// Parse the options with no arguments to get defaults
 	flags.ParseArgs(defaultopts, make([]string, 0))
 
-	// Set runtimeopts to defaults
-	runtimeopts := defaultopts
-
-	// Replace runtimeopts with non-zero config file values
-	mergo.Merge(runtimeopts, *cfgfileopts)
-
-	// Replace runtimeopts with non-zero commandline values
-	mergo.Merge(runtimeopts, *commandlineopts)
+	// Replace the defaults with the config file values, then with the
+	// commandline values
+	runtimeopts := MergeShipperConfig(defaultopts, cfgfileopts, commandlineopts)
 
 	glog.V(1).Infof("runtime metricshipper options: %+v", runtimeopts)
 
 	// Validate encoding
 	encoding := strings.ToLower(runtimeopts.Encoding)
-	if encoding != "json" && encoding != "binary" {
+	switch encoding {
+	case "json", "binary", encodingProtobuf, encodingMsgpack:
+	default:
 		return nil, fmt.Errorf("Invalid encoding: %s", runtimeopts.Encoding)
 	}
 	glog.SetVerbosity(runtimeopts.Verbosity)
@@ -141,3 +141,101 @@ func TestMergeOverrideAll(t *testing.T) {
 		t.Errorf("all non-empty options should have been merged into empty destination\nexpected: %+v \n  actual: %+v", &expectedopts, actualopts)
 	}
 }
+
+func TestParseRates(t *testing.T) {
+	config := `
+rates:
+  - pattern: ^ifHCInOctets
+    counterbits: 64
+    keepraw: true
+    suffix: _bps
+  - pattern: ^ifInErrors
+    maxrate: 1000
+`
+	shipperConfig := &ShipperConfig{}
+	if err := LoadYAMLConfig(strings.NewReader(config), shipperConfig); err != nil {
+		t.Fatalf("Unable to parse config: %s", err)
+	}
+	expected := []RateRule{
+		{Pattern: "^ifHCInOctets", CounterBits: 64, KeepRaw: true, Suffix: "_bps"},
+		{Pattern: "^ifInErrors", MaxRate: 1000},
+	}
+	if !reflect.DeepEqual(expected, shipperConfig.Rates) {
+		t.Errorf("expected %+v, got %+v", expected, shipperConfig.Rates)
+	}
+}
+
+func TestParseTaps(t *testing.T) {
+	config := `
+taps:
+  - pattern: Octets$
+    output: file
+    path: /tmp/octets.ndjson
+    maxsize: 10
+    maxage: 3600
+    gzip: true
+  - output: stdout
+`
+	shipperConfig := &ShipperConfig{}
+	if err := LoadYAMLConfig(strings.NewReader(config), shipperConfig); err != nil {
+		t.Fatalf("Unable to parse config: %s", err)
+	}
+	expected := []TapRule{
+		{Pattern: "Octets$", Output: "file", Path: "/tmp/octets.ndjson", MaxSize: 10, MaxAge: 3600, Gzip: true},
+		{Output: "stdout"},
+	}
+	if !reflect.DeepEqual(expected, shipperConfig.Taps) {
+		t.Errorf("expected %+v, got %+v", expected, shipperConfig.Taps)
+	}
+}
+
+// mergeConfig merges a config file and command line over the defaults, the
+// way ParseShipperConfig does
+func mergeConfig(t *testing.T, cfgfile string, args ...string) *ShipperConfig {
+	defaultopts, cfgfileopts, commandlineopts := &ShipperConfig{}, &ShipperConfig{}, &ShipperConfig{}
+	markUnset(cfgfileopts)
+	markUnset(commandlineopts)
+	if _, err := flags.NewParser(commandlineopts, flags.IgnoreDefaults).ParseArgs(args); err != nil {
+		t.Fatalf("Unable to parse %v: %s", args, err)
+	}
+	if err := LoadYAMLConfig(strings.NewReader(cfgfile), cfgfileopts); err != nil {
+		t.Fatalf("Unable to parse config: %s", err)
+	}
+	flags.ParseArgs(defaultopts, make([]string, 0))
+	return MergeShipperConfig(defaultopts, cfgfileopts, commandlineopts)
+}
+
+func TestMergeZeroableOptions(t *testing.T) {
+	for _, tc := range []struct {
+		cfgfile  string
+		args     []string
+		field    string
+		expected interface{}
+	}{
+		{"", nil, "KeepaliveInterval", 30},
+		{"keepaliveinterval: 0", nil, "KeepaliveInterval", 0},
+		{"keepaliveinterval: 0", []string{"--keepalive-interval-seconds=15"}, "KeepaliveInterval", 15},
+		{"keepaliveinterval: 15", []string{"--keepalive-interval-seconds=0"}, "KeepaliveInterval", 0},
+		{"", nil, "WriteTimeout", 30},
+		{"writetimeout: 0", nil, "WriteTimeout", 0},
+		{"", []string{"--write-timeout-seconds=0"}, "WriteTimeout", 0},
+		{"", nil, "OutputFileMaxSize", 100},
+		{"outputfilemaxsize: 0", nil, "OutputFileMaxSize", 0},
+		{"", []string{"--output-file-max-size=0"}, "OutputFileMaxSize", 0},
+		{"", nil, "ReconnectJitter", 0.5},
+		{"reconnectjitter: 0", nil, "ReconnectJitter", 0.0},
+		{"reconnectjitter: 0.25", []string{"--reconnect-jitter=0"}, "ReconnectJitter", 0.0},
+		{"", nil, "HealthInterval", 5},
+		{"healthinterval: 0", nil, "HealthInterval", 0},
+		{"", []string{"--health-interval=0"}, "HealthInterval", 0},
+	} {
+		config := mergeConfig(t, tc.cfgfile, tc.args...)
+		if actual := reflect.ValueOf(config).Elem().FieldByName(tc.field).Interface(); actual != tc.expected {
+			t.Errorf("expected %s to be %v with %q and %v, got %v", tc.field, tc.expected, tc.cfgfile, tc.args, actual)
+		}
+	}
+	// Other options keep ignoring zero values
+	if config := mergeConfig(t, "maxbuffersize: 0"); config.MaxBufferSize != 1024 {
+		t.Errorf("expected the default buffer size, got %d", config.MaxBufferSize)
+	}
+}
@@ -0,0 +1,70 @@
+package metricshipper
+
+import (
+	"container/list"
+	"strconv"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/zenoss/glog"
+)
+
+type dedupEntry struct {
+	key  string
+	seen time.Time
+}
+
+// DedupStage suppresses datapoints that have already been seen for the same
+// series and timestamp within a sliding window. Memory is bounded by evicting
+// the oldest entries once maxEntries is reached. It must only be used from a
+// single goroutine.
+type DedupStage struct {
+	window     time.Duration
+	maxEntries int
+	entries    *list.List // Oldest first
+	index      map[string]*list.Element
+	Suppressed metrics.Meter
+}
+
+func NewDedupStage(window time.Duration, maxEntries int) *DedupStage {
+	return &DedupStage{
+		window:     window,
+		maxEntries: maxEntries,
+		entries:    list.New(),
+		index:      make(map[string]*list.Element),
+		Suppressed: metrics.GetOrRegisterMeter("suppressedDuplicates", StatsRegistry),
+	}
+}
+
+func (s *DedupStage) Process(metric Metric) ([]Metric, error) {
+	now := time.Now()
+	s.expire(now)
+
+	key := metric.SeriesKey() + "@" + strconv.FormatFloat(metric.Timestamp, 'f', -1, 64)
+	if _, ok := s.index[key]; ok {
+		glog.V(3).Infof("Suppressing duplicate datapoint %s", key)
+		s.Suppressed.Mark(1)
+		return nil, nil
+	}
+
+	s.index[key] = s.entries.PushBack(&dedupEntry{key: key, seen: now})
+	if s.maxEntries > 0 && s.entries.Len() > s.maxEntries {
+		s.remove(s.entries.Front())
+	}
+	return []Metric{metric}, nil
+}
+
+// expire forgets entries that have fallen out of the window.
+func (s *DedupStage) expire(now time.Time) {
+	for e := s.entries.Front(); e != nil; e = s.entries.Front() {
+		if now.Sub(e.Value.(*dedupEntry).seen) < s.window {
+			return
+		}
+		s.remove(e)
+	}
+}
+
+func (s *DedupStage) remove(e *list.Element) {
+	s.entries.Remove(e)
+	delete(s.index, e.Value.(*dedupEntry).key)
+}
@@ -0,0 +1,54 @@
+package metricshipper
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDedupStage(t *testing.T) {
+	stage := NewDedupStage(time.Minute, 100)
+	before := stage.Suppressed.Count()
+
+	other := counter("octets", 100, 1)
+	other.Tags = map[string]interface{}{"device": "dev2"}
+	out := processAll(t, stage,
+		counter("octets", 100, 1),
+		counter("octets", 100, 1),
+		counter("octets", 110, 1),
+		other,
+		counter("octets", 110, 2),
+	)
+	if len(out) != 3 {
+		t.Errorf("expected 3 unique datapoints, got %+v", out)
+	}
+	if suppressed := stage.Suppressed.Count() - before; suppressed != 2 {
+		t.Errorf("expected 2 suppressed duplicates, got %d", suppressed)
+	}
+}
+
+func TestDedupStageWindow(t *testing.T) {
+	stage := NewDedupStage(10*time.Millisecond, 100)
+	processAll(t, stage, counter("octets", 100, 1))
+	time.Sleep(20 * time.Millisecond)
+	if out := processAll(t, stage, counter("octets", 100, 1)); len(out) != 1 {
+		t.Errorf("expected datapoint outside of the window to pass, got %+v", out)
+	}
+}
+
+func TestDedupStageMaxEntries(t *testing.T) {
+	stage := NewDedupStage(time.Minute, 2)
+	processAll(t, stage,
+		counter("octets", 100, 1),
+		counter("octets", 110, 1),
+		counter("octets", 120, 1),
+	)
+	if len(stage.index) != 2 || stage.entries.Len() != 2 {
+		t.Errorf("expected 2 entries to be remembered, got %d", stage.entries.Len())
+	}
+	if out := processAll(t, stage, counter("octets", 100, 1)); len(out) != 1 {
+		t.Errorf("expected oldest entry to have been evicted, got %+v", out)
+	}
+	if out := processAll(t, stage, counter("octets", 120, 1)); len(out) != 0 {
+		t.Errorf("expected newest entry to be remembered, got %+v", out)
+	}
+}
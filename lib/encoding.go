@@ -5,29 +5,86 @@ import (
 	"code.google.com/p/snappy-go/snappy"
 	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
+	"strconv"
 	"sync"
+	"sync/atomic"
+
+	"github.com/rcrowley/go-metrics"
 )
 
 // Binary encoding for metrics.
 
+// Metrics of the translation dictionaries of every connection
+var (
+	dictionaryEntries    = metrics.GetOrRegisterGauge("dictionaryEntries", StatsRegistry)
+	dictionaryHits       = metrics.GetOrRegisterMeter("dictionaryHits", StatsRegistry)
+	dictionaryMisses     = metrics.GetOrRegisterMeter("dictionaryMisses", StatsRegistry)
+	dictionaryHitPercent = metrics.GetOrRegisterGauge("dictionaryHitPercent", StatsRegistry)
+	dictionaryResets     = metrics.GetOrRegisterMeter("dictionaryResets", StatsRegistry)
+	dictionaryEntryCount int64 // Value of dictionaryEntries, accessed atomically
+)
+
 type dictionary struct {
 	sync.Mutex
-	last  int32
-	trans map[string]int32
+	last   int32
+	trans  map[string]int32
+	hits   int64 // Lookups since the last call to record
+	misses int64
 }
 
 func (d *dictionary) get(s string) (int32, bool) {
+	d.Lock()
+	defer d.Unlock()
 	if val, ok := d.trans[s]; ok {
+		d.hits++
 		return val, false
 	}
-	d.Lock()
-	defer d.Unlock()
+	d.misses++
 	d.last += 1
 	d.trans[s] = d.last
+	dictionaryEntries.Update(atomic.AddInt64(&dictionaryEntryCount, 1))
 	return d.last, true
 }
 
+// size returns the number of entries
+func (d *dictionary) size() int {
+	d.Lock()
+	defer d.Unlock()
+	return len(d.trans)
+}
+
+// reset forgets every entry, so they are sent along again when used next
+func (d *dictionary) reset() {
+	d.discard()
+	dictionaryResets.Mark(1)
+}
+
+// discard forgets every entry without counting a reset, for dictionaries
+// that are no longer used
+func (d *dictionary) discard() {
+	d.Lock()
+	defer d.Unlock()
+	dictionaryEntries.Update(atomic.AddInt64(&dictionaryEntryCount, -int64(len(d.trans))))
+	d.trans = make(map[string]int32)
+	d.last = 0
+}
+
+// record adds the lookups of a batch to the dictionary metrics
+func (d *dictionary) record() {
+	d.Lock()
+	hits, misses := d.hits, d.misses
+	d.hits, d.misses = 0, 0
+	d.Unlock()
+	dictionaryHits.Mark(hits)
+	dictionaryMisses.Mark(misses)
+	if total := dictionaryHits.Rate1() + dictionaryMisses.Rate1(); total > 0 {
+		dictionaryHitPercent.Update(int64(100 * dictionaryHits.Rate1() / total))
+	}
+}
+
 func (batch *MetricBatch) MarshalBinary(d *dictionary, doSnappy bool) ([]byte, error) {
 	var (
 		metric_name int32
@@ -35,6 +92,17 @@ func (batch *MetricBatch) MarshalBinary(d *dictionary, doSnappy bool) ([]byte, e
 		tag_val     int32
 		change      bool
 	)
+	// The counts have to fit their fields, and are checked before the
+	// dictionary is changed
+	if len(batch.Metrics) > math.MaxInt16 {
+		return nil, BatchError{Err: fmt.Errorf("batch of %d metrics is too large for binary encoding version 0", len(batch.Metrics))}
+	}
+	for i := range batch.Metrics {
+		if len(batch.Metrics[i].Tags) > math.MaxInt8 {
+			return nil, BatchError{Err: fmt.Errorf("metric %s has %d tags, too many for binary encoding version 0",
+				batch.Metrics[i].Metric, len(batch.Metrics[i].Tags))}
+		}
+	}
 	dict := make(map[string]string)
 	buf := new(bytes.Buffer)
 	// Write the API version
@@ -70,6 +138,7 @@ func (batch *MetricBatch) MarshalBinary(d *dictionary, doSnappy bool) ([]byte, e
 		return nil, err
 	}
 	buf.Write(changes)
+	d.record()
 
 	if doSnappy {
 		result := []byte{}
@@ -78,3 +147,434 @@ func (batch *MetricBatch) MarshalBinary(d *dictionary, doSnappy bool) ([]byte, e
 
 	return buf.Bytes(), nil
 }
+
+// Binary encoding versions. Version 1 is only sent to consumers that accept
+// it when the connection is established.
+const (
+	binaryV0 = 0
+	binaryV1 = 1
+)
+
+// Flags of a version 1 message
+const binaryXORValues = 1
+
+// Types of tag values in version 1
+const (
+	tagString = iota
+	tagInt
+	tagFloat
+	tagBool
+	tagNull
+)
+
+// MarshalBinaryV1 encodes a batch in version 1 of the binary encoding:
+//
+//	int8     version (1)
+//	uint8    flags (1 if values are XOR compressed)
+//	uvarint  number of metrics
+//	for each metric:
+//	  varint   timestamp in milliseconds; the difference from the previous
+//	           one after the first
+//	  uvarint  metric name id
+//	  uvarint  number of tags
+//	  for each tag: uvarint key id, uint8 value type and the value: a
+//	  uvarint id for strings, a varint for integers, a big endian float64
+//	  for floats, a byte for booleans and nothing for nulls
+//	uvarint  length of the values, followed by the values: big endian
+//	         float64s, or XOR compressed
+//	JSON     dictionary updates, as in version 0
+//
+// Unlike version 0, counts are not limited and tag values keep their type.
+// Timestamps are kept to the millisecond.
+func (batch *MetricBatch) MarshalBinaryV1(d *dictionary, compress bool, doSnappy bool) ([]byte, error) {
+	dict := make(map[string]string)
+	id := func(s string) uint64 {
+		val, change := d.get(s)
+		if change {
+			dict[strconv.Itoa(int(val))] = s
+		}
+		return uint64(val)
+	}
+	var (
+		buf  []byte
+		tmp  [binary.MaxVarintLen64]byte
+		last int64
+	)
+	putUvarint := func(v uint64) { buf = append(buf, tmp[:binary.PutUvarint(tmp[:], v)]...) }
+	putVarint := func(v int64) { buf = append(buf, tmp[:binary.PutVarint(tmp[:], v)]...) }
+	putFloat := func(v float64) {
+		binary.BigEndian.PutUint64(tmp[:8], math.Float64bits(v))
+		buf = append(buf, tmp[:8]...)
+	}
+
+	flags := byte(0)
+	if compress {
+		flags |= binaryXORValues
+	}
+	buf = append(buf, binaryV1, flags)
+	putUvarint(uint64(len(batch.Metrics)))
+	values := make([]float64, len(batch.Metrics))
+	for i, metric := range batch.Metrics {
+		timestamp := int64(math.Floor(metric.Timestamp*1000 + 0.5))
+		putVarint(timestamp - last)
+		last = timestamp
+		putUvarint(id(metric.Metric))
+		putUvarint(uint64(len(metric.Tags)))
+		for k, v := range metric.Tags {
+			putUvarint(id(k))
+			switch kind, value := tagValue(v); kind {
+			case tagString:
+				buf = append(buf, tagString)
+				putUvarint(id(value.(string)))
+			case tagInt:
+				buf = append(buf, tagInt)
+				putVarint(value.(int64))
+			case tagFloat:
+				buf = append(buf, tagFloat)
+				putFloat(value.(float64))
+			case tagBool:
+				b := byte(0)
+				if value.(bool) {
+					b = 1
+				}
+				buf = append(buf, tagBool, b)
+			default:
+				buf = append(buf, tagNull)
+			}
+		}
+		values[i] = metric.Value
+	}
+	if compress {
+		encoded := compressValues(values)
+		putUvarint(uint64(len(encoded)))
+		buf = append(buf, encoded...)
+	} else {
+		putUvarint(uint64(len(values) * 8))
+		for _, v := range values {
+			putFloat(v)
+		}
+	}
+	changes, err := json.Marshal(dict)
+	if err != nil {
+		return nil, err
+	}
+	buf = append(buf, changes...)
+	d.record()
+
+	if doSnappy {
+		return snappy.Encode(nil, buf)
+	}
+	return buf, nil
+}
+
+// tagValue returns the type a tag value is encoded as in version 1, with the
+// value converted to string, int64, float64 or bool
+func tagValue(v interface{}) (int, interface{}) {
+	switch v := v.(type) {
+	case nil:
+		return tagNull, nil
+	case string:
+		return tagString, v
+	case bool:
+		return tagBool, v
+	case float64:
+		return tagFloat, v
+	case float32:
+		return tagFloat, float64(v)
+	case int:
+		return tagInt, int64(v)
+	case int8:
+		return tagInt, int64(v)
+	case int16:
+		return tagInt, int64(v)
+	case int32:
+		return tagInt, int64(v)
+	case int64:
+		return tagInt, v
+	case uint8:
+		return tagInt, int64(v)
+	case uint16:
+		return tagInt, int64(v)
+	case uint32:
+		return tagInt, int64(v)
+	case uint:
+		if uint64(v) <= math.MaxInt64 {
+			return tagInt, int64(v)
+		}
+	case uint64:
+		if v <= math.MaxInt64 {
+			return tagInt, int64(v)
+		}
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return tagInt, i
+		}
+		if f, err := v.Float64(); err == nil {
+			return tagFloat, f
+		}
+	}
+	return tagString, fmt.Sprintf("%v", v)
+}
+
+// ReceiverDictionary mirrors the translation dictionary of a sender. Each
+// binary message only carries the entries added while encoding it, so a
+// receiver must decode every message of a connection, in order, with the same
+// dictionary.
+type ReceiverDictionary struct {
+	sync.Mutex
+	names map[int32]string
+}
+
+func NewReceiverDictionary() *ReceiverDictionary {
+	return &ReceiverDictionary{names: make(map[int32]string)}
+}
+
+// update applies the dictionary entries trailing a message
+func (d *ReceiverDictionary) update(changes map[string]string) error {
+	d.Lock()
+	defer d.Unlock()
+	for key, name := range changes {
+		id, err := strconv.ParseInt(key, 10, 32)
+		if err != nil {
+			return fmt.Errorf("invalid dictionary id %q", key)
+		}
+		d.names[int32(id)] = name
+	}
+	return nil
+}
+
+func (d *ReceiverDictionary) lookup(id int32) (string, error) {
+	d.Lock()
+	defer d.Unlock()
+	name, ok := d.names[id]
+	if !ok {
+		return "", fmt.Errorf("unknown dictionary id %d", id)
+	}
+	return name, nil
+}
+
+// binaryTag is a tag as written on the wire. Value is a dictionary id for
+// strings, and Typed holds the value of other types.
+type binaryTag struct {
+	Key, Value int32
+	Kind       int
+	Typed      interface{}
+}
+
+type binaryMetric struct {
+	timestamp float64
+	name      int32
+	value     float64
+	tags      []binaryTag
+}
+
+// UnmarshalBinary decodes a message written by MarshalBinary or
+// MarshalBinaryV1, replacing the metrics of the batch. Tag values are decoded
+// as strings in version 0, and as string, int64, float64, bool or nil in
+// version 1.
+func (batch *MetricBatch) UnmarshalBinary(data []byte, d *ReceiverDictionary, doSnappy bool) error {
+	if doSnappy {
+		var err error
+		if data, err = snappy.Decode(nil, data); err != nil {
+			return err
+		}
+	}
+	if len(data) == 0 {
+		return errors.New("empty message")
+	}
+	var (
+		encoded []binaryMetric
+		rest    *bytes.Reader
+		err     error
+	)
+	switch data[0] {
+	case binaryV0:
+		encoded, rest, err = decodeBinaryV0(bytes.NewReader(data[1:]))
+	case binaryV1:
+		encoded, rest, err = decodeBinaryV1(bytes.NewReader(data[1:]))
+	default:
+		return fmt.Errorf("unsupported binary encoding version %d", data[0])
+	}
+	if err != nil {
+		return err
+	}
+	// Metrics may refer to entries only defined by the dictionary updates at
+	// the end of the message, so names are resolved once those are applied
+	changes := make(map[string]string)
+	if err := json.NewDecoder(rest).Decode(&changes); err != nil {
+		return fmt.Errorf("invalid dictionary updates: %s", err)
+	}
+	if err := d.update(changes); err != nil {
+		return err
+	}
+
+	metrics := make([]Metric, len(encoded))
+	for i, m := range encoded {
+		name, err := d.lookup(m.name)
+		if err != nil {
+			return err
+		}
+		metrics[i] = Metric{Timestamp: m.timestamp, Metric: name, Value: m.value}
+		if len(m.tags) == 0 {
+			continue
+		}
+		metrics[i].Tags = make(map[string]interface{}, len(m.tags))
+		for _, tag := range m.tags {
+			key, err := d.lookup(tag.Key)
+			if err != nil {
+				return err
+			}
+			if tag.Kind != tagString {
+				metrics[i].Tags[key] = tag.Typed
+				continue
+			}
+			value, err := d.lookup(tag.Value)
+			if err != nil {
+				return err
+			}
+			metrics[i].Tags[key] = value
+		}
+	}
+	batch.Metrics = metrics
+	return nil
+}
+
+func decodeBinaryV0(buf *bytes.Reader) ([]binaryMetric, *bytes.Reader, error) {
+	var count int16
+	if err := binary.Read(buf, binary.BigEndian, &count); err != nil {
+		return nil, nil, err
+	}
+	// Every metric takes 21 bytes before its tags
+	if count < 0 || int(count) > buf.Len()/21 {
+		return nil, nil, fmt.Errorf("invalid message of %d metrics", count)
+	}
+	encoded := make([]binaryMetric, count)
+	for i := range encoded {
+		m := &encoded[i]
+		var tagCount int8
+		for _, field := range []interface{}{&m.timestamp, &m.name, &m.value, &tagCount} {
+			if err := binary.Read(buf, binary.BigEndian, field); err != nil {
+				return nil, nil, fmt.Errorf("truncated metric %d: %s", i, err)
+			}
+		}
+		// Every tag takes 8 bytes
+		if tagCount < 0 || int(tagCount) > buf.Len()/8 {
+			return nil, nil, fmt.Errorf("invalid tags of metric %d", i)
+		}
+		m.tags = make([]binaryTag, tagCount)
+		for j := range m.tags {
+			tag := &m.tags[j]
+			for _, field := range []interface{}{&tag.Key, &tag.Value} {
+				if err := binary.Read(buf, binary.BigEndian, field); err != nil {
+					return nil, nil, fmt.Errorf("truncated tags of metric %d: %s", i, err)
+				}
+			}
+		}
+	}
+	return encoded, buf, nil
+}
+
+func decodeBinaryV1(buf *bytes.Reader) ([]binaryMetric, *bytes.Reader, error) {
+	flags, err := buf.ReadByte()
+	if err != nil {
+		return nil, nil, err
+	}
+	readId := func() (int32, error) {
+		id, err := binary.ReadUvarint(buf)
+		if err == nil && id > math.MaxInt32 {
+			err = fmt.Errorf("invalid dictionary id %d", id)
+		}
+		return int32(id), err
+	}
+	readFloat := func() (float64, error) {
+		var bits uint64
+		err := binary.Read(buf, binary.BigEndian, &bits)
+		return math.Float64frombits(bits), err
+	}
+
+	count, err := binary.ReadUvarint(buf)
+	if err != nil {
+		return nil, nil, err
+	}
+	// Every metric takes at least three bytes
+	if count > uint64(buf.Len())/3 {
+		return nil, nil, fmt.Errorf("truncated message of %d metrics", count)
+	}
+	encoded := make([]binaryMetric, count)
+	var timestamp int64
+	for i := range encoded {
+		m := &encoded[i]
+		delta, err := binary.ReadVarint(buf)
+		if err != nil {
+			return nil, nil, fmt.Errorf("truncated metric %d: %s", i, err)
+		}
+		timestamp += delta
+		m.timestamp = float64(timestamp) / 1000
+		if m.name, err = readId(); err != nil {
+			return nil, nil, fmt.Errorf("truncated metric %d: %s", i, err)
+		}
+		tagCount, err := binary.ReadUvarint(buf)
+		if err != nil {
+			return nil, nil, fmt.Errorf("truncated metric %d: %s", i, err)
+		}
+		// Every tag takes at least two bytes
+		if tagCount > uint64(buf.Len())/2 {
+			return nil, nil, fmt.Errorf("truncated tags of metric %d", i)
+		}
+		m.tags = make([]binaryTag, tagCount)
+		for j := range m.tags {
+			tag := &m.tags[j]
+			if tag.Key, err = readId(); err != nil {
+				return nil, nil, fmt.Errorf("truncated tags of metric %d: %s", i, err)
+			}
+			kind, err := buf.ReadByte()
+			if err != nil {
+				return nil, nil, fmt.Errorf("truncated tags of metric %d: %s", i, err)
+			}
+			tag.Kind = int(kind)
+			switch tag.Kind {
+			case tagString:
+				tag.Value, err = readId()
+			case tagInt:
+				tag.Typed, err = binary.ReadVarint(buf)
+			case tagFloat:
+				tag.Typed, err = readFloat()
+			case tagBool:
+				var b byte
+				b, err = buf.ReadByte()
+				tag.Typed = b != 0
+			case tagNull:
+			default:
+				err = fmt.Errorf("unknown tag type %d", kind)
+			}
+			if err != nil {
+				return nil, nil, fmt.Errorf("invalid tags of metric %d: %s", i, err)
+			}
+		}
+	}
+
+	size, err := binary.ReadUvarint(buf)
+	if err != nil || size > uint64(buf.Len()) {
+		return nil, nil, errors.New("truncated values")
+	}
+	data := make([]byte, size)
+	buf.Read(data)
+	var values []float64
+	if flags&binaryXORValues != 0 {
+		if values, err = decompressValues(data, len(encoded)); err != nil {
+			return nil, nil, err
+		}
+	} else {
+		if size != count*8 {
+			return nil, nil, errors.New("truncated values")
+		}
+		values = make([]float64, count)
+		for i := range values {
+			values[i] = math.Float64frombits(binary.BigEndian.Uint64(data[i*8:]))
+		}
+	}
+	for i := range encoded {
+		encoded[i].value = values[i]
+	}
+	return encoded, buf, nil
+}
@@ -5,7 +5,11 @@ import (
 
 	"bytes"
 	"encoding/hex"
+	"encoding/json"
+	"fmt"
 	"io/ioutil"
+	"math"
+	"reflect"
 	"testing"
 )
 
@@ -42,4 +46,323 @@ func TestMarshalBinary(t *testing.T) {
 	if 0 != bytes.Compare(expected, actual) {
 		t.Fatalf("expected does not match actual\n%s\n%s", hex.Dump(expected), hex.Dump(actual))
 	}
-}
\ No newline at end of file
+}
+func TestUnmarshalBinary(t *testing.T) {
+	expected, err := ioutil.ReadFile("encoding_test.expected")
+	if err != nil {
+		t.Fatalf("unable to read expected file: %s", err)
+	}
+	batch := &MetricBatch{}
+	if err := batch.UnmarshalBinary(expected, NewReceiverDictionary(), false); err != nil {
+		t.Fatalf("unable to unmarshal binary: %s", err)
+	}
+	metrics := []Metric{
+		{Timestamp: 1.0, Metric: "foo", Value: 2.0},
+		{Timestamp: 3.0, Metric: "bar", Value: 5.0},
+		{Timestamp: 7.0, Metric: "baz", Value: 11.0},
+	}
+	if !reflect.DeepEqual(metrics, batch.Metrics) {
+		t.Errorf("expected %+v, got %+v", metrics, batch.Metrics)
+	}
+}
+
+func TestBinaryRoundTrip(t *testing.T) {
+	batches := []*MetricBatch{
+		{Metrics: []Metric{
+			{Timestamp: 1.5, Metric: "cpu", Value: 2, Tags: map[string]interface{}{"device": "sw01", "cpu": 2}},
+			{Timestamp: 1.5, Metric: "load", Value: 0.25},
+		}},
+		// Only new names are sent along with the second batch
+		{Metrics: []Metric{
+			{Timestamp: 2.5, Metric: "cpu", Value: 3, Tags: map[string]interface{}{"device": "sw02", "cpu": "2"}},
+		}},
+	}
+	sender := &dictionary{trans: make(map[string]int32)}
+	receiver := NewReceiverDictionary()
+	var messages [][]byte
+	for _, batch := range batches {
+		data, err := batch.MarshalBinary(sender, true)
+		if err != nil {
+			t.Fatalf("unable to marshal binary: %s", err)
+		}
+		messages = append(messages, data)
+
+		decoded := &MetricBatch{}
+		if err := decoded.UnmarshalBinary(data, receiver, true); err != nil {
+			t.Fatalf("unable to unmarshal binary: %s", err)
+		}
+		for i := range batch.Metrics {
+			m, d := batch.Metrics[i], decoded.Metrics[i]
+			if m.Timestamp != d.Timestamp || m.Metric != d.Metric || m.Value != d.Value || len(m.Tags) != len(d.Tags) {
+				t.Errorf("expected %+v, got %+v", m, d)
+			}
+			for k, v := range m.Tags {
+				if d.Tags[k] != fmt.Sprintf("%v", v) {
+					t.Errorf("expected tag %s to be %v, got %v", k, v, d.Tags[k])
+				}
+			}
+		}
+	}
+
+	// Without the entries of the first message the second can't be decoded
+	if err := (&MetricBatch{}).UnmarshalBinary(messages[1], NewReceiverDictionary(), true); err == nil {
+		t.Error("expected an unknown dictionary id to be an error")
+	}
+	if err := (&MetricBatch{}).UnmarshalBinary([]byte{1, 0, 0}, NewReceiverDictionary(), false); err == nil {
+		t.Error("expected an unknown version to be an error")
+	}
+	if err := (&MetricBatch{}).UnmarshalBinary([]byte{0, 0, 1, 0}, NewReceiverDictionary(), false); err == nil {
+		t.Error("expected a truncated message to be an error")
+	}
+}
+
+func TestBinaryV1RoundTrip(t *testing.T) {
+	tags := map[string]interface{}{
+		"device":  "sw01",
+		"cpu":     2,
+		"speed":   1.5e9,
+		"virtual": true,
+		"owner":   nil,
+	}
+	// More metrics and tags than version 0 can count
+	for i := 0; i < 200; i++ {
+		tags[fmt.Sprintf("tag%d", i)] = fmt.Sprintf("value%d", i%7)
+	}
+	batch := &MetricBatch{}
+	for i := 0; i < 40000; i++ {
+		batch.Metrics = append(batch.Metrics, Metric{
+			Timestamp: 1500000000.5 + float64(i%100),
+			Metric:    fmt.Sprintf("metric%d", i%10),
+			Value:     float64(i % 13),
+		})
+	}
+	batch.Metrics[0].Tags = tags
+	batch.Metrics[1].Value = math.NaN()
+
+	for _, compress := range []bool{false, true} {
+		data, err := batch.MarshalBinaryV1(&dictionary{trans: make(map[string]int32)}, compress, true)
+		if err != nil {
+			t.Fatalf("unable to marshal binary: %s", err)
+		}
+		decoded := &MetricBatch{}
+		if err := decoded.UnmarshalBinary(data, NewReceiverDictionary(), true); err != nil {
+			t.Fatalf("unable to unmarshal binary: %s", err)
+		}
+		if len(decoded.Metrics) != len(batch.Metrics) {
+			t.Fatalf("expected %d metrics, got %d", len(batch.Metrics), len(decoded.Metrics))
+		}
+		for i, m := range batch.Metrics {
+			d := decoded.Metrics[i]
+			if m.Timestamp != d.Timestamp || m.Metric != d.Metric ||
+				m.Value != d.Value && !(math.IsNaN(m.Value) && math.IsNaN(d.Value)) {
+				t.Fatalf("expected %+v, got %+v", m, d)
+			}
+		}
+		expected := map[string]interface{}{
+			"device":  "sw01",
+			"cpu":     int64(2),
+			"speed":   1.5e9,
+			"virtual": true,
+			"owner":   nil,
+		}
+		for k, v := range expected {
+			if actual, ok := decoded.Metrics[0].Tags[k]; !ok || actual != v {
+				t.Errorf("expected tag %s to be %#v, got %#v", k, v, actual)
+			}
+		}
+		if len(decoded.Metrics[0].Tags) != len(tags) || decoded.Metrics[0].Tags["tag199"] != "value3" {
+			t.Errorf("expected %d tags, got %d", len(tags), len(decoded.Metrics[0].Tags))
+		}
+	}
+}
+
+func TestBinaryV1IsSmaller(t *testing.T) {
+	batch := &MetricBatch{}
+	for i := 0; i < 64; i++ {
+		batch.Metrics = append(batch.Metrics, Metric{Timestamp: 1500000000 + float64(i), Metric: "cpu", Value: 50})
+	}
+	v0, _ := batch.MarshalBinary(&dictionary{trans: make(map[string]int32)}, false)
+	v1, _ := batch.MarshalBinaryV1(&dictionary{trans: make(map[string]int32)}, true, false)
+	if len(v1) >= len(v0)/4 {
+		t.Errorf("expected version 1 to be much smaller than %d bytes, got %d", len(v0), len(v1))
+	}
+}
+
+func TestUnmarshalBinaryV1Errors(t *testing.T) {
+	batch := &MetricBatch{Metrics: []Metric{{Timestamp: 1, Metric: "cpu", Value: 1}}}
+	data, err := batch.MarshalBinaryV1(&dictionary{trans: make(map[string]int32)}, true, false)
+	if err != nil {
+		t.Fatalf("unable to marshal binary: %s", err)
+	}
+	for i := 1; i < len(data); i++ {
+		if err := (&MetricBatch{}).UnmarshalBinary(data[:i], NewReceiverDictionary(), false); err == nil {
+			t.Errorf("expected a message truncated to %d bytes to be an error", i)
+		}
+	}
+	// A huge count must not be trusted
+	if err := (&MetricBatch{}).UnmarshalBinary([]byte{1, 0, 0xff, 0xff, 0xff, 0xff, 0x0f}, NewReceiverDictionary(), false); err == nil {
+		t.Error("expected an impossible metric count to be an error")
+	}
+}
+
+func TestUnmarshalBinaryV0Errors(t *testing.T) {
+	batch := &MetricBatch{Metrics: []Metric{{Timestamp: 1, Metric: "cpu", Value: 1, Tags: map[string]interface{}{"device": "sw01"}}}}
+	data, err := batch.MarshalBinary(&dictionary{trans: make(map[string]int32)}, false)
+	if err != nil {
+		t.Fatalf("unable to marshal binary: %s", err)
+	}
+	// Cut the message in the middle of the metric and of its tag
+	for _, i := range []int{5, 20, 25} {
+		if err := (&MetricBatch{}).UnmarshalBinary(data[:i], NewReceiverDictionary(), false); err == nil {
+			t.Errorf("expected a message truncated to %d bytes to be an error", i)
+		}
+	}
+	// Negative counts of metrics and tags
+	for _, data := range [][]byte{
+		{0, 0xff, 0xff},
+		append([]byte{0, 0, 1}, append(make([]byte, 20), 0xff)...),
+	} {
+		if err := (&MetricBatch{}).UnmarshalBinary(data, NewReceiverDictionary(), false); err == nil {
+			t.Errorf("expected a negative count in %v to be an error", data)
+		}
+	}
+}
+
+func TestMarshalBinaryLimits(t *testing.T) {
+	d := &dictionary{trans: make(map[string]int32)}
+	tags := make(map[string]interface{})
+	for i := 0; i < 128; i++ {
+		tags[fmt.Sprintf("tag%d", i)] = i
+	}
+	for _, batch := range []*MetricBatch{
+		{Metrics: make([]Metric, 32768)},
+		{Metrics: []Metric{{Metric: "cpu", Tags: tags}}},
+	} {
+		if _, err := batch.MarshalBinary(d, false); !isBatchError(err) {
+			t.Errorf("expected a batch error, got %v", err)
+		}
+	}
+	if len(d.trans) != 0 {
+		t.Errorf("expected the dictionary to be left alone, got %d entries", len(d.trans))
+	}
+}
+
+func TestDictionaryReset(t *testing.T) {
+	before := dictionaryEntries.Value()
+	d := &dictionary{trans: make(map[string]int32)}
+	d.get("cpu")
+	d.get("load")
+	d.get("cpu")
+	if d.size() != 2 || dictionaryEntries.Value() != before+2 {
+		t.Errorf("expected 2 entries, got %d (%d counted)", d.size(), dictionaryEntries.Value()-before)
+	}
+	hits := dictionaryHits.Count()
+	d.record()
+	if dictionaryHits.Count() != hits+1 {
+		t.Errorf("expected 1 hit, got %d", dictionaryHits.Count()-hits)
+	}
+
+	resets := dictionaryResets.Count()
+	d.reset()
+	if d.size() != 0 || dictionaryEntries.Value() != before || dictionaryResets.Count() != resets+1 {
+		t.Error("expected the reset to forget every entry")
+	}
+	if id, change := d.get("load"); id != 1 || !change {
+		t.Errorf("expected ids to start over after a reset, got %d", id)
+	}
+	d.discard()
+}
+
+// benchmarkBatch is a batch of 64 metrics, most of them of the same series
+// as a previous one, with the tags of a typical device metric
+func benchmarkBatch() *MetricBatch {
+	batch := &MetricBatch{}
+	for i := 0; i < 64; i++ {
+		batch.Metrics = append(batch.Metrics, Metric{
+			Timestamp: 1500000000 + float64(i/8),
+			Metric:    fmt.Sprintf("ifInOctets%d", i%8),
+			Value:     float64(i * 1000),
+			Tags: map[string]interface{}{
+				"device":      "sw01",
+				"contextUUID": "6b8c1c36-6c1b-4c8f-9d1b-1b2d3e4f5a6b",
+				"key":         "Devices/sw01/os/interfaces/eth0",
+			},
+		})
+	}
+	return batch
+}
+
+func benchmarkMarshal(b *testing.B, marshal func(*MetricBatch) ([]byte, error)) {
+	batch := benchmarkBatch()
+	var size int
+	for i := 0; i < b.N; i++ {
+		data, err := marshal(batch)
+		if err != nil {
+			b.Fatal(err)
+		}
+		size = len(data)
+	}
+	b.SetBytes(int64(size))
+}
+
+func BenchmarkMarshalJSON(b *testing.B) {
+	benchmarkMarshal(b, func(batch *MetricBatch) ([]byte, error) { return json.Marshal(batch) })
+}
+
+// The dictionary is kept between batches, as on a connection
+func BenchmarkMarshalBinary(b *testing.B) {
+	d := &dictionary{trans: make(map[string]int32)}
+	benchmarkMarshal(b, func(batch *MetricBatch) ([]byte, error) { return batch.MarshalBinary(d, false) })
+}
+
+func BenchmarkMarshalBinaryV1(b *testing.B) {
+	d := &dictionary{trans: make(map[string]int32)}
+	benchmarkMarshal(b, func(batch *MetricBatch) ([]byte, error) { return batch.MarshalBinaryV1(d, true, false) })
+}
+
+func BenchmarkMarshalProtobuf(b *testing.B) {
+	benchmarkMarshal(b, (*MetricBatch).MarshalProtobuf)
+}
+
+func BenchmarkMarshalMsgpack(b *testing.B) {
+	benchmarkMarshal(b, (*MetricBatch).MarshalMsgpack)
+}
+
+func benchmarkUnmarshal(b *testing.B, data []byte, unmarshal func([]byte, *MetricBatch) error) {
+	b.SetBytes(int64(len(data)))
+	for i := 0; i < b.N; i++ {
+		if err := unmarshal(data, &MetricBatch{}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkUnmarshalJSON(b *testing.B) {
+	data, _ := json.Marshal(benchmarkBatch())
+	benchmarkUnmarshal(b, data, func(data []byte, batch *MetricBatch) error { return json.Unmarshal(data, batch) })
+}
+
+// Each message carries the whole dictionary, as the first of a connection
+func BenchmarkUnmarshalBinary(b *testing.B) {
+	data, _ := benchmarkBatch().MarshalBinary(&dictionary{trans: make(map[string]int32)}, false)
+	benchmarkUnmarshal(b, data, func(data []byte, batch *MetricBatch) error {
+		return batch.UnmarshalBinary(data, NewReceiverDictionary(), false)
+	})
+}
+
+func BenchmarkUnmarshalBinaryV1(b *testing.B) {
+	data, _ := benchmarkBatch().MarshalBinaryV1(&dictionary{trans: make(map[string]int32)}, true, false)
+	benchmarkUnmarshal(b, data, func(data []byte, batch *MetricBatch) error {
+		return batch.UnmarshalBinary(data, NewReceiverDictionary(), false)
+	})
+}
+
+func BenchmarkUnmarshalProtobuf(b *testing.B) {
+	data, _ := benchmarkBatch().MarshalProtobuf()
+	benchmarkUnmarshal(b, data, func(data []byte, batch *MetricBatch) error { return batch.UnmarshalProtobuf(data) })
+}
+
+func BenchmarkUnmarshalMsgpack(b *testing.B) {
+	data, _ := benchmarkBatch().MarshalMsgpack()
+	benchmarkUnmarshal(b, data, func(data []byte, batch *MetricBatch) error { return batch.UnmarshalMsgpack(data) })
+}
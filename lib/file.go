@@ -0,0 +1,254 @@
+package metricshipper
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/zenoss/glog"
+)
+
+// Suffix of rotated files, ahead of .gz if they are compressed
+const rotatedTimeFormat = "20060102T150405.000"
+
+// FileSender writes batches as newline-delimited JSON, one metric per line,
+// to a file or to stdout. Files are rotated once they reach a size or age
+// limit, by renaming them after the time of the rotation and optionally
+// compressing them, so the current file can be followed with tail -f.
+type FileSender struct {
+	sync.Mutex
+	path     string
+	maxSize  int64
+	maxAge   time.Duration
+	compress bool
+	out      io.Writer
+	file     *os.File // Open on path, if writing to a file; nil until reopened after a failed rotation
+	size     int64
+	opened   time.Time
+}
+
+// NewFileSender appends to the file at path, rotating it once it grows past
+// maxSize bytes or is older than maxAge; either limit is disabled if zero.
+func NewFileSender(path string, maxSize int64, maxAge time.Duration, compress bool) (*FileSender, error) {
+	f := &FileSender{
+		path:     path,
+		maxSize:  maxSize,
+		maxAge:   maxAge,
+		compress: compress,
+	}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// NewStdoutSender writes batches to stdout, without rotation
+func NewStdoutSender() *FileSender {
+	return &FileSender{out: os.Stdout}
+}
+
+func (f *FileSender) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file, f.out = file, file
+	f.size = info.Size()
+	f.opened = time.Now()
+	return nil
+}
+
+// rotate renames the current file and starts a new one. If that fails the
+// file is reopened by the next batch.
+func (f *FileSender) rotate() error {
+	if err := f.file.Close(); err != nil {
+		glog.Errorf("Unable to close %s: %s", f.path, err)
+	}
+	f.file, f.out = nil, nil
+	rotated := f.path + "." + time.Now().Format(rotatedTimeFormat)
+	if err := os.Rename(f.path, rotated); err != nil {
+		return err
+	}
+	if f.compress {
+		if err := compressFile(rotated); err != nil {
+			glog.Errorf("Unable to compress %s: %s", rotated, err)
+		}
+	}
+	return f.open()
+}
+
+// compressFile replaces a file with a gzipped copy
+func compressFile(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(path+".gz", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	writer := gzip.NewWriter(out)
+	_, err = io.Copy(writer, in)
+	if err == nil {
+		err = writer.Close()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path + ".gz")
+		return err
+	}
+	return os.Remove(path)
+}
+
+// encodeLines encodes each metric of a batch as a line of JSON. Values that
+// JSON can't represent, such as NaN, are written as strings.
+func encodeLines(batch *MetricBatch) ([]byte, error) {
+	var data []byte
+	for i := range batch.Metrics {
+		m := &batch.Metrics[i]
+		var line []byte
+		var err error
+		if math.IsNaN(m.Value) || math.IsInf(m.Value, 0) {
+			line, err = json.Marshal(map[string]interface{}{
+				"timestamp": m.Timestamp,
+				"metric":    m.Metric,
+				"value":     strconv.FormatFloat(m.Value, 'g', -1, 64),
+				"tags":      m.Tags,
+				"error":     m.Error,
+			})
+		} else {
+			line, err = json.Marshal(m)
+		}
+		if err != nil {
+			return nil, err
+		}
+		data = append(append(data, line...), '\n')
+	}
+	return data, nil
+}
+
+func (f *FileSender) SendBatch(batch *MetricBatch, backoff *Backoff) (int, int, error) {
+	data, err := encodeLines(batch)
+	if err != nil {
+		return 0, 0, BatchError{Err: err}
+	}
+
+	f.Lock()
+	defer f.Unlock()
+	if f.path != "" && f.file == nil {
+		if err := f.open(); err != nil {
+			return 0, 0, PublisherError{Msg: err.Error()}
+		}
+	}
+	if f.file != nil && f.size > 0 && (f.maxSize > 0 && f.size+int64(len(data)) > f.maxSize ||
+		f.maxAge > 0 && time.Since(f.opened) >= f.maxAge) {
+		if err := f.rotate(); err != nil {
+			return 0, 0, PublisherError{Msg: err.Error()}
+		}
+	}
+	n, err := f.out.Write(data)
+	f.size += int64(n)
+	if err != nil {
+		return 0, 0, PublisherError{Msg: err.Error()}
+	}
+	return len(batch.Metrics), len(data), nil
+}
+
+// Close closes the current file
+func (f *FileSender) Close() error {
+	f.Lock()
+	defer f.Unlock()
+	if f.file == nil {
+		return nil
+	}
+	return f.file.Close()
+}
+
+// TapRule copies the metrics whose name matches Pattern to a file or stdout,
+// in addition to sending them to the consumer
+type TapRule struct {
+	Pattern string // Regular expression matched against the metric name; empty matches every metric
+	Output  string // file or stdout
+	Path    string // File to write to
+	MaxSize int    // Size in megabytes to rotate the file at; 0 disables
+	MaxAge  int    // Age in seconds to rotate the file at; 0 disables
+	Gzip    bool   // Compress rotated files
+}
+
+// Tap copies matching metrics to a sender before they are published
+type Tap struct {
+	pattern *regexp.Regexp
+	sender  BatchSender
+	Tapped  metrics.Meter
+}
+
+// NewTap opens the output of a tap rule
+func NewTap(rule TapRule) (*Tap, error) {
+	tap := &Tap{Tapped: metrics.GetOrRegisterMeter("tappedDatapoints", StatsRegistry)}
+	if rule.Pattern != "" {
+		pattern, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			return nil, err
+		}
+		tap.pattern = pattern
+	}
+	switch rule.Output {
+	case "stdout":
+		tap.sender = NewStdoutSender()
+	case "", "file":
+		sender, err := NewFileSender(rule.Path, int64(rule.MaxSize)*1024*1024,
+			time.Duration(rule.MaxAge)*time.Second, rule.Gzip)
+		if err != nil {
+			return nil, err
+		}
+		tap.sender = sender
+	default:
+		return nil, fmt.Errorf("Unknown tap output %q", rule.Output)
+	}
+	return tap, nil
+}
+
+// Send writes the matching metrics of a batch to the tap, logging failures
+// rather than holding up the batch
+func (t *Tap) Send(batch *MetricBatch) {
+	tapped := batch
+	if t.pattern != nil {
+		tapped = &MetricBatch{}
+		for _, m := range batch.Metrics {
+			if t.pattern.MatchString(m.Metric) {
+				tapped.Metrics = append(tapped.Metrics, m)
+			}
+		}
+	}
+	if len(tapped.Metrics) == 0 {
+		return
+	}
+	if _, _, err := t.sender.SendBatch(tapped, nil); err != nil {
+		glog.Errorf("Unable to tap %d metrics: %s", len(tapped.Metrics), err)
+		return
+	}
+	t.Tapped.Mark(int64(len(tapped.Metrics)))
+}
+
+// WithTap copies every batch to the tap before it is sent to the consumer
+func WithTap(tap *Tap) PublisherOption {
+	return func(w *WebsocketPublisher) {
+		w.taps = append(w.taps, tap)
+	}
+}
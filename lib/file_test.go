@@ -0,0 +1,121 @@
+package metricshipper
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFileSender(t *testing.T) {
+	dir, err := ioutil.TempDir("", "metricshipper")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "metrics.ndjson")
+
+	sender, err := NewFileSender(path, 150, 0, true)
+	if err != nil {
+		t.Fatalf("unable to open: %s", err)
+	}
+	defer sender.Close()
+	batch := &MetricBatch{Metrics: []Metric{
+		taggedMetric("load", 1, map[string]interface{}{"device": "sw01"}),
+		taggedMetric("cpu", math.NaN(), nil),
+	}}
+	num, _, err := sender.SendBatch(batch, nil)
+	if err != nil || num != 2 {
+		t.Fatalf("expected 2 metrics written, got %d: %v", num, err)
+	}
+	data, _ := ioutil.ReadFile(path)
+	expected := `{"timestamp":1500000000.5,"metric":"load","value":1,"tags":{"device":"sw01"},"error":false}` + "\n" +
+		`{"error":false,"metric":"cpu","tags":null,"timestamp":1500000000.5,"value":"NaN"}` + "\n"
+	if string(data) != expected {
+		t.Errorf("expected\n%s\ngot\n%s", expected, data)
+	}
+
+	// The file is over its size limit, so the next batch starts a new one
+	if _, _, err := sender.SendBatch(&MetricBatch{Metrics: batch.Metrics[:1]}, nil); err != nil {
+		t.Fatalf("unable to write: %s", err)
+	}
+	rotated, _ := filepath.Glob(path + ".*.gz")
+	if len(rotated) != 1 {
+		t.Fatalf("expected a compressed rotated file, got %v", rotated)
+	}
+	file, _ := os.Open(rotated[0])
+	defer file.Close()
+	reader, err := gzip.NewReader(file)
+	if err != nil {
+		t.Fatalf("invalid gzip file: %s", err)
+	}
+	if data, _ := ioutil.ReadAll(reader); string(data) != expected {
+		t.Errorf("expected the rotated file to contain\n%s\ngot\n%s", expected, data)
+	}
+	if data, _ := ioutil.ReadFile(path); strings.Count(string(data), "\n") != 1 {
+		t.Errorf("expected the new file to contain a single metric, got\n%s", data)
+	}
+}
+
+func TestFileSenderFailedRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "metricshipper")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "out", "metrics.ndjson")
+	os.Mkdir(filepath.Dir(path), 0755)
+
+	sender, err := NewFileSender(path, 10, 0, false)
+	if err != nil {
+		t.Fatalf("unable to open: %s", err)
+	}
+	defer sender.Close()
+	batch := &MetricBatch{Metrics: []Metric{taggedMetric("load", 1, nil)}}
+	if _, _, err := sender.SendBatch(batch, nil); err != nil {
+		t.Fatalf("unable to write: %s", err)
+	}
+
+	// The file can't be renamed once its directory is gone
+	os.RemoveAll(filepath.Dir(path))
+	if _, _, err := sender.SendBatch(batch, nil); err == nil {
+		t.Fatal("expected the rotation to fail")
+	}
+	os.Mkdir(filepath.Dir(path), 0755)
+	if _, _, err := sender.SendBatch(batch, nil); err != nil {
+		t.Fatalf("expected the file to be reopened, got %s", err)
+	}
+	if data, _ := ioutil.ReadFile(path); strings.Count(string(data), "\n") != 1 {
+		t.Errorf("expected the reopened file to contain a single metric, got\n%s", data)
+	}
+}
+
+func TestTap(t *testing.T) {
+	dir, err := ioutil.TempDir("", "metricshipper")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "octets.ndjson")
+
+	if _, err := NewTap(TapRule{Output: "syslog", Path: path}); err == nil {
+		t.Error("expected an unknown output to be rejected")
+	}
+	tap, err := NewTap(TapRule{Pattern: "Octets$", Path: path})
+	if err != nil {
+		t.Fatalf("unable to create tap: %s", err)
+	}
+	tap.Send(&MetricBatch{Metrics: []Metric{
+		taggedMetric("ifInOctets", 1, nil),
+		taggedMetric("load", 1, nil),
+	}})
+	tap.Send(&MetricBatch{Metrics: []Metric{taggedMetric("cpu", 1, nil)}})
+	data, _ := ioutil.ReadFile(path)
+	if lines := strings.Split(strings.TrimSpace(string(data)), "\n"); len(lines) != 1 ||
+		!strings.Contains(lines[0], `"metric":"ifInOctets"`) {
+		t.Errorf("expected only the matching metric to be tapped, got\n%s", data)
+	}
+}
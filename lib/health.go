@@ -0,0 +1,230 @@
+package metricshipper
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/zenoss/glog"
+)
+
+// CheckResult is the health of a part of the shipper
+type CheckResult struct {
+	Healthy bool        `json:"healthy"`
+	Message string      `json:"message,omitempty"`
+	Details interface{} `json:"details,omitempty"`
+}
+
+// HealthCheck reports the health of a part of the shipper
+type HealthCheck func() CheckResult
+
+// HealthStatus is the health of every part of the shipper
+type HealthStatus struct {
+	Healthy bool                   `json:"healthy"` // Whether every check is healthy
+	Checks  map[string]CheckResult `json:"checks"`
+}
+
+// DefaultHealthInterval is how often the health marker file is updated when
+// health reports are otherwise disabled
+const DefaultHealthInterval = 5 * time.Second
+
+// HealthReporter publishes the health of the shipper, such as to a process
+// supervisor. Reporters are called from a single goroutine.
+type HealthReporter interface {
+	Report(status HealthStatus)
+}
+
+// HealthRegistry collects the health checks of the parts of the shipper and
+// reports their results to its reporters
+type HealthRegistry struct {
+	sync.Mutex
+	checks    map[string]HealthCheck
+	reporters []HealthReporter
+}
+
+func NewHealthRegistry() *HealthRegistry {
+	return &HealthRegistry{checks: make(map[string]HealthCheck)}
+}
+
+// Register adds a check, replacing any other check of the same name
+func (r *HealthRegistry) Register(name string, check HealthCheck) {
+	r.Lock()
+	defer r.Unlock()
+	r.checks[name] = check
+}
+
+// AddReporter reports the health of the shipper to reporter from then on
+func (r *HealthRegistry) AddReporter(reporter HealthReporter) {
+	r.Lock()
+	defer r.Unlock()
+	r.reporters = append(r.reporters, reporter)
+}
+
+// Status runs every check
+func (r *HealthRegistry) Status() HealthStatus {
+	r.Lock()
+	checks := make(map[string]HealthCheck, len(r.checks))
+	for name, check := range r.checks {
+		checks[name] = check
+	}
+	r.Unlock()
+	status := HealthStatus{Healthy: true, Checks: make(map[string]CheckResult, len(checks))}
+	for name, check := range checks {
+		result := check()
+		status.Checks[name] = result
+		status.Healthy = status.Healthy && result.Healthy
+	}
+	return status
+}
+
+// Run reports the health of the shipper to the reporters every interval
+func (r *HealthRegistry) Run(interval time.Duration) {
+	for {
+		status := r.Status()
+		r.Lock()
+		reporters := append([]HealthReporter(nil), r.reporters...)
+		r.Unlock()
+		for _, reporter := range reporters {
+			reporter.Report(status)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// HealthHandler serves the health of the shipper as JSON, with a 503 status
+// while any check is unhealthy
+func HealthHandler(registry *HealthRegistry) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status := registry.Status()
+		w.Header().Set("Content-Type", "application/json")
+		if !status.Healthy {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(status)
+	})
+}
+
+// MarkerFileReporter leaves a file at Path while a check is unhealthy, and
+// removes it once the check is healthy again
+type MarkerFileReporter struct {
+	Path  string
+	Check string // Check to watch; the health of every check if empty
+}
+
+func (m *MarkerFileReporter) Report(status HealthStatus) {
+	healthy := status.Healthy
+	if m.Check != "" {
+		healthy = status.Checks[m.Check].Healthy
+	}
+	_, err := os.Stat(m.Path)
+	switch {
+	case !healthy && os.IsNotExist(err):
+		f, err := os.Create(m.Path)
+		if err != nil {
+			glog.Errorf("Unable to create health marker file: %s", err)
+			return
+		}
+		f.Close()
+	case healthy && err == nil:
+		if err := os.Remove(m.Path); err != nil {
+			glog.Errorf("Unable to remove health marker file: %s", err)
+		}
+	}
+}
+
+// LogReporter logs the checks whose health changed
+type LogReporter struct {
+	last map[string]bool
+}
+
+func (l *LogReporter) Report(status HealthStatus) {
+	names := make([]string, 0, len(status.Checks))
+	for name := range status.Checks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		result := status.Checks[name]
+		if healthy, known := l.last[name]; known && healthy == result.Healthy || !known && result.Healthy {
+			continue
+		}
+		if result.Healthy {
+			glog.Infof("Health check %s recovered", name)
+		} else {
+			glog.Warningf("Health check %s failed: %s", name, result.Message)
+		}
+	}
+	l.last = make(map[string]bool, len(status.Checks))
+	for name, result := range status.Checks {
+		l.last[name] = result.Healthy
+	}
+}
+
+// BufferCheck is unhealthy while any of the named buffers is full, which
+// means metrics are coming in faster than they can be sent
+func BufferCheck(buffers map[string]chan Metric) HealthCheck {
+	return func() CheckResult {
+		result := CheckResult{Healthy: true}
+		details := make(map[string]string, len(buffers))
+		var full []string
+		for name, buffer := range buffers {
+			details[name] = fmt.Sprintf("%d/%d", len(buffer), cap(buffer))
+			if cap(buffer) > 0 && len(buffer) >= cap(buffer) {
+				full = append(full, name)
+			}
+		}
+		if len(full) > 0 {
+			sort.Strings(full)
+			result.Healthy = false
+			result.Message = "Full: " + strings.Join(full, ", ")
+		}
+		result.Details = details
+		return result
+	}
+}
+
+// Health tells whether the shipper can deliver to the consumer
+type Health struct {
+	Circuit   string           `json:"circuit"`             // closed, half-open or open
+	Endpoints []EndpointStatus `json:"endpoints,omitempty"` // Only for websocket consumers
+	LastSend  *time.Time       `json:"lastSend,omitempty"`  // When a batch was last delivered
+}
+
+// Health returns the health of the connection to the consumer. Outputs other
+// than websockets are always reported as closed circuits.
+func (w *WebsocketPublisher) Health() Health {
+	health := Health{Circuit: CircuitClosed.String()}
+	if w.pool != nil {
+		health.Circuit = w.pool.State().String()
+		health.Endpoints = w.pool.Endpoints()
+	}
+	if sent := atomic.LoadInt64(&w.lastSend); sent != 0 {
+		t := time.Unix(0, sent)
+		health.LastSend = &t
+	}
+	return health
+}
+
+// Check is unhealthy while the consumer can't be reached
+func (w *WebsocketPublisher) Check() CheckResult {
+	health := w.Health()
+	result := CheckResult{Healthy: health.Circuit != CircuitOpen.String(), Details: health}
+	if !result.Healthy {
+		result.Message = "No consumer can be reached"
+	}
+	return result
+}
+
+// WithHealth registers the health check of the publisher as output, before
+// it waits to connect to the consumer
+func WithHealth(registry *HealthRegistry) PublisherOption {
+	return func(w *WebsocketPublisher) {
+		w.health = registry
+	}
+}
@@ -0,0 +1,78 @@
+package metricshipper
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestHealthRegistry(t *testing.T) {
+	registry := NewHealthRegistry()
+	pub := &WebsocketPublisher{}
+	registry.Register("output", pub.Check)
+	buffer := make(chan Metric, 1)
+	registry.Register("buffers", BufferCheck(map[string]chan Metric{"outgoing": buffer}))
+
+	recorder := httptest.NewRecorder()
+	HealthHandler(registry).ServeHTTP(recorder, nil)
+	if recorder.Code != http.StatusOK || !strings.Contains(recorder.Body.String(), `"circuit":"closed"`) {
+		t.Errorf("expected a healthy shipper without a pool, got %d %s", recorder.Code, recorder.Body)
+	}
+
+	buffer <- Metric{}
+	pub.pool = &WebSocketConnPool{circuit: CircuitOpen}
+	status := registry.Status()
+	if status.Healthy || status.Checks["output"].Healthy || status.Checks["buffers"].Healthy {
+		t.Errorf("expected an open circuit and a full buffer to be unhealthy, got %+v", status)
+	}
+	recorder = httptest.NewRecorder()
+	HealthHandler(registry).ServeHTTP(recorder, nil)
+	if recorder.Code != http.StatusServiceUnavailable || !strings.Contains(recorder.Body.String(), `"Full: outgoing"`) {
+		t.Errorf("expected an unhealthy shipper to be unavailable, got %d %s", recorder.Code, recorder.Body)
+	}
+}
+
+func TestMarkerFileReporter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "metricshipper")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	reporter := &MarkerFileReporter{Path: filepath.Join(dir, "websocket_error"), Check: "output"}
+
+	// Only the watched check matters
+	reporter.Report(HealthStatus{Checks: map[string]CheckResult{"output": {Healthy: true}, "input": {}}})
+	if _, err := os.Stat(reporter.Path); !os.IsNotExist(err) {
+		t.Error("expected no marker file while the output is healthy")
+	}
+	for i := 0; i < 2; i++ {
+		reporter.Report(HealthStatus{Checks: map[string]CheckResult{"output": {}}})
+		if _, err := os.Stat(reporter.Path); err != nil {
+			t.Errorf("expected a marker file while the output is unhealthy: %s", err)
+		}
+	}
+	reporter.Report(HealthStatus{Healthy: true, Checks: map[string]CheckResult{"output": {Healthy: true}}})
+	if _, err := os.Stat(reporter.Path); !os.IsNotExist(err) {
+		t.Error("expected the marker file to be removed once the output recovers")
+	}
+}
+
+func TestRedisReaderCheck(t *testing.T) {
+	reader := &RedisReader{}
+	if reader.Check().Healthy {
+		t.Error("expected a reader that hasn't read yet to be unhealthy")
+	}
+	reader.setStatus(nil)
+	if !reader.Check().Healthy {
+		t.Error("expected a successful read to be healthy")
+	}
+	reader.setStatus(errors.New("connection refused"))
+	if result := reader.Check(); result.Healthy || result.Message != "connection refused" {
+		t.Errorf("expected a failed read to be unhealthy, got %+v", result)
+	}
+}
@@ -0,0 +1,241 @@
+package metricshipper
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Content types of batches in the binary, protobuf and msgpack encodings
+const (
+	binaryContentType   = "application/x-metricshipper-binary"
+	protobufContentType = "application/x-protobuf; messageType=metricshipper.MetricBatch"
+	msgpackContentType  = "application/msgpack"
+)
+
+// Longest response body kept for error messages
+const maxErrorBody = 512
+
+// BatchSender delivers batches to the consumer
+type BatchSender interface {
+	SendBatch(batch *MetricBatch, backoff *Backoff) (metricCount, bytes int, err error)
+}
+
+// CompressedBatchSender is a BatchSender that compresses batches, and also
+// reports their size before compression
+type CompressedBatchSender interface {
+	BatchSender
+	SendCompressedBatch(batch *MetricBatch, backoff *Backoff) (metricCount, bytes, uncompressed int, err error)
+}
+
+// HTTPSender POSTs each batch to the consumer, or to the OpenTSDB /api/put,
+// InfluxDB /write or Prometheus remote write endpoint in their encodings.
+// Responses of 429 or 503 slow down the writer for as long as Retry-After
+// asks, other client errors reject the batch, and anything else unsuccessful
+// is retried.
+type HTTPSender struct {
+	sync.Mutex
+	URL         string
+	Encoding    string        // json, binary, protobuf, msgpack, opentsdb, influxdb or prometheus
+	Gzip        bool          // Compress request bodies with gzip, unless Codec is set
+	Codec       Codec         // Compresses request bodies
+	Version     int           // Binary encoding version; consumers can't negotiate it over HTTP
+	XOR         bool          // Compress values in binary encoding version 1
+	Auth        Authenticator // Sets the Authorization header, if not nil
+	TLS         *TLSLoader    // Secures https:// consumers, if not nil
+	Proxy       func(*http.Request) (*url.URL, error)
+	timeout     time.Duration
+	concurrency int
+	client      *http.Client
+	tlsConfig   *tls.Config // The configuration client was built with
+}
+
+// NewHTTPSender posts to url, keeping up to concurrency connections alive
+func NewHTTPSender(url, encoding string, concurrency int, timeout time.Duration) *HTTPSender {
+	return &HTTPSender{
+		URL:         url,
+		Encoding:    encoding,
+		Proxy:       http.ProxyFromEnvironment,
+		timeout:     timeout,
+		concurrency: concurrency,
+	}
+}
+
+// httpClient returns the client to send with, replacing it when the TLS
+// certificates have been reloaded
+func (s *HTTPSender) httpClient() *http.Client {
+	s.Lock()
+	defer s.Unlock()
+	var tlsConfig *tls.Config
+	if s.TLS != nil {
+		tlsConfig = s.TLS.Config()
+	}
+	if s.client != nil && tlsConfig == s.tlsConfig {
+		return s.client
+	}
+	if s.client != nil {
+		s.client.Transport.(*http.Transport).CloseIdleConnections()
+	}
+	s.tlsConfig = tlsConfig
+	s.client = &http.Client{
+		Timeout: s.timeout,
+		Transport: &http.Transport{
+			Proxy:               s.Proxy,
+			TLSClientConfig:     tlsConfig,
+			MaxIdleConnsPerHost: s.concurrency,
+		},
+	}
+	return s.client
+}
+
+func (s *HTTPSender) SendBatch(batch *MetricBatch, backoff *Backoff) (int, int, error) {
+	num, bytes, _, err := s.SendCompressedBatch(batch, backoff)
+	return num, bytes, err
+}
+
+// SendCompressedBatch sends a batch like SendBatch, also returning the size
+// of its body before compression
+func (s *HTTPSender) SendCompressedBatch(batch *MetricBatch, backoff *Backoff) (int, int, int, error) {
+	body, header, err := s.encode(batch)
+	if err != nil {
+		return 0, 0, 0, BatchError{Err: err}
+	}
+	uncompressed := len(body)
+	if body, err = s.compress(body, header); err != nil {
+		return 0, 0, 0, BatchError{Err: err}
+	}
+	req, err := http.NewRequest("POST", s.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	if s.Auth != nil {
+		header, _, err := s.Auth.Authorization()
+		if err != nil {
+			return 0, 0, 0, err
+		}
+		req.Header.Set("Authorization", header)
+	}
+
+	batch.Tracer("publishing")
+	resp, err := s.httpClient().Do(req)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	defer resp.Body.Close()
+	// Read the body completely so the connection can be reused
+	message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+	io.Copy(ioutil.Discard, resp.Body)
+
+	num := len(batch.Metrics)
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		batch.Tracer("sent")
+		return num, len(body), uncompressed, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable:
+		backoff.Collision()
+		if delay, ok := retryAfter(resp.Header.Get("Retry-After")); ok {
+			backoff.Pause(delay)
+		}
+		return num, len(body), uncompressed, PublisherError{Msg: fmt.Sprintf("Consumer is busy: %s", resp.Status)}
+	case resp.StatusCode >= 400 && resp.StatusCode < 500 &&
+		resp.StatusCode != http.StatusUnauthorized && resp.StatusCode != http.StatusForbidden:
+		return num, len(body), uncompressed, BatchRejectedError{Control: Control{
+			Type:  "ERROR",
+			Value: strings.TrimSpace(resp.Status + " " + string(message)),
+		}}
+	}
+	return num, len(body), uncompressed, PublisherError{Msg: fmt.Sprintf("Consumer responded with %s", resp.Status)}
+}
+
+// encode returns the request body for a batch and the headers describing it
+func (s *HTTPSender) encode(batch *MetricBatch) ([]byte, http.Header, error) {
+	var (
+		body []byte
+		err  error
+	)
+	header := make(http.Header)
+	switch strings.ToLower(s.Encoding) {
+	case "binary":
+		// Requests may reach different consumers, so each one carries its
+		// own dictionary
+		dict := &dictionary{trans: make(map[string]int32)}
+		if s.Version >= binaryV1 {
+			body, err = batch.MarshalBinaryV1(dict, s.XOR, false)
+			header.Set("Content-Type", binaryContentType+"; version=1")
+		} else {
+			body, err = batch.MarshalBinary(dict, false)
+			header.Set("Content-Type", binaryContentType)
+		}
+		dict.discard()
+	case encodingProtobuf:
+		body, err = batch.MarshalProtobuf()
+		header.Set("Content-Type", protobufContentType)
+	case encodingMsgpack:
+		body, err = batch.MarshalMsgpack()
+		header.Set("Content-Type", msgpackContentType)
+	case encodingOpenTSDB:
+		body, err = encodeOpenTSDB(batch)
+		header.Set("Content-Type", "application/json")
+	case encodingInfluxDB:
+		body, err = encodeInfluxDB(batch)
+		header.Set("Content-Type", "text/plain; charset=utf-8")
+	case encodingPrometheus:
+		// Remote write requests are always compressed with snappy
+		body, err = encodeRemoteWrite(batch)
+		header.Set("Content-Type", "application/x-protobuf")
+		header.Set("Content-Encoding", "snappy")
+		header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	default:
+		body, err = json.Marshal(batch)
+		header.Set("Content-Type", "application/json")
+	}
+	return body, header, err
+}
+
+// compress compresses a request body with the codec of the sender, setting
+// its Content-Encoding header
+func (s *HTTPSender) compress(body []byte, header http.Header) ([]byte, error) {
+	codec := s.Codec
+	if codec.Name == "" && s.Gzip {
+		codec = Codec{Name: codecGzip, Level: gzip.DefaultCompression}
+	}
+	// Binary bodies are compressed with snappy unless told otherwise, which
+	// consumers expect without a header
+	if codec.Name == "" && strings.ToLower(s.Encoding) == "binary" {
+		return Codec{Name: codecSnappy}.Compress(body)
+	}
+	// Remote write requests are already compressed
+	if codec.Name == "" || codec.Name == codecNone || header.Get("Content-Encoding") != "" {
+		return body, nil
+	}
+	header.Set("Content-Encoding", codec.Name)
+	return codec.Compress(body)
+}
+
+// retryAfter parses a Retry-After header, which is either a number of
+// seconds or a date
+func retryAfter(header string) (time.Duration, bool) {
+	if header == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(header); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(header); err == nil {
+		return date.Sub(time.Now()), true
+	}
+	return 0, false
+}
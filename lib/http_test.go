@@ -0,0 +1,168 @@
+package metricshipper
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// startHTTPConsumer starts a consumer answering with status, and sends the
+// batches it receives to batches
+func startHTTPConsumer(t *testing.T, status int, header http.Header, batches chan<- *MetricBatch) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for key, values := range header {
+			w.Header()[key] = values
+		}
+		if status != http.StatusOK {
+			http.Error(w, "go away", status)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		if encoding := r.Header.Get("Content-Encoding"); encoding != "" {
+			var err error
+			if body, err = (Codec{Name: encoding}).Decompress(body); err != nil {
+				t.Errorf("invalid %s body: %s", encoding, err)
+				return
+			}
+		}
+		batch := &MetricBatch{}
+		if r.Header.Get("Content-Type") == "application/json" {
+			if err := json.Unmarshal(body, batch); err != nil {
+				t.Errorf("invalid JSON body: %s", err)
+			}
+		} else {
+			batch.Control = body
+		}
+		batches <- batch
+	}))
+}
+
+func TestHTTPSender(t *testing.T) {
+	batches := make(chan *MetricBatch, 1)
+	server := startHTTPConsumer(t, http.StatusOK, nil, batches)
+	defer server.Close()
+
+	sender := NewHTTPSender(server.URL, "json", 1, time.Second)
+	sender.Gzip = true
+	sender.Auth = BearerToken("abc")
+	num, bytes, err := sender.SendBatch(spoolBatch("cpu"), NewBackoff(1, 1, 1))
+	if err != nil || num != 1 || bytes == 0 {
+		t.Fatalf("unable to send batch: %d metrics, %d bytes, %v", num, bytes, err)
+	}
+	if batch := <-batches; batch.Metrics[0].Metric != "cpu" {
+		t.Errorf("unexpected batch %+v", batch)
+	}
+
+	sender.Encoding = "binary"
+	sender.Gzip = false
+	if _, _, err := sender.SendBatch(spoolBatch("cpu"), NewBackoff(1, 1, 1)); err != nil {
+		t.Fatalf("unable to send binary batch: %s", err)
+	}
+	if data, ok := (<-batches).Control.([]byte); !ok || len(data) == 0 {
+		t.Error("expected a binary body")
+	}
+
+	sender.Encoding = "json"
+	sender.Codec = Codec{Name: codecDeflate, Level: 1}
+	if _, _, err := sender.SendBatch(spoolBatch("load"), NewBackoff(1, 1, 1)); err != nil {
+		t.Fatalf("unable to send deflated batch: %s", err)
+	}
+	if batch := <-batches; batch.Metrics[0].Metric != "load" {
+		t.Errorf("unexpected batch %+v", batch)
+	}
+}
+
+func TestHTTPSenderBinaryCompression(t *testing.T) {
+	batches := make(chan *MetricBatch, 1)
+	server := startHTTPConsumer(t, http.StatusOK, nil, batches)
+	defer server.Close()
+
+	sender := NewHTTPSender(server.URL, "binary", 1, time.Second)
+	for _, tc := range []struct {
+		codec  Codec
+		snappy bool // Whether the body is still compressed with snappy
+	}{
+		{Codec{}, true},
+		{Codec{Name: codecNone}, false},
+		{Codec{Name: codecSnappy}, false},
+		{Codec{Name: codecGzip, Level: 1}, false},
+	} {
+		sender.Codec = tc.codec
+		if _, _, err := sender.SendBatch(spoolBatch("cpu"), NewBackoff(1, 1, 1)); err != nil {
+			t.Fatalf("unable to send binary batch: %s", err)
+		}
+		data, _ := (<-batches).Control.([]byte)
+		batch := &MetricBatch{}
+		if err := batch.UnmarshalBinary(data, NewReceiverDictionary(), tc.snappy); err != nil || len(batch.Metrics) != 1 {
+			t.Errorf("expected a binary body compressed only with %q, got %d metrics: %v", tc.codec.Name, len(batch.Metrics), err)
+		}
+	}
+}
+
+func TestHTTPSenderBackpressure(t *testing.T) {
+	server := startHTTPConsumer(t, http.StatusTooManyRequests, http.Header{"Retry-After": {"1"}}, nil)
+	defer server.Close()
+
+	backoff := NewBackoff(1, 1, 1)
+	_, _, err := NewHTTPSender(server.URL, "json", 1, time.Second).SendBatch(spoolBatch("cpu"), backoff)
+	if err == nil || isBatchError(err) {
+		t.Errorf("expected a busy consumer to be retried, got %v", err)
+	}
+	if backoff.collisions != 1 || backoff.until.Sub(time.Now()) < 900*time.Millisecond {
+		t.Errorf("expected the backoff to pause for a second, got %s", backoff.until.Sub(time.Now()))
+	}
+}
+
+func TestHTTPSenderErrors(t *testing.T) {
+	for status, batchError := range map[int]bool{
+		http.StatusBadRequest:            true,
+		http.StatusRequestEntityTooLarge: true,
+		http.StatusUnauthorized:          false,
+		http.StatusInternalServerError:   false,
+	} {
+		server := startHTTPConsumer(t, status, nil, nil)
+		_, _, err := NewHTTPSender(server.URL, "json", 1, time.Second).SendBatch(spoolBatch("cpu"), NewBackoff(1, 1, 1))
+		if err == nil || isBatchError(err) != batchError {
+			t.Errorf("%d: unexpected error %v", status, err)
+		}
+		server.Close()
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	if delay, ok := retryAfter("120"); !ok || delay != 2*time.Minute {
+		t.Errorf("expected 2 minutes, got %s", delay)
+	}
+	date := time.Now().Add(time.Minute).UTC().Format(http.TimeFormat)
+	if delay, ok := retryAfter(date); !ok || delay < 58*time.Second || delay > time.Minute {
+		t.Errorf("expected about a minute, got %s", delay)
+	}
+	if _, ok := retryAfter("soon"); ok {
+		t.Error("expected an invalid Retry-After to be ignored")
+	}
+}
+
+func TestHTTPPublisher(t *testing.T) {
+	batches := make(chan *MetricBatch, 10)
+	server := startHTTPConsumer(t, http.StatusOK, nil, batches)
+	defer server.Close()
+
+	pub, err := NewWebsocketPublisher(server.URL, 1, 1, 1, 1, 1, 999, "admin", "zenoss", "json", 1, 1, 1, false,
+		WithSender(NewHTTPSender(server.URL, "json", 1, time.Second)))
+	if err != nil {
+		t.Fatalf("Could not create HTTP publisher: %s", err)
+	}
+	defer pub.Stop()
+	stageMetrics(1, pub)
+	select {
+	case <-batches:
+	case <-time.After(time.Second):
+		t.Fatal("Consumer didn't receive the batch")
+	}
+	if !waitForCount(pub.OutgoingDatapoints, 1) {
+		t.Error("expected the datapoint to be counted as sent")
+	}
+}
@@ -75,6 +75,33 @@ type RedisReader struct {
 	batch_size    int
 	queue_name    string
 	IncomingMeter metrics.Meter // no need to lock since metrics.Meter already does that
+	MTraceEnabled bool          // Trace the metrics that ask for it
+	statusLock    sync.Mutex
+	lastRead      time.Time // When redis was last read from successfully
+	readErr       error     // Why the last read failed, if it did
+}
+
+// setStatus records the outcome of a read for the health check
+func (r *RedisReader) setStatus(err error) {
+	r.statusLock.Lock()
+	defer r.statusLock.Unlock()
+	r.readErr = err
+	if err == nil {
+		r.lastRead = time.Now()
+	}
+}
+
+// Check is unhealthy until redis has been read from, and while reading fails
+func (r *RedisReader) Check() CheckResult {
+	r.statusLock.Lock()
+	defer r.statusLock.Unlock()
+	switch {
+	case r.readErr != nil:
+		return CheckResult{Message: r.readErr.Error()}
+	case r.lastRead.IsZero():
+		return CheckResult{Message: "Not connected to redis yet"}
+	}
+	return CheckResult{Healthy: true, Details: map[string]time.Time{"lastRead": r.lastRead}}
 }
 
 // Read a batch of metrics
@@ -131,7 +158,7 @@ func (r *RedisReader) ReadBatch(conn *redis.Conn) (int, error) {
 		if err != nil {
 			glog.Errorf("Invalid metric json: %+v %s", m, err)
 		} else {
-			if mtraceEnabled && met.HasTracer() {
+			if r.MTraceEnabled && met.HasTracer() {
 				met.TracerMessage("metric read from redis")
 			}
 			r.Incoming <- *met
@@ -160,6 +187,7 @@ func (r *RedisReader) Drain() {
 			defer conn.Close()
 			for {
 				count, err := r.ReadBatch(&conn)
+				r.setStatus(err)
 				// there was an error pulling data, create a new connection
 				if err != nil {
 					glog.Errorf("Error pulling data: %v. Creating a new connection.", err)
@@ -113,7 +113,7 @@ func TestReadBatch(t *testing.T) {
 		seen = append(seen, m)
 	}
 	if len(seen) != mBatch {
-		t.Errorf("Did not read the correct batch size, expected 2 got %s", len(seen))
+		t.Errorf("Did not read the correct batch size, expected 2 got %d", len(seen))
 	}
 
 	metrics, err := readMetrics(conn)
@@ -130,7 +130,7 @@ func TestReadBatch(t *testing.T) {
 		seen = append(seen, m)
 	}
 	if len(seen) != 3 {
-		t.Errorf("Did not read the correct batch size, expected 3 got %s", len(seen))
+		t.Errorf("Did not read the correct batch size, expected 3 got %d", len(seen))
 	}
 
 }
@@ -1,10 +1,12 @@
 package metricshipper
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"math"
 	"reflect"
+	"sort"
 	"strconv"
 
 	"github.com/Sirupsen/logrus"
@@ -14,7 +16,6 @@ import (
 
 var (
 	plog = logging.PackageLogger()
-	mtraceEnabled = false
 )
 
 func init() {
@@ -45,6 +46,23 @@ func (m *Metric) HasTracer() bool {
 	return false
 }
 
+// SeriesKey identifies the time series a metric belongs to: the metric name
+// followed by its tags in sorted key order.
+func (m *Metric) SeriesKey() string {
+	keys := make([]string, 0, len(m.Tags))
+	for k := range m.Tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var buf bytes.Buffer
+	buf.WriteString(m.Metric)
+	for _, k := range keys {
+		fmt.Fprintf(&buf, ",%s=%v", k, m.Tags[k])
+	}
+	return buf.String()
+}
+
 func (m *Metric) TracerMessage(msg string) {
 	elapsed := "bad_tracetime"
 	if ttime, ok := m.Tags["mtrace"].(string); ok {
@@ -134,15 +152,23 @@ func (m Metric) Equal(that Metric) bool {
 	return reflect.DeepEqual(m.Tags, that.Tags)
 }
 
+// Control section of the messages exchanged with the consumer. Batches carry
+// an id when acknowledgements are enabled; the consumer echoes it back.
+type Control struct {
+	Type  string `json:"type"`
+	Value string `json:"value,omitempty"`
+	Id    string `json:"id,omitempty"`
+}
+
 // Structure of message forwarded via websocket
 type MetricBatch struct {
-	Control       interface{} `json:"control"` // Should be nil
+	Control       interface{} `json:"control"` // Nil, or a *Control with the batch id
 	Metrics       []Metric    `json:"metrics"`
 	MTraceEnabled bool
 }
 
 func (b MetricBatch) Tracer(msg string) {
-	if !mtraceEnabled {
+	if !b.MTraceEnabled {
 		return
 	}
 	for _, m := range b.Metrics {
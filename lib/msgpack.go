@@ -0,0 +1,371 @@
+package metricshipper
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// Encoding of batches as MessagePack maps with the same keys as the JSON
+// encoding, which keeps the types of tag values and can be decoded by the
+// MessagePack library of any language
+const encodingMsgpack = "msgpack"
+
+var errTruncatedMsgpack = errors.New("truncated MessagePack message")
+
+func appendMsgpackNil(buf []byte) []byte {
+	return append(buf, 0xc0)
+}
+
+func appendMsgpackBool(buf []byte, v bool) []byte {
+	if v {
+		return append(buf, 0xc3)
+	}
+	return append(buf, 0xc2)
+}
+
+// appendMsgpackInt appends v in the smallest of the integer formats
+func appendMsgpackInt(buf []byte, v int64) []byte {
+	switch {
+	case v >= 0 && v <= 0x7f:
+		return append(buf, byte(v))
+	case v < 0 && v >= -32:
+		return append(buf, byte(v))
+	case v >= math.MinInt8 && v <= math.MaxInt8:
+		return append(buf, 0xd0, byte(v))
+	case v >= math.MinInt16 && v <= math.MaxInt16:
+		return append(buf, 0xd1, byte(v>>8), byte(v))
+	case v >= math.MinInt32 && v <= math.MaxInt32:
+		return appendMsgpackUint32(append(buf, 0xd2), uint32(v))
+	}
+	buf = append(buf, 0xd3)
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(v))
+	return append(buf, b[:]...)
+}
+
+func appendMsgpackFloat(buf []byte, v float64) []byte {
+	buf = append(buf, 0xcb)
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], math.Float64bits(v))
+	return append(buf, b[:]...)
+}
+
+func appendMsgpackUint32(buf []byte, v uint32) []byte {
+	return append(buf, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func appendMsgpackString(buf []byte, v string) []byte {
+	switch n := len(v); {
+	case n < 32:
+		buf = append(buf, 0xa0|byte(n))
+	case n <= math.MaxUint8:
+		buf = append(buf, 0xd9, byte(n))
+	case n <= math.MaxUint16:
+		buf = append(buf, 0xda, byte(n>>8), byte(n))
+	default:
+		buf = appendMsgpackUint32(append(buf, 0xdb), uint32(n))
+	}
+	return append(buf, v...)
+}
+
+func appendMsgpackArrayHeader(buf []byte, n int) []byte {
+	switch {
+	case n < 16:
+		return append(buf, 0x90|byte(n))
+	case n <= math.MaxUint16:
+		return append(buf, 0xdc, byte(n>>8), byte(n))
+	}
+	return appendMsgpackUint32(append(buf, 0xdd), uint32(n))
+}
+
+func appendMsgpackMapHeader(buf []byte, n int) []byte {
+	switch {
+	case n < 16:
+		return append(buf, 0x80|byte(n))
+	case n <= math.MaxUint16:
+		return append(buf, 0xde, byte(n>>8), byte(n))
+	}
+	return appendMsgpackUint32(append(buf, 0xdf), uint32(n))
+}
+
+// MarshalMsgpack encodes the batch as a MessagePack map
+func (batch *MetricBatch) MarshalMsgpack() ([]byte, error) {
+	buf := appendMsgpackMapHeader(nil, 2)
+	buf = appendMsgpackString(buf, "control")
+	if control, ok := batch.Control.(*Control); ok && control != nil {
+		fields := [][2]string{{"type", control.Type}, {"value", control.Value}, {"id", control.Id}}
+		n := 1
+		for _, field := range fields[1:] {
+			if field[1] != "" {
+				n++
+			}
+		}
+		buf = appendMsgpackMapHeader(buf, n)
+		for i, field := range fields {
+			if i == 0 || field[1] != "" {
+				buf = appendMsgpackString(appendMsgpackString(buf, field[0]), field[1])
+			}
+		}
+	} else {
+		buf = appendMsgpackNil(buf)
+	}
+
+	buf = appendMsgpackString(buf, "metrics")
+	buf = appendMsgpackArrayHeader(buf, len(batch.Metrics))
+	for i := range batch.Metrics {
+		m := &batch.Metrics[i]
+		buf = appendMsgpackMapHeader(buf, 5)
+		buf = appendMsgpackFloat(appendMsgpackString(buf, "timestamp"), m.Timestamp)
+		buf = appendMsgpackString(appendMsgpackString(buf, "metric"), m.Metric)
+		buf = appendMsgpackFloat(appendMsgpackString(buf, "value"), m.Value)
+		buf = appendMsgpackString(buf, "tags")
+		if m.Tags == nil {
+			buf = appendMsgpackNil(buf)
+		} else {
+			keys := make([]string, 0, len(m.Tags))
+			for key := range m.Tags {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			buf = appendMsgpackMapHeader(buf, len(keys))
+			for _, key := range keys {
+				buf = appendMsgpackString(buf, key)
+				switch kind, value := tagValue(m.Tags[key]); kind {
+				case tagString:
+					buf = appendMsgpackString(buf, value.(string))
+				case tagInt:
+					buf = appendMsgpackInt(buf, value.(int64))
+				case tagFloat:
+					buf = appendMsgpackFloat(buf, value.(float64))
+				case tagBool:
+					buf = appendMsgpackBool(buf, value.(bool))
+				default:
+					buf = appendMsgpackNil(buf)
+				}
+			}
+		}
+		buf = appendMsgpackBool(appendMsgpackString(buf, "error"), m.Error)
+	}
+	return buf, nil
+}
+
+// msgpackReader decodes MessagePack values into nil, bool, int64, uint64,
+// float64, string, []interface{} and map[string]interface{}
+type msgpackReader struct {
+	data []byte
+}
+
+func (r *msgpackReader) read(n int) ([]byte, error) {
+	if n < 0 || n > len(r.data) {
+		return nil, errTruncatedMsgpack
+	}
+	v := r.data[:n]
+	r.data = r.data[n:]
+	return v, nil
+}
+
+// length reads a big-endian length of size bytes
+func (r *msgpackReader) length(size int) (int, error) {
+	b, err := r.read(size)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, c := range b {
+		n = n<<8 | int(c)
+	}
+	return n, nil
+}
+
+func (r *msgpackReader) value() (interface{}, error) {
+	b, err := r.read(1)
+	if err != nil {
+		return nil, err
+	}
+	switch c := b[0]; {
+	case c <= 0x7f:
+		return int64(c), nil
+	case c >= 0xe0:
+		return int64(int8(c)), nil
+	case c&0xf0 == 0x80:
+		return r.mapOf(int(c & 0x0f))
+	case c&0xf0 == 0x90:
+		return r.arrayOf(int(c & 0x0f))
+	case c&0xe0 == 0xa0:
+		return r.stringOf(int(c & 0x1f))
+	case c == 0xc0:
+		return nil, nil
+	case c == 0xc2, c == 0xc3:
+		return c == 0xc3, nil
+	case c >= 0xc4 && c <= 0xc6: // bin 8, 16 and 32
+		n, err := r.length(1 << (c - 0xc4))
+		if err != nil {
+			return nil, err
+		}
+		return r.stringOf(n)
+	case c == 0xca:
+		v, err := r.read(4)
+		if err != nil {
+			return nil, err
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(v))), nil
+	case c == 0xcb:
+		v, err := r.read(8)
+		if err != nil {
+			return nil, err
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(v)), nil
+	case c >= 0xcc && c <= 0xcf: // uint 8 to 64
+		v, err := r.read(1 << (c - 0xcc))
+		if err != nil {
+			return nil, err
+		}
+		var u uint64
+		for _, b := range v {
+			u = u<<8 | uint64(b)
+		}
+		if u <= math.MaxInt64 {
+			return int64(u), nil
+		}
+		return u, nil
+	case c >= 0xd0 && c <= 0xd3: // int 8 to 64
+		size := uint(1) << (c - 0xd0)
+		v, err := r.read(int(size))
+		if err != nil {
+			return nil, err
+		}
+		var u uint64
+		for _, b := range v {
+			u = u<<8 | uint64(b)
+		}
+		// Sign extend
+		shift := 64 - 8*size
+		return int64(u<<shift) >> shift, nil
+	case c >= 0xd9 && c <= 0xdb: // str 8, 16 and 32
+		n, err := r.length(1 << (c - 0xd9))
+		if err != nil {
+			return nil, err
+		}
+		return r.stringOf(n)
+	case c == 0xdc, c == 0xdd:
+		n, err := r.length(2 << (c - 0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return r.arrayOf(n)
+	case c == 0xde, c == 0xdf:
+		n, err := r.length(2 << (c - 0xde))
+		if err != nil {
+			return nil, err
+		}
+		return r.mapOf(n)
+	}
+	return nil, fmt.Errorf("unsupported MessagePack format 0x%02x", b[0])
+}
+
+func (r *msgpackReader) stringOf(n int) (interface{}, error) {
+	v, err := r.read(n)
+	if err != nil {
+		return nil, err
+	}
+	return string(v), nil
+}
+
+func (r *msgpackReader) arrayOf(n int) (interface{}, error) {
+	// Every element takes at least a byte
+	if n > len(r.data) {
+		return nil, errTruncatedMsgpack
+	}
+	values := make([]interface{}, n)
+	for i := range values {
+		var err error
+		if values[i], err = r.value(); err != nil {
+			return nil, err
+		}
+	}
+	return values, nil
+}
+
+func (r *msgpackReader) mapOf(n int) (interface{}, error) {
+	if 2*n > len(r.data) {
+		return nil, errTruncatedMsgpack
+	}
+	values := make(map[string]interface{}, n)
+	for i := 0; i < n; i++ {
+		key, err := r.value()
+		if err != nil {
+			return nil, err
+		}
+		s, ok := key.(string)
+		if !ok {
+			return nil, fmt.Errorf("unsupported MessagePack map key %v", key)
+		}
+		if values[s], err = r.value(); err != nil {
+			return nil, err
+		}
+	}
+	return values, nil
+}
+
+// msgpackFloat converts a decoded number to a float64
+func msgpackFloat(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case float64:
+		return v, true
+	case int64:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	}
+	return 0, false
+}
+
+// UnmarshalMsgpack decodes a batch encoded by MarshalMsgpack. Tags with
+// integer values are decoded as int64.
+func (batch *MetricBatch) UnmarshalMsgpack(data []byte) error {
+	r := &msgpackReader{data: data}
+	value, err := r.value()
+	if err != nil {
+		return err
+	}
+	fields, ok := value.(map[string]interface{})
+	if !ok {
+		return errors.New("MessagePack batch is not a map")
+	}
+	batch.Metrics = batch.Metrics[:0]
+	batch.Control = nil
+	if control, ok := fields["control"].(map[string]interface{}); ok {
+		c := &Control{}
+		c.Type, _ = control["type"].(string)
+		c.Value, _ = control["value"].(string)
+		c.Id, _ = control["id"].(string)
+		batch.Control = c
+	}
+	metrics, ok := fields["metrics"].([]interface{})
+	if !ok && fields["metrics"] != nil {
+		return errors.New("MessagePack batch metrics are not an array")
+	}
+	for _, metric := range metrics {
+		fields, ok := metric.(map[string]interface{})
+		if !ok {
+			return errors.New("MessagePack metric is not a map")
+		}
+		var m Metric
+		if m.Timestamp, ok = msgpackFloat(fields["timestamp"]); !ok {
+			return fmt.Errorf("invalid MessagePack metric timestamp %v", fields["timestamp"])
+		}
+		if m.Value, ok = msgpackFloat(fields["value"]); !ok {
+			return fmt.Errorf("invalid MessagePack metric value %v", fields["value"])
+		}
+		if m.Metric, ok = fields["metric"].(string); !ok {
+			return fmt.Errorf("invalid MessagePack metric name %v", fields["metric"])
+		}
+		m.Tags, _ = fields["tags"].(map[string]interface{})
+		m.Error, _ = fields["error"].(bool)
+		batch.Metrics = append(batch.Metrics, m)
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package metricshipper
+
+import (
+	"bytes"
+	"encoding/hex"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMsgpackRoundTrip(t *testing.T) {
+	batch := typedBatch()
+	data, err := batch.MarshalMsgpack()
+	if err != nil {
+		t.Fatalf("unable to marshal MessagePack: %s", err)
+	}
+	decoded := &MetricBatch{}
+	if err := decoded.UnmarshalMsgpack(data); err != nil {
+		t.Fatalf("unable to unmarshal MessagePack: %s", err)
+	}
+	if !reflect.DeepEqual(batch, decoded) {
+		t.Errorf("expected %+v, got %+v", batch, decoded)
+	}
+	if err := decoded.UnmarshalMsgpack(data[:len(data)-1]); err == nil {
+		t.Error("expected a truncated message to be an error")
+	}
+}
+
+func TestMsgpackEncoding(t *testing.T) {
+	batch := &MetricBatch{Metrics: []Metric{{Timestamp: 1, Metric: "cpu", Value: 2}}}
+	data, _ := batch.MarshalMsgpack()
+	expected, _ := hex.DecodeString("82" +
+		"a7636f6e74726f6c" + "c0" + // control: nil
+		"a76d657472696373" + "91" + "85" + // metrics: [{
+		"a974696d657374616d70" + "cb3ff0000000000000" + // timestamp: 1.0
+		"a66d6574726963" + "a3637075" + // metric: "cpu"
+		"a576616c7565" + "cb4000000000000000" + // value: 2.0
+		"a474616773" + "c0" + // tags: nil
+		"a56572726f72" + "c2") // error: false }]
+	if !bytes.Equal(data, expected) {
+		t.Errorf("expected\n%s\ngot\n%s", hex.Dump(expected), hex.Dump(data))
+	}
+}
+
+func TestMsgpackFormats(t *testing.T) {
+	long := strings.Repeat("x", 300)
+	for _, v := range []interface{}{
+		int64(0), int64(127), int64(-32), int64(-33), int64(200), int64(-200),
+		int64(70000), int64(-70000), int64(math.MaxInt64), int64(math.MinInt64),
+		"", long, 1.5, true, false, nil,
+	} {
+		var data []byte
+		switch v := v.(type) {
+		case int64:
+			data = appendMsgpackInt(nil, v)
+		case string:
+			data = appendMsgpackString(nil, v)
+		case float64:
+			data = appendMsgpackFloat(nil, v)
+		case bool:
+			data = appendMsgpackBool(nil, v)
+		default:
+			data = appendMsgpackNil(nil)
+		}
+		r := &msgpackReader{data: data}
+		if decoded, err := r.value(); err != nil || decoded != v || len(r.data) != 0 {
+			t.Errorf("expected %v to round trip, got %v: %v", v, decoded, err)
+		}
+	}
+
+	// Arrays and maps past the sizes of their fixed formats
+	data := appendMsgpackArrayHeader(nil, 20)
+	for i := 0; i < 20; i++ {
+		data = appendMsgpackInt(data, int64(i))
+	}
+	if decoded, err := (&msgpackReader{data: data}).value(); err != nil || len(decoded.([]interface{})) != 20 {
+		t.Errorf("expected an array of 20 values, got %v: %v", decoded, err)
+	}
+	if _, err := (&msgpackReader{data: []byte{0xc1}}).value(); err == nil {
+		t.Error("expected an unused format to be an error")
+	}
+}
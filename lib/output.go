@@ -1,10 +1,12 @@
 package metricshipper
 
 import (
-	"encoding/base64"
 	"encoding/json"
+	"fmt"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/rcrowley/go-metrics"
@@ -14,33 +16,212 @@ import (
 
 var origin string = "http://localhost"
 
+// How long the spool replayer waits before checking an empty spool again
+const spoolPollInterval = 1 * time.Second
+
+// Request header declaring the encoding of websocket messages to the consumer
+const encodingHeader = "X-Metricshipper-Encoding"
+
+var errNoConnection = PublisherError{Msg: "No connection to the consumer available"}
+
+// BatchRejectedError is returned when the consumer refuses a batch. Sending
+// the same batch again would fail the same way.
+type BatchRejectedError struct {
+	Control Control
+}
+
+func (e BatchRejectedError) Error() string {
+	return fmt.Sprintf("Consumer rejected batch %s: %s %s", e.Control.Id, e.Control.Type, e.Control.Value)
+}
+
 type WebsocketPublisher struct {
-	pool               *WebSocketConnPool
-	batch_size         int
-	batch_timeout      float64
-	encoding           string
-	Outgoing           chan Metric
-	OutgoingDatapoints metrics.Meter // number of datapoints written to websocket endpoint
-	OutgoingBytes      metrics.Meter // number of bytes written to websocket endpoint
-	ErrorDatapoints    metrics.Meter
+	sequence               uint64 // Last batch id; first for atomic alignment
+	lastSend               int64  // UnixNano of the last delivered batch
+	idPrefix               string
+	pool                   *WebSocketConnPool
+	batch_size             int
+	batch_timeout          float64
+	maxBatchBytes          int         // Estimated bytes to end batches at; 0 for no limit
+	sizer                  *batchSizer // Adapts the batch size, if not nil
+	encoding               string
+	compressValues         bool // XOR compress values in binary version 1
+	codec                  Codec
+	dictionaryLimit        int  // Entries to reset dictionaries at; 0 for no limit
+	spool                  *Spool
+	spoolAfter             time.Duration
+	ackTimeout             time.Duration
+	retry                  RetryPolicy
+	deadLetters            *DeadLetterFile
+	balancing              Balancing
+	dialHooks              []DialHook
+	dialer                 Dialer
+	sender                 BatchSender
+	taps                   []*Tap
+	reconnect              ReconnectPolicy
+	health                 *HealthRegistry
+	keepalive              time.Duration // Idle time to ping connections after; 0 disables
+	pongTimeout            time.Duration
+	writeTimeout           time.Duration // Longest sending a batch may block; 0 for no limit
+	mtraceEnabled          bool
+	stop                   chan struct{} // Closed by Stop
+	stopOnce               sync.Once
+	running                sync.WaitGroup // Goroutines sending batches
+	Outgoing               chan Metric
+	OutgoingDatapoints     metrics.Meter // number of datapoints written to websocket endpoint
+	OutgoingBytes          metrics.Meter // number of bytes written to websocket endpoint
+	UncompressedBytes      metrics.Meter // number of bytes written before compression
+	ErrorDatapoints        metrics.Meter
+	RetriedBatches         metrics.Meter // number of times a batch was sent again
+	DeadLetteredDatapoints metrics.Meter // number of datapoints given up on
+}
+
+// PublisherOption enables an optional publisher feature
+type PublisherOption func(*WebsocketPublisher)
+
+// WithSpool writes batches to the spool when no connection to the consumer
+// becomes available within after, or when sending them fails. Spooled
+// batches are replayed in order once the consumer is reachable again, and new
+// batches are spooled behind them until the replay catches up.
+func WithSpool(spool *Spool, after time.Duration) PublisherOption {
+	return func(w *WebsocketPublisher) {
+		w.spool = spool
+		w.spoolAfter = after
+	}
+}
+
+// WithAcknowledgements only counts a batch as sent once the consumer has
+// acknowledged it. A batch that is not acknowledged within timeout is sent
+// again; one the consumer rejects is retried according to the retry policy.
+func WithAcknowledgements(timeout time.Duration) PublisherOption {
+	return func(w *WebsocketPublisher) {
+		w.ackTimeout = timeout
+	}
+}
+
+// WithRetryPolicy bounds the attempts to send a batch the consumer can't
+// accept. Failures to reach the consumer are retried indefinitely.
+func WithRetryPolicy(policy RetryPolicy) PublisherOption {
+	return func(w *WebsocketPublisher) {
+		w.retry = policy
+	}
+}
+
+// WithDeadLetterFile records metrics that are given up on in file, rather
+// than only logging them.
+func WithDeadLetterFile(file *DeadLetterFile) PublisherOption {
+	return func(w *WebsocketPublisher) {
+		w.deadLetters = file
+	}
+}
+
+// WithBalancing decides how connections are spread over several consumers
+func WithBalancing(balancing Balancing) PublisherOption {
+	return func(w *WebsocketPublisher) {
+		w.balancing = balancing
+	}
+}
+
+// Subprotocols offered to the consumer for the versions of the binary encoding
+const (
+	protocolBinaryV0 = "metricshipper-binary-v0"
+	protocolBinaryV1 = "metricshipper-binary-v1"
+)
+
+// WithBinaryVersion offers the consumer versions of the binary encoding up to
+// version when connecting, as websocket subprotocols. Each connection uses
+// the version the consumer picks, or version 0 if it doesn't pick one.
+// compress enables XOR compression of values in version 1.
+func WithBinaryVersion(version int, compress bool) PublisherOption {
+	return func(w *WebsocketPublisher) {
+		w.compressValues = compress
+		if version < binaryV1 {
+			return
+		}
+		w.dialHooks = append(w.dialHooks, func(config *websocket.Config) (time.Time, error) {
+			config.Protocol = []string{protocolBinaryV1, protocolBinaryV0}
+			return time.Time{}, nil
+		})
+	}
+}
+
+// WithCompression compresses batches with codec, declaring it to the
+// consumer when connecting. Compressed JSON batches are sent as binary
+// messages. Without it binary batches are compressed with snappy and JSON
+// batches are not compressed.
+func WithCompression(codec Codec) PublisherOption {
+	return func(w *WebsocketPublisher) {
+		w.codec = codec
+		w.dialHooks = append(w.dialHooks, func(config *websocket.Config) (time.Time, error) {
+			config.Header.Set(compressionHeader, codec.Name)
+			return time.Time{}, nil
+		})
+	}
+}
+
+// WithDictionaryLimit resets the translation dictionary of a connection
+// before sending a binary batch once it holds limit entries, telling the
+// consumer with a RESET_DICTIONARY control message. Without a limit
+// dictionaries grow until their connection is closed.
+func WithDictionaryLimit(limit int) PublisherOption {
+	return func(w *WebsocketPublisher) {
+		w.dictionaryLimit = limit
+	}
+}
+
+// WithReconnectBackoff doubles the delay between attempts to connect to a
+// consumer that can't be reached up to max, shortening each at random by up
+// to jitter of itself.
+func WithReconnectBackoff(max time.Duration, jitter float64) PublisherOption {
+	return func(w *WebsocketPublisher) {
+		w.reconnect.MaxDelay = max
+		w.reconnect.Jitter = jitter
+	}
+}
+
+// WithKeepalive pings connections that have been idle in the pool for
+// interval, evicting those the consumer doesn't answer within timeout, so
+// that half-open connections are replaced before a batch is sent on them.
+func WithKeepalive(interval, timeout time.Duration) PublisherOption {
+	return func(w *WebsocketPublisher) {
+		w.keepalive = interval
+		w.pongTimeout = timeout
+	}
+}
+
+// WithWriteTimeout evicts a connection when sending a batch on it blocks for
+// longer than timeout
+func WithWriteTimeout(timeout time.Duration) PublisherOption {
+	return func(w *WebsocketPublisher) {
+		w.writeTimeout = timeout
+	}
+}
+
+// WithSender sends batches with sender instead of websocket connections
+func WithSender(sender BatchSender) PublisherOption {
+	return func(w *WebsocketPublisher) {
+		w.sender = sender
+	}
 }
 
+// NewWebsocketPublisher publishes to the consumer at uri, which may be a
+// comma-separated list of consumers to fail over or balance between.
 func NewWebsocketPublisher(uri string, concurrency int, buffer_size int,
 	batch_size int, batch_timeout float64, retry_connection_timeout time.Duration,
 	max_connection_age time.Duration, username string, password string,
-	encoding string, window, maxcollisions, maxdelay int, mte bool) (publisher *WebsocketPublisher, err error) {
-
-	mtraceEnabled = mte
+	encoding string, window, maxcollisions, maxdelay int, mte bool,
+	options ...PublisherOption) (publisher *WebsocketPublisher, err error) {
 
-	config, err := websocket.NewConfig(uri, origin)
-	if err != nil {
-		return nil, err
+	basic, _, _ := BasicAuth{Username: username, Password: password}.Authorization()
+	var configs []*websocket.Config
+	for _, location := range strings.Split(uri, ",") {
+		config, err := websocket.NewConfig(strings.TrimSpace(location), origin)
+		if err != nil {
+			return nil, err
+		}
+		config.Header.Add("Authorization", basic)
+		configs = append(configs, config)
 	}
 
-	data := []byte(username + ":" + password)
-	str := base64.StdEncoding.EncodeToString(data)
-	config.Header.Add("Authorization", "basic "+str)
-
 	outgoingDatapoints := metrics.NewMeter()
 	metrics.Register("outgoingDatapoints", outgoingDatapoints)
 	outgoingBytes := metrics.NewMeter()
@@ -48,69 +229,185 @@ func NewWebsocketPublisher(uri string, concurrency int, buffer_size int,
 	errorDataPoints := metrics.NewMeter()
 	metrics.Register("errorDatapoints", errorDataPoints)
 
-	pool := NewWebSocketConnPool(concurrency, retry_connection_timeout, max_connection_age, config)
 	publisher = &WebsocketPublisher{
-		pool:               pool,
-		batch_size:         batch_size,
-		batch_timeout:      batch_timeout,
-		encoding:           encoding,
-		Outgoing:           make(chan Metric, buffer_size),
-		OutgoingDatapoints: outgoingDatapoints,
-		OutgoingBytes:      outgoingBytes,
-		ErrorDatapoints:    errorDataPoints,
+		idPrefix:               strconv.FormatInt(time.Now().UnixNano(), 36),
+		batch_size:             batch_size,
+		batch_timeout:          batch_timeout,
+		encoding:               encoding,
+		mtraceEnabled:          mte,
+		stop:                   make(chan struct{}),
+		Outgoing:               make(chan Metric, buffer_size),
+		OutgoingDatapoints:     outgoingDatapoints,
+		OutgoingBytes:          outgoingBytes,
+		ErrorDatapoints:        errorDataPoints,
+		retry:                  DefaultRetryPolicy,
+		reconnect:              ReconnectPolicy{InitialDelay: retry_connection_timeout},
+		UncompressedBytes:      uncompressedBytes,
+		RetriedBatches:         metrics.GetOrRegisterMeter("retriedBatches", StatsRegistry),
+		DeadLetteredDatapoints: metrics.GetOrRegisterMeter("deadLetteredDatapoints", StatsRegistry),
+	}
+	for _, option := range options {
+		option(publisher)
+	}
+	if publisher.sizer != nil {
+		publisher.sizer.start(batch_size)
+	}
+	if publisher.codec.Name == "" {
+		// Binary batches have always been compressed with snappy
+		publisher.codec = Codec{Name: codecNone}
+		if strings.ToLower(encoding) == "binary" {
+			publisher.codec.Name = codecSnappy
+		}
+	}
+	if publisher.sender == nil {
+		// Consumers can't tell protobuf and msgpack batches apart otherwise
+		publisher.dialHooks = append(publisher.dialHooks, func(config *websocket.Config) (time.Time, error) {
+			config.Header.Set(encodingHeader, strings.ToLower(encoding))
+			return time.Time{}, nil
+		})
+		publisher.pool = NewWebSocketConnPool(concurrency, publisher.reconnect, max_connection_age,
+			publisher.balancing, publisher.dialHooks, publisher.dialer, configs...)
 	}
 
-	// Block until at least one connection has been established
-	pool.WaitForConnection()
+	if publisher.health != nil {
+		publisher.health.Register("output", publisher.Check)
+	}
+	if publisher.pool != nil && publisher.keepalive > 0 {
+		go publisher.Keepalive()
+	}
+
+	if publisher.spool != nil {
+		// Batches go to the spool until the consumer is reachable
+		publisher.running.Add(1)
+		go func() {
+			defer publisher.running.Done()
+			publisher.ReplaySpool(NewBackoff(window, maxcollisions, maxdelay))
+		}()
+	} else if publisher.pool != nil {
+		// Block until at least one connection has been established
+		publisher.pool.WaitForConnection()
+	}
 
 	// Now it's cool to open the gates
 	for i := 0; i < concurrency; i++ {
-		go publisher.DoBatch(NewBackoff(window, maxcollisions, maxdelay))
+		publisher.running.Add(1)
+		go func() {
+			defer publisher.running.Done()
+			publisher.DoBatch(NewBackoff(window, maxcollisions, maxdelay))
+		}()
 	}
 	return publisher, nil
 }
 
-func (w *WebsocketPublisher) getBatch() (int, *MetricBatch, *MetricBatch) {
+// Stop stops sending batches and waits for the batches being sent. Metrics
+// still buffered are not sent.
+func (w *WebsocketPublisher) Stop() {
+	w.stopOnce.Do(func() {
+		close(w.stop)
+	})
+	w.running.Wait()
+}
+
+// stopped returns whether Stop was called
+func (w *WebsocketPublisher) stopped() bool {
+	select {
+	case <-w.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// batchSize returns the number of metrics to end the next batch at
+func (w *WebsocketPublisher) batchSize() int {
+	if w.sizer != nil {
+		return w.sizer.current()
+	}
+	return w.batch_size
+}
+
+// getBatch collects metrics until the batch is full or the batch timeout
+// expires, starting with held if it is not nil. A metric that would take the
+// batch past its byte limit is returned to start the next batch with.
+func (w *WebsocketPublisher) getBatch(held *Metric) (int, *MetricBatch, *MetricBatch, *Metric) {
 	glog.V(3).Infof("enter getBatch()")
 	buf := make([]Metric, 0)
 	errorBuffer := make([]Metric, 0)
 	batch := &MetricBatch{
 		Metrics: buf,
-		MTraceEnabled: mtraceEnabled,
+		MTraceEnabled: w.mtraceEnabled,
 	}
 	errorBatch := &MetricBatch{
 		Metrics: errorBuffer,
+		MTraceEnabled: w.mtraceEnabled,
 	}
 	defer glog.V(3).Infof("exit getBatch(), len(buf)=%d, len(errorBuffer)=%d", len(buf), len(errorBuffer))
 
-	remaining := w.batch_size - len(buf)
-	timer := time.After(time.Duration(w.batch_timeout) * time.Second)
+	var size int
+	remaining := w.batchSize() - len(buf)
+	timer := time.After(time.Duration(w.batch_timeout * float64(time.Second)))
 	for i := 0; i < remaining; i++ {
-		select {
-		case <-timer:
-			i = remaining // Break out of the loop
-		case m := <-w.Outgoing:
-			if m.Error {
-				errorBuffer = append(errorBuffer, m)
-			} else {
-				buf = append(buf, m)
+		var m Metric
+		if held != nil {
+			m, held = *held, nil
+		} else {
+			select {
+			case <-timer:
+				i = remaining // Break out of the loop
+				continue
+			case m = <-w.Outgoing:
+			}
+		}
+		if m.Error {
+			errorBuffer = append(errorBuffer, m)
+			continue
+		}
+		if w.maxBatchBytes > 0 {
+			msize := metricSize(&m)
+			if len(buf) > 0 && size+msize > w.maxBatchBytes {
+				held = &m
+				break
 			}
+			size += msize
 		}
+		buf = append(buf, m)
 	}
 	batch.Metrics = buf
 	errorBatch.Metrics = errorBuffer
 
-	return len(buf), batch, errorBatch
+	return len(buf), batch, errorBatch, held
 }
 
 func (w *WebsocketPublisher) sendBatch(batch *MetricBatch, backoff *Backoff) (metricCount, bytes int, err error) {
+	if sender, ok := w.sender.(CompressedBatchSender); ok {
+		num, bytes, uncompressed, err := sender.SendCompressedBatch(batch, backoff)
+		if err == nil {
+			w.UncompressedBytes.Mark(int64(uncompressed))
+		}
+		return num, bytes, err
+	}
+	if w.sender != nil {
+		// Other senders send batches as they are encoded
+		num, bytes, err := w.sender.SendBatch(batch, backoff)
+		if err == nil {
+			w.UncompressedBytes.Mark(int64(bytes))
+		}
+		return num, bytes, err
+	}
 	var num int
 	if batch != nil {
 		num = len(batch.Metrics)
 	}
-	conn := w.pool.Get()
+	conn := w.getConnection()
+	if conn == nil {
+		return 0, 0, errNoConnection
+	}
 	defer w.pool.Put(conn)
-	glog.V(3).Infof("enter sendBatch(), conn=%s, len(batch)=%d", w.pool.config.Location, len(batch.Metrics))
+	if w.writeTimeout > 0 {
+		conn.conn.SetWriteDeadline(time.Now().Add(w.writeTimeout))
+		defer conn.conn.SetWriteDeadline(time.Time{})
+	}
+	glog.V(3).Infof("enter sendBatch(), conn=%s, len(batch)=%d", conn.endpoint.config.Location, len(batch.Metrics))
 	defer glog.V(3).Infof("exit sendBatch(), num=%d", num)
 
 	if glog.V(5) {
@@ -120,22 +417,81 @@ func (w *WebsocketPublisher) sendBatch(batch *MetricBatch, backoff *Backoff) (me
 	}
 	batch.Tracer("publishing")
 
+	var id string
+	if w.ackTimeout > 0 {
+		id = w.nextBatchId()
+		batch.Control = &Control{Type: "BATCH", Id: id}
+	}
+
+	var msg []byte
+	text := false
 	switch strings.ToLower(w.encoding) {
-	case "json":
-		bytes, err = websocket.JSON.Send(conn.conn, batch)
 	case "binary":
-		msg, err := batch.MarshalBinary(conn.dictionary, true)
-		if err != nil {
-			return 0, bytes, err
+		if w.dictionaryLimit > 0 && conn.dictionary.size() >= w.dictionaryLimit {
+			if err = w.resetDictionary(conn, backoff); err != nil {
+				return 0, 0, err
+			}
+		}
+		if conn.version >= binaryV1 {
+			msg, err = batch.MarshalBinaryV1(conn.dictionary, w.compressValues, false)
+		} else {
+			msg, err = batch.MarshalBinary(conn.dictionary, false)
 		}
+	case encodingProtobuf:
+		msg, err = batch.MarshalProtobuf()
+	case encodingMsgpack:
+		msg, err = batch.MarshalMsgpack()
+	default:
+		msg, err = json.Marshal(batch)
+		text = w.codec.Name == codecNone
+	}
+	if err != nil {
+		return 0, 0, BatchError{Err: err}
+	}
+	uncompressed := len(msg)
+	if msg, err = w.codec.Compress(msg); err != nil {
+		return 0, 0, BatchError{Err: err}
+	}
+	if text {
+		bytes, err = websocket.Message.Send(conn.conn, string(msg))
+	} else {
 		bytes, err = websocket.Message.Send(conn.conn, msg)
 	}
 	if err != nil {
-		conn.Close()
+		if isTimeout(err) {
+			w.pool.Evict(conn, fmt.Sprintf("sending a batch took longer than %s", w.writeTimeout))
+		} else {
+			conn.Close()
+		}
 		return num, bytes, err
 	}
 	batch.Tracer("sent")
-	return num, bytes, w.readResponse(conn, backoff)
+	if w.ackTimeout > 0 {
+		err = w.waitForAck(conn, id, backoff)
+	} else {
+		err = w.readResponse(conn, backoff)
+	}
+	if err == nil {
+		w.UncompressedBytes.Mark(int64(uncompressed))
+	}
+	return num, bytes, err
+}
+
+func (w *WebsocketPublisher) nextBatchId() string {
+	return fmt.Sprintf("%s-%d", w.idPrefix, atomic.AddUint64(&w.sequence, 1))
+}
+
+// getConnection takes a connection from the pool. With a spool, it gives up
+// and returns nil if no connection becomes available in time.
+func (w *WebsocketPublisher) getConnection() *WebSocketConn {
+	if w.spool == nil {
+		return w.pool.Get()
+	}
+	if w.pool.State() == CircuitOpen {
+		// The consumer is down, so there is no point waiting to spool
+		return w.pool.TryGet()
+	}
+	return w.pool.GetTimeout(w.spoolAfter)
 }
 
 var bufferPool = &sync.Pool{
@@ -153,7 +509,7 @@ func (w *WebsocketPublisher) readResponse(conn *WebSocketConn, backoff *Backoff)
 		deadline := time.Now().Add(time.Microsecond)
 		err = conn.conn.SetReadDeadline(deadline)
 
-		if n, err = conn.conn.Read(msg); err != nil && !strings.HasSuffix(err.Error(), "i/o timeout") {
+		if n, err = conn.conn.Read(msg); err != nil && !isTimeout(err) {
 			conn.Close()
 			break
 		}
@@ -162,41 +518,288 @@ func (w *WebsocketPublisher) readResponse(conn *WebSocketConn, backoff *Backoff)
 		if n == 0 {
 			break
 		}
-		dmsg := make(map[string]string)
-		if err := json.Unmarshal(msg[0:n], &dmsg); err != nil {
+		if err := w.handleResponse(conn, msg[0:n], backoff); err != nil {
+			return err
+		}
+	}
+	return err
+}
+
+// handleResponse acts on a response to an unacknowledged batch. backoff may
+// be nil if no batch is being sent.
+func (w *WebsocketPublisher) handleResponse(conn *WebSocketConn, msg []byte, backoff *Backoff) error {
+	dmsg := make(map[string]string)
+	if err := json.Unmarshal(msg, &dmsg); err != nil {
+		return err
+	}
+	if (strings.HasSuffix(dmsg["type"], "COLLISION") || dmsg["type"] == "DROPPED") && backoff != nil {
+		backoff.Collision()
+	}
+	if dmsg["type"] == "RESYNC" {
+		// The consumer lost its copy of the dictionary, so every entry
+		// has to be sent again
+		glog.Warningf("Consumer %s asked to resend the dictionary", conn.endpoint.config.Location)
+		conn.dictionary.reset()
+	}
+	glog.V(2).Infof("Server responded with message: %v", dmsg)
+	return nil
+}
+
+// isTimeout returns whether err is a deadline expiring
+func isTimeout(err error) bool {
+	return strings.HasSuffix(err.Error(), "i/o timeout")
+}
+
+// Keepalive pings the connections that have been idle for the keepalive
+// interval, evicting those that don't answer
+func (w *WebsocketPublisher) Keepalive() {
+	ticker := time.NewTicker(w.keepalive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-w.stop:
+			return
+		}
+		for _, conn := range w.pool.Idle(w.keepalive) {
+			go func(conn *WebSocketConn) {
+				defer w.pool.Put(conn)
+				if err := w.ping(conn); err != nil {
+					w.pool.Evict(conn, err.Error())
+				}
+			}(conn)
+		}
+	}
+}
+
+// ping sends a ping on a connection and waits for the pong, handling the
+// responses to earlier batches that arrive before it. The websocket library
+// reports pongs as ErrNotImplemented once it has read their header, so pings
+// carry no payload that would be left unread.
+func (w *WebsocketPublisher) ping(conn *WebSocketConn) error {
+	deadline := time.Now().Add(w.pongTimeout)
+	conn.conn.SetWriteDeadline(deadline)
+	conn.conn.SetReadDeadline(deadline)
+	defer conn.conn.SetWriteDeadline(time.Time{})
+	defer conn.conn.SetReadDeadline(time.Time{})
+	conn.conn.PayloadType = websocket.PingFrame
+	_, err := conn.conn.Write(nil)
+	conn.conn.PayloadType = websocket.TextFrame
+	if err != nil {
+		return fmt.Errorf("unable to ping: %s", err)
+	}
+
+	msg := bufferPool.Get().([]byte)
+	defer bufferPool.Put(msg)
+	for {
+		n, err := conn.conn.Read(msg)
+		switch {
+		case err == websocket.ErrNotImplemented:
+			glog.V(3).Infof("Consumer %s answered ping", conn.endpoint.config.Location)
+			return nil
+		case err != nil && isTimeout(err):
+			return fmt.Errorf("no pong within %s", w.pongTimeout)
+		case err != nil:
 			return err
 		}
-		if strings.HasSuffix(dmsg["type"], "COLLISION") || dmsg["type"] == "DROPPED" {
+		if err := w.handleResponse(conn, msg[0:n], nil); err != nil {
+			glog.Warningf("Invalid response from consumer %s: %s", conn.endpoint.config.Location, err)
+		}
+	}
+}
+
+// waitForAck reads responses until the consumer acknowledges the batch with
+// the given id. Binary batches carry no id, so responses without one are
+// matched to batches in the order they were sent.
+func (w *WebsocketPublisher) waitForAck(conn *WebSocketConn, id string, backoff *Backoff) error {
+	conn.conn.SetReadDeadline(time.Now().Add(w.ackTimeout))
+	defer conn.conn.SetReadDeadline(time.Time{})
+	for {
+		var control Control
+		if err := websocket.JSON.Receive(conn.conn, &control); err != nil {
+			// The response may still arrive, so the connection can't be reused
+			conn.Close()
+			if isTimeout(err) {
+				return PublisherError{Msg: fmt.Sprintf("Batch %s was not acknowledged within %s", id, w.ackTimeout)}
+			}
+			return err
+		}
+		glog.V(2).Infof("Server responded with message: %+v", control)
+		if control.Id != "" && control.Id != id {
+			glog.V(1).Infof("Ignoring response to batch %s while waiting for %s", control.Id, id)
+			continue
+		}
+		switch {
+		case control.Type == "OK":
+			return nil
+		case strings.HasSuffix(control.Type, "COLLISION"):
 			backoff.Collision()
+		case control.Type == "DROPPED":
+			backoff.Collision()
+			return PublisherError{Msg: fmt.Sprintf("Consumer dropped batch %s", id)}
+		case control.Type == "ERROR" || control.Type == "MALFORMED_REQUEST":
+			control.Id = id
+			return BatchRejectedError{Control: control}
+		case control.Type == "RESYNC":
+			glog.Warningf("Consumer %s asked to resend the dictionary", conn.endpoint.config.Location)
+			conn.dictionary.reset()
+			return PublisherError{Msg: fmt.Sprintf("Consumer could not decode batch %s", id)}
+		}
+	}
+}
+
+// resetDictionary empties the translation dictionary of a connection and
+// tells the consumer to do the same. Entries are sent along again when they
+// are used next, so consumers that ignore the message stay in sync.
+func (w *WebsocketPublisher) resetDictionary(conn *WebSocketConn, backoff *Backoff) error {
+	glog.V(1).Infof("Resetting dictionary of %d entries", conn.dictionary.size())
+	control := &Control{Type: "RESET_DICTIONARY"}
+	if w.ackTimeout > 0 {
+		control.Id = w.nextBatchId()
+	}
+	msg, err := json.Marshal(MetricBatch{Control: control, Metrics: []Metric{}})
+	if err != nil {
+		return err
+	}
+	if _, err := websocket.Message.Send(conn.conn, string(msg)); err != nil {
+		if isTimeout(err) {
+			w.pool.Evict(conn, fmt.Sprintf("sending a dictionary reset took longer than %s", w.writeTimeout))
+		} else {
+			conn.Close()
+		}
+		return err
+	}
+	conn.dictionary.reset()
+	if w.ackTimeout > 0 {
+		return w.waitForAck(conn, control.Id, backoff)
+	}
+	return nil
+}
+
+// deliver sends a batch, retrying failures caused by its contents according
+// to the retry policy. Once the attempts are used up the batch is split in
+// halves, each tried once, to isolate the metrics responsible; those are
+// dead-lettered. Only failures to reach the consumer are returned.
+func (w *WebsocketPublisher) deliver(batch *MetricBatch, backoff *Backoff, attempts int) error {
+	for attempt := 1; ; attempt++ {
+		backoff.Wait()
+		collisions := backoff.Total()
+		start := time.Now()
+		metrics, bytes, err := w.sendBatch(batch, backoff)
+		if w.sizer != nil && (err == nil || backoff.Total() != collisions) {
+			w.sizer.observe(time.Since(start), backoff.Total() != collisions)
+		}
+		if err == nil {
+			glog.V(2).Infof("Sent %d metrics to the consumer.", metrics)
+
+			// update meter with number of metrics sent
+			atomic.StoreInt64(&w.lastSend, time.Now().UnixNano())
+			w.OutgoingDatapoints.Mark(int64(metrics))
+			w.OutgoingBytes.Mark(int64(bytes))
+			return nil
+		}
+		if !isBatchError(err) {
+			return err
+		}
+		if attempt < attempts {
+			delay := w.retry.Delay(attempt)
+			glog.Warningf("Failed sending %d metrics (attempt %d of %d), retrying in %s: %s",
+				len(batch.Metrics), attempt, attempts, delay, err)
+			w.RetriedBatches.Mark(1)
+			time.Sleep(delay)
+			continue
+		}
+		if len(batch.Metrics) == 1 {
+			w.deadLetter(batch, err)
+			return nil
+		}
+		half := len(batch.Metrics) / 2
+		for _, metrics := range [][]Metric{batch.Metrics[:half], batch.Metrics[half:]} {
+			part := &MetricBatch{Metrics: metrics, MTraceEnabled: batch.MTraceEnabled}
+			if err := w.deliver(part, backoff, 1); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// deadLetter gives up on a batch
+func (w *WebsocketPublisher) deadLetter(batch *MetricBatch, cause error) {
+	glog.Errorf("Giving up on %d metrics: %s", len(batch.Metrics), cause)
+	w.DeadLetteredDatapoints.Mark(int64(len(batch.Metrics)))
+	if w.deadLetters != nil {
+		if err := w.deadLetters.Write(batch, cause); err != nil {
+			glog.Errorf("Unable to write dead letters: %s", err)
 		}
-		glog.V(2).Infof("Server responded with message: %v", dmsg)
 	}
-	return err
 }
 
 func (w *WebsocketPublisher) DoBatch(backoff *Backoff) {
-	for {
+	var held *Metric
+	for !w.stopped() {
+		num, batch, errorBatch, next := w.getBatch(held)
+		held = next
+		if num == 0 {
+			continue
+		}
+		for _, tap := range w.taps {
+			tap.Send(batch)
+		}
+		// Batches queue up behind the spooled ones until the replay catches
+		// up, so the consumer gets every series in order
+		if w.spool != nil && !w.spool.Empty() {
+			if err := w.spool.Append(batch); err != nil {
+				glog.Errorf("Unable to spool %d metrics: %s", num, err)
+			} else {
+				glog.V(2).Infof("Spooled %d metrics behind the replay", num)
+				continue
+			}
+		}
 		// Retry loop
-		num, batch, errorBatch := w.getBatch()
-		if num > 0 {
-			for {
-				backoff.Wait()
-				metrics, bytes, err := w.sendBatch(batch, backoff)
-				if err == nil {
-					glog.V(2).Infof("Sent %d metrics to the consumer.", metrics)
-
-					// update meter with number of metrics sent
-					w.OutgoingDatapoints.Mark(int64(metrics))
-					w.OutgoingBytes.Mark(int64(bytes))
-					if errorBatch != nil {
-						w.ErrorDatapoints.Mark(int64(len(errorBatch.Metrics)))
-					}
+		for attempt := 1; ; attempt++ {
+			err := w.deliver(batch, backoff, w.retry.MaxAttempts)
+			if err == nil {
+				if errorBatch != nil {
+					w.ErrorDatapoints.Mark(int64(len(errorBatch.Metrics)))
+				}
+				break
+			}
+			glog.Errorf("Failed sending %d metrics to the consumer: %s", num, err)
 
-					break
+			if w.spool != nil {
+				if err := w.spool.Append(batch); err != nil {
+					glog.Errorf("Unable to spool %d metrics: %s", num, err)
 				} else {
-					glog.Errorf("Failed sending %d metrics to the consumer: %s", num, err)
+					glog.V(1).Infof("Spooled %d metrics", num)
+					break
 				}
 			}
+			w.RetriedBatches.Mark(1)
+			time.Sleep(w.retry.Delay(attempt))
+		}
+	}
+}
+
+// ReplaySpool sends spooled batches to the consumer, oldest first, removing
+// each from the spool once it has been delivered.
+func (w *WebsocketPublisher) ReplaySpool(backoff *Backoff) {
+	for !w.stopped() {
+		batch, err := w.spool.Next()
+		if err != nil {
+			glog.Errorf("Unable to read from spool: %s", err)
+		}
+		if batch == nil {
+			time.Sleep(spoolPollInterval)
+			continue
+		}
+
+		if err := w.deliver(batch, backoff, w.retry.MaxAttempts); err != nil {
+			glog.V(1).Infof("Failed replaying %d spooled metrics: %s", len(batch.Metrics), err)
+			time.Sleep(w.reconnect.InitialDelay)
+			continue
 		}
+		glog.V(2).Infof("Replayed %d spooled metrics to the consumer.", len(batch.Metrics))
+		w.spool.Commit(batch)
 	}
 }
@@ -2,14 +2,23 @@ package metricshipper
 
 import (
 	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
 	"log"
+	"math"
 	"net/http"
 	"net/http/httptest"
+	"os"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	gorilla "github.com/gorilla/websocket"
+	"github.com/rcrowley/go-metrics"
 	"github.com/zenoss/websocket"
 )
 
@@ -65,7 +74,8 @@ func TestConnectFail(t *testing.T) {
 	go func() {
 		_, err := NewWebsocketPublisher("ws://127.0.0.1:12345/metrics", 1, 1, 1, 1, 1, 999, "admin", "zenoss", "json", 1, 1, 1, false)
 		if err != nil {
-			t.Fatalf("Could not create websocket publisher: %s", err)
+			t.Errorf("Could not create websocket publisher: %s", err)
+			return
 		}
 		connected <- true
 	}()
@@ -83,7 +93,8 @@ func TestConnect(t *testing.T) {
 	go func() {
 		_, err := NewWebsocketPublisher("ws://"+serverAddr+"/metrics", 1, 1, 1, 1, 1, 999, "admin", "zenoss", "json", 1, 1, 1, false)
 		if err != nil {
-			t.Fatalf("Could not create websocket publisher: %s", err)
+			t.Errorf("Could not create websocket publisher: %s", err)
+			return
 		}
 		connected <- true
 	}()
@@ -134,3 +145,488 @@ func TestHitBatchTimeout(t *testing.T) {
 	time.Sleep(1 * time.Second)
 	assertBufferSize(1, "Didn't send batch after 1 second", t)
 }
+
+func TestSpoolWhileDisconnected(t *testing.T) {
+	spool, dir := newTestSpool(t, 1<<20, 0)
+	defer os.RemoveAll(dir)
+
+	pub, err := NewWebsocketPublisher("ws://127.0.0.1:12345/metrics", 1, 1, 1, 0.01, 1, 999, "admin", "zenoss", "json", 1, 1, 1, false,
+		WithSpool(spool, 10*time.Millisecond))
+	if err != nil {
+		t.Fatalf("Could not create websocket publisher: %s", err)
+	}
+	stageMetrics(1, pub)
+	deadline := time.Now().Add(time.Second)
+	for spool.Empty() && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if spool.Empty() {
+		t.Error("Batch was not spooled while the consumer was unavailable")
+	}
+}
+
+func TestReplaySpool(t *testing.T) {
+	once.Do(startServer)
+	defer clearBuffer()
+	spool, dir := newTestSpool(t, 1<<20, 0)
+	defer os.RemoveAll(dir)
+	appendBatches(t, spool, "spooled")
+
+	_, err := NewWebsocketPublisher("ws://"+serverAddr+"/metrics", 1, 1, 1, 1, 1, 999, "admin", "zenoss", "json", 1, 1, 1, false,
+		WithSpool(spool, time.Second))
+	if err != nil {
+		t.Fatalf("Could not create websocket publisher: %s", err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for !spool.Empty() && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if !spool.Empty() {
+		t.Fatal("Spooled batch was not replayed")
+	}
+	// The consumer may still be handling the batch
+	for time.Now().Before(deadline.Add(time.Second)) {
+		for _, msg := range buf {
+			if strings.Contains(msg, "spooled") {
+				return
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Errorf("Consumer didn't receive the spooled batch: %v", buf)
+}
+
+func TestReplaySpoolOrder(t *testing.T) {
+	var lock sync.Mutex
+	var received []string
+	server := startAckServer(func(batch int, control Control, metrics []Metric) []Control {
+		if batch == 1 {
+			// Keep the replay busy while new batches come in
+			time.Sleep(100 * time.Millisecond)
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		for _, m := range metrics {
+			received = append(received, m.Metric)
+		}
+		return []Control{{Type: "OK"}}
+	})
+	defer server.Close()
+	spool, dir := newTestSpool(t, 1<<20, 0)
+	defer os.RemoveAll(dir)
+	// Left over from an outage
+	appendBatches(t, spool, "old1", "old2")
+	replayed := spool.Replayed.Count()
+
+	pub, err := NewWebsocketPublisher("ws://"+server.Listener.Addr().String()+"/", 2, 4, 1, 1, 1, 0, "admin", "zenoss", "json", 1, 1, 1, false,
+		WithSpool(spool, time.Second))
+	if err != nil {
+		t.Fatalf("Could not create websocket publisher: %s", err)
+	}
+	defer pub.Stop()
+	stageNamedMetrics(pub, "new1", "new2")
+	if !waitForCount(spool.Replayed, replayed+4) {
+		t.Fatalf("expected every batch to go through the spool, replayed %d", spool.Replayed.Count()-replayed)
+	}
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		lock.Lock()
+		n := len(received)
+		lock.Unlock()
+		if n == 4 {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if fmt.Sprint(received) != "[old1 old2 new1 new2]" {
+		t.Errorf("expected spooled batches before new ones, got %v", received)
+	}
+}
+
+// startAckServer starts a consumer answering each batch with the control
+// messages returned by respond
+func startAckServer(respond func(batch int, control Control, metrics []Metric) []Control) *httptest.Server {
+	var batches int32
+	return httptest.NewServer(websocket.Handler(func(ws *websocket.Conn) {
+		for {
+			var message struct {
+				Control Control  `json:"control"`
+				Metrics []Metric `json:"metrics"`
+			}
+			if err := websocket.JSON.Receive(ws, &message); err != nil {
+				return
+			}
+			for _, response := range respond(int(atomic.AddInt32(&batches, 1)), message.Control, message.Metrics) {
+				websocket.JSON.Send(ws, response)
+			}
+		}
+	}))
+}
+
+func newAckPublisher(t *testing.T, server *httptest.Server, batchSize int, timeout time.Duration, options ...PublisherOption) *WebsocketPublisher {
+	options = append(options, WithAcknowledgements(timeout))
+	pub, err := NewWebsocketPublisher("ws://"+server.Listener.Addr().String()+"/", 1, 4, batchSize, 1, 1, 999, "admin", "zenoss", "json", 1, 1, 1, false,
+		options...)
+	if err != nil {
+		t.Fatalf("Could not create websocket publisher: %s", err)
+	}
+	return pub
+}
+
+func waitForCount(meter metrics.Meter, expected int64) bool {
+	deadline := time.Now().Add(2 * time.Second)
+	for meter.Count() < expected && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	return meter.Count() >= expected
+}
+
+func TestAcknowledgedDelivery(t *testing.T) {
+	server := startAckServer(func(batch int, control Control, metrics []Metric) []Control {
+		if control.Type != "BATCH" || control.Id == "" {
+			t.Errorf("expected batch to carry an id, got %+v", control)
+		}
+		// Responses to other batches don't acknowledge this one
+		return []Control{{Type: "OK", Id: "stale"}, {Type: "LOW_COLLISION"}, {Type: "OK", Id: control.Id}}
+	})
+	defer server.Close()
+
+	pub := newAckPublisher(t, server, 1, time.Second)
+	stageMetrics(2, pub)
+	if !waitForCount(pub.OutgoingDatapoints, 2) {
+		t.Errorf("expected 2 acknowledged datapoints, got %d", pub.OutgoingDatapoints.Count())
+	}
+}
+
+func TestUnacknowledgedBatchIsResent(t *testing.T) {
+	server := startAckServer(func(batch int, control Control, metrics []Metric) []Control {
+		if batch == 1 {
+			return nil
+		}
+		return []Control{{Type: "OK", Id: control.Id}}
+	})
+	defer server.Close()
+
+	pub := newAckPublisher(t, server, 1, 200*time.Millisecond)
+	stageMetrics(1, pub)
+	if !waitForCount(pub.OutgoingDatapoints, 1) {
+		t.Error("expected the unacknowledged batch to be sent again")
+	}
+}
+
+// stageNamedMetrics queues a metric with each of the given names
+func stageNamedMetrics(pub *WebsocketPublisher, names ...string) {
+	for _, name := range names {
+		m := *getMetric()
+		m.Metric = name
+		pub.Outgoing <- m
+	}
+}
+
+func TestRejectedBatch(t *testing.T) {
+	// The consumer refuses any batch with the bad metric in it
+	server := startAckServer(func(batch int, control Control, metrics []Metric) []Control {
+		for _, m := range metrics {
+			if m.Metric == "bad" {
+				return []Control{{Type: "ERROR", Value: "bad metric", Id: control.Id}}
+			}
+		}
+		return []Control{{Type: "OK", Id: control.Id}}
+	})
+	defer server.Close()
+
+	f, err := ioutil.TempFile("", "deadletter")
+	if err != nil {
+		t.Fatalf("unable to create dead letter file: %s", err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+	deadLetters, err := NewDeadLetterFile(f.Name())
+	if err != nil {
+		t.Fatalf("unable to open dead letter file: %s", err)
+	}
+	defer deadLetters.Close()
+
+	pub := newAckPublisher(t, server, 4, time.Second,
+		WithRetryPolicy(RetryPolicy{MaxAttempts: 2, InitialDelay: time.Millisecond, MaxDelay: time.Millisecond}),
+		WithDeadLetterFile(deadLetters))
+	retried, deadLettered := pub.RetriedBatches.Count(), pub.DeadLetteredDatapoints.Count()
+	stageNamedMetrics(pub, "good1", "good2", "bad", "good3")
+	if !waitForCount(pub.OutgoingDatapoints, 3) {
+		t.Fatalf("expected the good metrics to be delivered, got %d", pub.OutgoingDatapoints.Count())
+	}
+	if pub.DeadLetteredDatapoints.Count()-deadLettered != 1 {
+		t.Errorf("expected 1 dead-lettered datapoint, got %d", pub.DeadLetteredDatapoints.Count()-deadLettered)
+	}
+	if pub.RetriedBatches.Count() == retried {
+		t.Error("expected the rejected batch to be retried")
+	}
+	data, _ := ioutil.ReadFile(f.Name())
+	if !strings.Contains(string(data), `"metric":"bad"`) || !strings.Contains(string(data), "bad metric") ||
+		strings.Contains(string(data), "good") {
+		t.Errorf("expected only the bad metric to be dead-lettered with its error, got %s", data)
+	}
+}
+
+func TestUnencodableMetricIsDeadLettered(t *testing.T) {
+	server := startAckServer(func(batch int, control Control, metrics []Metric) []Control {
+		return []Control{{Type: "OK", Id: control.Id}}
+	})
+	defer server.Close()
+
+	pub := newAckPublisher(t, server, 2, time.Second,
+		WithRetryPolicy(RetryPolicy{MaxAttempts: 1}))
+	deadLettered := pub.DeadLetteredDatapoints.Count()
+	m := *getMetric()
+	m.Value = math.NaN()
+	pub.Outgoing <- m
+	stageNamedMetrics(pub, "good")
+	if !waitForCount(pub.OutgoingDatapoints, 1) {
+		t.Fatal("expected the writer to carry on past the unencodable metric")
+	}
+	if pub.DeadLetteredDatapoints.Count()-deadLettered != 1 {
+		t.Errorf("expected 1 dead-lettered datapoint, got %d", pub.DeadLetteredDatapoints.Count()-deadLettered)
+	}
+}
+
+type frame struct {
+	text bool
+	data []byte
+}
+
+// frameCodec receives frames of either type
+var frameCodec = websocket.Codec{Unmarshal: func(data []byte, payloadType byte, v interface{}) error {
+	*v.(*frame) = frame{text: payloadType == websocket.TextFrame, data: data}
+	return nil
+}}
+
+// startBinaryServer decodes binary batches the way a consumer does, keeping
+// a dictionary per connection. respond gets the control of each text message
+// or the decoded binary batch, and may replace the dictionary.
+func startBinaryServer(t *testing.T, respond func(dictionary **ReceiverDictionary, control *Control, batch *MetricBatch) []Control) *httptest.Server {
+	return httptest.NewServer(websocket.Handler(func(ws *websocket.Conn) {
+		dictionary := NewReceiverDictionary()
+		for {
+			var f frame
+			if err := frameCodec.Receive(ws, &f); err != nil {
+				return
+			}
+			var responses []Control
+			if f.text {
+				var message struct {
+					Control Control `json:"control"`
+				}
+				if err := json.Unmarshal(f.data, &message); err != nil {
+					t.Errorf("invalid text message: %s", err)
+				}
+				responses = respond(&dictionary, &message.Control, nil)
+			} else {
+				batch := &MetricBatch{}
+				if err := batch.UnmarshalBinary(f.data, dictionary, true); err != nil {
+					t.Errorf("unable to decode batch: %s", err)
+					continue
+				}
+				responses = respond(&dictionary, nil, batch)
+			}
+			for _, response := range responses {
+				websocket.JSON.Send(ws, response)
+			}
+		}
+	}))
+}
+
+// newBinaryPublisher keeps its connection, and so its dictionary, for good
+func newBinaryPublisher(t *testing.T, server *httptest.Server, batchSize int, options ...PublisherOption) *WebsocketPublisher {
+	pub, err := NewWebsocketPublisher("ws://"+server.Listener.Addr().String()+"/", 1, 4, batchSize, 1, 1, 0, "admin", "zenoss", "binary", 1, 1, 1, false,
+		options...)
+	if err != nil {
+		t.Fatalf("Could not create websocket publisher: %s", err)
+	}
+	return pub
+}
+
+func TestDictionaryLimit(t *testing.T) {
+	var resets, received int32
+	server := startBinaryServer(t, func(dictionary **ReceiverDictionary, control *Control, batch *MetricBatch) []Control {
+		if control != nil {
+			if control.Type != "RESET_DICTIONARY" {
+				t.Errorf("expected a dictionary reset, got %+v", control)
+			}
+			atomic.AddInt32(&resets, 1)
+			*dictionary = NewReceiverDictionary()
+			return []Control{{Type: "OK"}}
+		}
+		atomic.AddInt32(&received, int32(len(batch.Metrics)))
+		return []Control{{Type: "OK"}}
+	})
+	defer server.Close()
+
+	pub := newBinaryPublisher(t, server, 1, WithDictionaryLimit(2))
+	stageNamedMetrics(pub, "a", "b", "c", "d", "a")
+	deadline := time.Now().Add(2 * time.Second)
+	for atomic.LoadInt32(&received) < 5 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if received != 5 {
+		t.Errorf("expected 5 decodable metrics, got %d", received)
+	}
+	if atomic.LoadInt32(&resets) == 0 {
+		t.Error("expected the dictionary to be reset")
+	}
+}
+
+func TestDictionaryResync(t *testing.T) {
+	var batches, received int32
+	server := startBinaryServer(t, func(dictionary **ReceiverDictionary, control *Control, batch *MetricBatch) []Control {
+		// The consumer loses its dictionary after the first batch
+		if atomic.AddInt32(&batches, 1) == 1 {
+			*dictionary = NewReceiverDictionary()
+			return []Control{{Type: "RESYNC"}}
+		}
+		atomic.AddInt32(&received, int32(len(batch.Metrics)))
+		return []Control{{Type: "OK"}}
+	})
+	defer server.Close()
+
+	pub := newBinaryPublisher(t, server, 1, WithAcknowledgements(time.Second))
+	stageNamedMetrics(pub, "a", "a")
+	if !waitForCount(pub.OutgoingDatapoints, 2) {
+		t.Errorf("expected 2 acknowledged datapoints, got %d", pub.OutgoingDatapoints.Count())
+	}
+	if received != 2 {
+		t.Errorf("expected the batch to be resent with its dictionary entries, got %d metrics", received)
+	}
+}
+
+func TestCompressedJSON(t *testing.T) {
+	var received int32
+	declared := make(chan string, 1)
+	server := httptest.NewServer(websocket.Server{
+		Handshake: func(config *websocket.Config, r *http.Request) error {
+			declared <- r.Header.Get(compressionHeader)
+			return nil
+		},
+		Handler: func(ws *websocket.Conn) {
+			for {
+				var f frame
+				if err := frameCodec.Receive(ws, &f); err != nil {
+					return
+				}
+				if f.text {
+					t.Error("expected compressed batches to be sent as binary messages")
+				}
+				data, err := Codec{Name: codecGzip}.Decompress(f.data)
+				if err != nil {
+					t.Errorf("invalid gzip message: %s", err)
+					continue
+				}
+				var batch MetricBatch
+				if err := json.Unmarshal(data, &batch); err != nil {
+					t.Errorf("invalid JSON batch: %s", err)
+				}
+				atomic.AddInt32(&received, int32(len(batch.Metrics)))
+				websocket.JSON.Send(ws, Control{Type: "OK"})
+			}
+		},
+	})
+	defer server.Close()
+
+	uncompressed := uncompressedBytes.Count()
+	pub, err := NewWebsocketPublisher("ws://"+server.Listener.Addr().String()+"/", 1, 4, 4, 1, 1, 0, "admin", "zenoss", "json", 1, 1, 1, false,
+		WithCompression(Codec{Name: codecGzip, Level: 9}))
+	if err != nil {
+		t.Fatalf("Could not create websocket publisher: %s", err)
+	}
+	if header := <-declared; header != "gzip" {
+		t.Errorf("expected gzip to be declared when connecting, got %q", header)
+	}
+	stageNamedMetrics(pub, "cpu", "cpu", "cpu", "cpu")
+	deadline := time.Now().Add(2 * time.Second)
+	for atomic.LoadInt32(&received) < 4 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if !waitForCount(pub.OutgoingDatapoints, 4) || atomic.LoadInt32(&received) != 4 {
+		t.Fatalf("expected 4 datapoints, got %d", received)
+	}
+	if sent := uncompressedBytes.Count() - uncompressed; sent <= pub.OutgoingBytes.Count() {
+		t.Errorf("expected %d bytes on the wire to be fewer than the %d uncompressed", pub.OutgoingBytes.Count(), sent)
+	}
+}
+
+// startSilentServer accepts connections but never reads from them, so pings
+// go unanswered. It counts the connections made.
+func startSilentServer(connections *int32) (*httptest.Server, chan struct{}) {
+	done := make(chan struct{})
+	return httptest.NewServer(websocket.Handler(func(ws *websocket.Conn) {
+		atomic.AddInt32(connections, 1)
+		<-done
+	})), done
+}
+
+func TestPing(t *testing.T) {
+	// The consumer answers an earlier batch before the ping. The server of
+	// the websocket library drops connections on pings without a payload, so
+	// it is played by gorilla, which answers them while reading.
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := gorilla.Upgrade(w, r, nil, 1024, 1024)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.WriteJSON(Control{Type: "RESYNC"})
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}))
+	defer server.Close()
+	w := &WebsocketPublisher{pongTimeout: time.Second}
+	pool := NewWebSocketConnPool(1, ReconnectPolicy{InitialDelay: time.Minute}, 0, Failover, nil, nil, serverConfig(t, server))
+	conn := pool.GetTimeout(time.Second)
+	conn.dictionary.get("cpu")
+	if err := w.ping(conn); err != nil {
+		t.Fatalf("expected a pong, got %s", err)
+	}
+	if conn.dictionary.size() != 0 {
+		t.Error("expected the response before the pong to be handled")
+	}
+	if err := w.ping(conn); err != nil {
+		t.Errorf("expected the connection to be usable after a pong, got %s", err)
+	}
+
+	var connections int32
+	silent, done := startSilentServer(&connections)
+	defer silent.Close()
+	defer close(done)
+	w.pongTimeout = 50 * time.Millisecond
+	pool = NewWebSocketConnPool(1, ReconnectPolicy{InitialDelay: time.Minute}, 0, Failover, nil, nil, serverConfig(t, silent))
+	if err := w.ping(pool.GetTimeout(time.Second)); err == nil {
+		t.Error("expected a missing pong to be an error")
+	}
+}
+
+func TestKeepaliveEvictsDeadConnections(t *testing.T) {
+	var connections int32
+	server, done := startSilentServer(&connections)
+	defer server.Close()
+	defer close(done)
+
+	evicted := metrics.GetOrRegisterMeter("evictedConnections", StatsRegistry).Count()
+	_, err := NewWebsocketPublisher("ws://"+server.Listener.Addr().String()+"/", 1, 1, 1, 1, 1, 0,
+		"admin", "zenoss", "json", 1, 1, 1, false, WithKeepalive(20*time.Millisecond, 20*time.Millisecond))
+	if err != nil {
+		t.Fatalf("Could not create websocket publisher: %s", err)
+	}
+	for i := 0; i < 100 && atomic.LoadInt32(&connections) < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if atomic.LoadInt32(&connections) < 2 {
+		t.Error("expected the unresponsive connection to be replaced")
+	}
+	if metrics.GetOrRegisterMeter("evictedConnections", StatsRegistry).Count() <= evicted {
+		t.Error("expected the eviction to be counted")
+	}
+}
@@ -1,22 +1,135 @@
 package metricshipper
 
 import (
-        "os"
-        "sync"
-        "time"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/rcrowley/go-metrics"
 	"github.com/zenoss/glog"
 	"github.com/zenoss/websocket"
 )
 
-const websocket_error = "/opt/zenoss/var/websocket_error"
+// Longest an unreachable endpoint is skipped, in multiples of the retry delay,
+// unless the reconnect policy sets a maximum
+const maxEndpointBackoff = 32
 
-var mutex = &sync.Mutex{}
+// Jitter of reconnection delays. Seeded, so that shippers started together
+// don't pick the same delays.
+var (
+	jitterLock sync.Mutex
+	jitter     = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+// ReconnectPolicy spaces out attempts to connect to an endpoint that can't be
+// reached. The delay doubles with every consecutive failure up to MaxDelay,
+// and is shortened at random by up to Jitter of itself, so that a fleet of
+// shippers doesn't reconnect in lockstep after a consumer restarts.
+type ReconnectPolicy struct {
+	InitialDelay time.Duration
+	MaxDelay     time.Duration // 32 times InitialDelay if zero
+	Jitter       float64       // Fraction of the delay, from 0 to 1
+}
+
+// Delay returns how long to skip an endpoint after the given number of
+// consecutive failures
+func (p ReconnectPolicy) Delay(failures int) time.Duration {
+	max := p.MaxDelay
+	if max <= 0 {
+		max = maxEndpointBackoff * p.InitialDelay
+	}
+	delay := p.InitialDelay
+	for i := 1; i < failures && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	if p.Jitter > 0 {
+		jitterLock.Lock()
+		delay -= time.Duration(jitter.Float64() * p.Jitter * float64(delay))
+		jitterLock.Unlock()
+	}
+	return delay
+}
+
+// CircuitState tells callers whether the consumer is down, as opposed to
+// slow to take batches
+type CircuitState int
+
+const (
+	// CircuitClosed is the normal state, with at least one endpoint healthy
+	CircuitClosed CircuitState = iota
+	// CircuitHalfOpen is trying an endpoint again after every one failed
+	CircuitHalfOpen
+	// CircuitOpen is when every endpoint failed to connect
+	CircuitOpen
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitHalfOpen:
+		return "half-open"
+	case CircuitOpen:
+		return "open"
+	}
+	return "closed"
+}
+
+// Balancing decides which consumer endpoint new connections go to
+type Balancing int
+
+const (
+	// Failover connects to the first healthy endpoint in the list
+	Failover Balancing = iota
+	// RoundRobin spreads connections evenly over the healthy endpoints
+	RoundRobin
+	// LeastOutstanding connects to the healthy endpoint with the fewest
+	// batches in flight, then the fewest connections
+	LeastOutstanding
+)
+
+// ParseBalancing converts a balancing name from the configuration
+func ParseBalancing(name string) (Balancing, error) {
+	switch strings.ToLower(name) {
+	case "", "failover":
+		return Failover, nil
+	case "round-robin":
+		return RoundRobin, nil
+	case "least-outstanding":
+		return LeastOutstanding, nil
+	}
+	return Failover, fmt.Errorf("Unknown consumer balancing %q", name)
+}
+
+// DialHook adjusts the configuration of a connection before it is made. It
+// returns when the connection has to be replaced, such as when credentials
+// it added expire, or the zero time if it can be kept.
+type DialHook func(config *websocket.Config) (time.Time, error)
+
+// Endpoint is a consumer the pool connects to. An endpoint that can't be
+// reached is skipped for a while, longer with every failure, until a
+// connection to it succeeds again.
+type Endpoint struct {
+	config      *websocket.Config
+	failures    int       // Consecutive failed connection attempts
+	retryAt     time.Time // When to try connecting again after a failure
+	connections int       // Open connections
+	inflight    int       // Batches being sent
+	Healthy     metrics.Gauge
+}
 
 type WebSocketConn struct {
 	conn       *websocket.Conn // The underlying connection
+	endpoint   *Endpoint       // The consumer connected to
 	expires    time.Time       // The expiration time of this connection
+	renew      time.Time       // When the credentials of this connection expire
 	dictionary *dictionary     // Translation dictionary for binary encoding
+	version    int             // Binary encoding version picked by the consumer
+	idle       time.Time       // When the connection was last put in the pool
 	closed     bool
 }
 
@@ -28,37 +141,35 @@ func (conn *WebSocketConn) Close() {
 }
 
 type WebSocketConnPool struct {
-	delay  time.Duration
-	maxage time.Duration
-	config *websocket.Config
-	pool   chan *WebSocketConn
+	sync.Mutex // Guards the endpoints and circuit
+	reconnect  ReconnectPolicy
+	circuit    CircuitState
+	Circuit    metrics.Gauge // The circuit state: 0 closed, 1 half-open or 2 open
+	maxage     time.Duration
+	balancing  Balancing
+	endpoints  []*Endpoint
+	hooks      []DialHook
+	dialer     Dialer
+	next       int // Next endpoint for round robin
+	pool       chan *WebSocketConn
+	Evicted    metrics.Meter // Connections closed for being unhealthy
 }
 
 func (pool *WebSocketConnPool) newWebSocket() *WebSocketConn {
 	for {
-		if conn, err := websocket.DialConfig(pool.config); err != nil {
-			glog.Infof("Unable to connect to consumer %s", pool.config.Location)
-                       mutex.Lock()
-                       if _, err := os.Stat(websocket_error); os.IsNotExist(err) {
-                           f, err := os.Create(websocket_error)
-                           if err != nil {
-                               glog.Infof("%s", err)
-                           }
-                           f.Close()
-                       }
-                       mutex.Unlock()
-			time.Sleep(pool.delay)
+		endpoint := pool.pick()
+		if endpoint == nil {
+			// Every endpoint failed recently
+			time.Sleep(pool.untilRetry())
+			continue
+		}
+		if conn, renew, err := pool.dial(endpoint); err != nil {
+			glog.Infof("Unable to connect to consumer %s: %s", endpoint.config.Location, err)
+			pool.failed(endpoint)
 			continue
 		} else {
-			glog.Infof("Connected to consumer %s", pool.config.Location)
-                       mutex.Lock()
-                       if _, err := os.Stat(websocket_error); err == nil {
-                           err := os.Remove(websocket_error)
-                           if err != nil {
-                               glog.Infof("%s", err)
-                           }
-                       }
-                       mutex.Unlock()
+			glog.Infof("Connected to consumer %s", endpoint.config.Location)
+			pool.connected(endpoint)
 			var expires time.Time
 			// Don't expire connections if maxage is 0
 			if pool.maxage > 0 {
@@ -66,19 +177,184 @@ func (pool *WebSocketConnPool) newWebSocket() *WebSocketConn {
 			}
 			return &WebSocketConn{
 				conn:       conn,
+				endpoint:   endpoint,
 				expires:    expires,
+				renew:      renew,
 				dictionary: &dictionary{trans: make(map[string]int32)},
+				version:    negotiatedVersion(conn.Config()),
+				idle:       time.Now(),
 			}
 		}
 	}
 }
 
-func NewWebSocketConnPool(size int, delay time.Duration, maxage time.Duration, config *websocket.Config) *WebSocketConnPool {
+// dial connects to an endpoint, with the configuration adjusted by the
+// hooks. It returns when the earliest hook wants the connection replaced.
+func (pool *WebSocketConnPool) dial(endpoint *Endpoint) (*websocket.Conn, time.Time, error) {
+	var renew time.Time
+	config := *endpoint.config
+	config.Header = make(http.Header)
+	for key, values := range endpoint.config.Header {
+		config.Header[key] = append([]string(nil), values...)
+	}
+	for _, hook := range pool.hooks {
+		expires, err := hook(&config)
+		if err != nil {
+			return nil, renew, err
+		}
+		if !expires.IsZero() && (renew.IsZero() || expires.Before(renew)) {
+			renew = expires
+		}
+	}
+	conn, err := pool.dialer(&config)
+	return conn, renew, err
+}
+
+// pick chooses the endpoint for a new connection, or returns nil if every
+// endpoint is being skipped
+func (pool *WebSocketConnPool) pick() *Endpoint {
+	pool.Lock()
+	defer pool.Unlock()
+	now := time.Now()
+	candidates := make([]*Endpoint, 0, len(pool.endpoints))
+	for _, endpoint := range pool.endpoints {
+		if !now.Before(endpoint.retryAt) {
+			candidates = append(candidates, endpoint)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	if pool.circuit == CircuitOpen {
+		pool.trip(CircuitHalfOpen)
+	}
+	switch pool.balancing {
+	case RoundRobin:
+		pool.next++
+		return candidates[pool.next%len(candidates)]
+	case LeastOutstanding:
+		best := candidates[0]
+		for _, endpoint := range candidates[1:] {
+			if endpoint.inflight < best.inflight ||
+				endpoint.inflight == best.inflight && endpoint.connections < best.connections {
+				best = endpoint
+			}
+		}
+		return best
+	}
+	return candidates[0]
+}
+
+// failed records a failed connection attempt, opening the circuit if no
+// endpoint is healthy
+func (pool *WebSocketConnPool) failed(endpoint *Endpoint) {
+	pool.Lock()
+	defer pool.Unlock()
+	endpoint.failures++
+	endpoint.retryAt = time.Now().Add(pool.reconnect.Delay(endpoint.failures))
+	endpoint.Healthy.Update(0)
+	for _, e := range pool.endpoints {
+		if e.failures == 0 {
+			return
+		}
+	}
+	pool.trip(CircuitOpen)
+}
+
+// untilRetry returns how long until the first skipped endpoint may be tried
+// again
+func (pool *WebSocketConnPool) untilRetry() time.Duration {
+	pool.Lock()
+	defer pool.Unlock()
+	var first time.Time
+	for _, endpoint := range pool.endpoints {
+		if first.IsZero() || endpoint.retryAt.Before(first) {
+			first = endpoint.retryAt
+		}
+	}
+	return first.Sub(time.Now())
+}
+
+// trip changes the circuit state; the pool must be locked
+func (pool *WebSocketConnPool) trip(state CircuitState) {
+	if pool.circuit == state {
+		return
+	}
+	glog.Infof("Consumer circuit is %s, was %s", state, pool.circuit)
+	pool.circuit = state
+	pool.Circuit.Update(int64(state))
+}
+
+// State returns the circuit state of the pool
+func (pool *WebSocketConnPool) State() CircuitState {
+	pool.Lock()
+	defer pool.Unlock()
+	return pool.circuit
+}
+
+// EndpointStatus describes a consumer endpoint of the pool
+type EndpointStatus struct {
+	Location    string    `json:"location"`
+	Healthy     bool      `json:"healthy"`
+	Failures    int       `json:"failures"`    // Consecutive failed connection attempts
+	RetryAt     time.Time `json:"retryAt"`     // When an unhealthy endpoint is tried again
+	Connections int       `json:"connections"` // Open connections
+}
+
+// Endpoints returns the status of every endpoint of the pool
+func (pool *WebSocketConnPool) Endpoints() []EndpointStatus {
+	pool.Lock()
+	defer pool.Unlock()
+	statuses := make([]EndpointStatus, len(pool.endpoints))
+	for i, endpoint := range pool.endpoints {
+		statuses[i] = EndpointStatus{
+			Location:    endpoint.config.Location.String(),
+			Healthy:     endpoint.failures == 0,
+			Failures:    endpoint.failures,
+			RetryAt:     endpoint.retryAt,
+			Connections: endpoint.connections,
+		}
+	}
+	return statuses
+}
+
+func (pool *WebSocketConnPool) connected(endpoint *Endpoint) {
+	pool.Lock()
+	defer pool.Unlock()
+	if endpoint.failures > 0 {
+		glog.Infof("Consumer %s recovered", endpoint.config.Location)
+	}
+	endpoint.failures = 0
+	endpoint.retryAt = time.Time{}
+	endpoint.connections++
+	endpoint.Healthy.Update(1)
+	pool.trip(CircuitClosed)
+}
+
+// NewWebSocketConnPool keeps size connections open to the consumers in
+// configs, spread according to balancing, and reconnects to the consumers
+// that fail according to the reconnect policy. The hooks run before every
+// connection is made with dialer, or directly if dialer is nil.
+func NewWebSocketConnPool(size int, reconnect ReconnectPolicy, maxage time.Duration, balancing Balancing, hooks []DialHook, dialer Dialer, configs ...*websocket.Config) *WebSocketConnPool {
+	if dialer == nil {
+		dialer = websocket.DialConfig
+	}
 	pool := &WebSocketConnPool{
-		delay:  delay,
-		maxage: maxage,
-		config: config,
-		pool:   make(chan *WebSocketConn, size),
+		reconnect: reconnect,
+		Circuit:   metrics.GetOrRegisterGauge("consumerCircuit", StatsRegistry),
+		maxage:    maxage,
+		balancing: balancing,
+		hooks:     hooks,
+		dialer:    dialer,
+		next:      -1,
+		pool:      make(chan *WebSocketConn, size),
+		Evicted:   metrics.GetOrRegisterMeter("evictedConnections", StatsRegistry),
+	}
+	for i, config := range configs {
+		pool.endpoints = append(pool.endpoints, &Endpoint{
+			config:  config,
+			Healthy: metrics.GetOrRegisterGauge(fmt.Sprintf("consumerEndpoint%d.healthy", i), StatsRegistry),
+		})
 	}
 	go func() {
 		for i := 0; i < size; i++ {
@@ -93,23 +369,98 @@ func (pool *WebSocketConnPool) WaitForConnection() {
 }
 
 func (pool *WebSocketConnPool) Get() *WebSocketConn {
-	return <-pool.pool
+	return pool.checkout(<-pool.pool)
+}
+
+// GetTimeout is like Get but returns nil if no connection becomes available
+// within timeout
+func (pool *WebSocketConnPool) GetTimeout(timeout time.Duration) *WebSocketConn {
+	select {
+	case conn := <-pool.pool:
+		return pool.checkout(conn)
+	case <-time.After(timeout):
+		return nil
+	}
+}
+
+// TryGet is like Get but returns nil if no connection is available right away
+func (pool *WebSocketConnPool) TryGet() *WebSocketConn {
+	select {
+	case conn := <-pool.pool:
+		return pool.checkout(conn)
+	default:
+		return nil
+	}
+}
+
+func (pool *WebSocketConnPool) checkout(conn *WebSocketConn) *WebSocketConn {
+	pool.Lock()
+	defer pool.Unlock()
+	conn.endpoint.inflight++
+	return conn
 }
 
 func (pool *WebSocketConnPool) Put(conn *WebSocketConn) {
+	pool.Lock()
+	conn.endpoint.inflight--
+	pool.Unlock()
 	if conn.closed {
 		pool.Release(conn)
 	} else if !conn.expires.IsZero() && time.Now().After(conn.expires) {
-		glog.V(1).Infof("Connection is older than %d seconds; closing", pool.maxage.Seconds())
+		glog.V(1).Infof("Connection is older than %.0f seconds; closing", pool.maxage.Seconds())
+		pool.Release(conn)
+	} else if !conn.renew.IsZero() && time.Now().After(conn.renew) {
+		glog.V(1).Info("Connection credentials expired; reconnecting")
 		pool.Release(conn)
 	} else {
+		conn.idle = time.Now()
 		pool.pool <- conn
 	}
 }
 
+// Idle checks out the connections that have been waiting in the pool for at
+// least d, leaving the others to writers
+func (pool *WebSocketConnPool) Idle(d time.Duration) []*WebSocketConn {
+	var idle []*WebSocketConn
+	for i := len(pool.pool); i > 0; i-- {
+		select {
+		case conn := <-pool.pool:
+			if time.Since(conn.idle) >= d {
+				idle = append(idle, pool.checkout(conn))
+			} else {
+				pool.pool <- conn
+			}
+		default:
+			return idle
+		}
+	}
+	return idle
+}
+
+// Evict closes an unhealthy connection, which is replaced once it is put
+// back in the pool
+func (pool *WebSocketConnPool) Evict(conn *WebSocketConn, reason string) {
+	glog.Warningf("Evicting connection to consumer %s: %s", conn.endpoint.config.Location, reason)
+	pool.Evicted.Mark(1)
+	conn.Close()
+}
+
 func (pool *WebSocketConnPool) Release(conn *WebSocketConn) {
 	defer conn.conn.Close()
+	conn.dictionary.discard()
+	pool.Lock()
+	conn.endpoint.connections--
+	pool.Unlock()
 	go func() {
 		pool.pool <- pool.newWebSocket()
 	}()
 }
+
+// negotiatedVersion returns the binary encoding version the consumer picked
+// among the subprotocols offered to it
+func negotiatedVersion(config *websocket.Config) int {
+	if len(config.Protocol) == 1 && config.Protocol[0] == protocolBinaryV1 {
+		return binaryV1
+	}
+	return binaryV0
+}
@@ -0,0 +1,251 @@
+package metricshipper
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/zenoss/websocket"
+)
+
+// startSinkServer starts a consumer that reads and ignores everything
+func startSinkServer() *httptest.Server {
+	return httptest.NewServer(websocket.Handler(func(ws *websocket.Conn) {
+		io.Copy(ioutil.Discard, ws)
+	}))
+}
+
+func wsConfig(t *testing.T, location string) *websocket.Config {
+	config, err := websocket.NewConfig(location, origin)
+	if err != nil {
+		t.Fatalf("invalid location %s: %s", location, err)
+	}
+	return config
+}
+
+func serverConfig(t *testing.T, server *httptest.Server) *websocket.Config {
+	return wsConfig(t, "ws://"+server.Listener.Addr().String()+"/")
+}
+
+// checkoutAll takes every connection of the pool, counting them per endpoint
+func checkoutAll(pool *WebSocketConnPool, size int) (map[*Endpoint]int, []*WebSocketConn) {
+	counts := make(map[*Endpoint]int)
+	var conns []*WebSocketConn
+	for i := 0; i < size; i++ {
+		conn := pool.GetTimeout(time.Second)
+		if conn == nil {
+			break
+		}
+		counts[conn.endpoint]++
+		conns = append(conns, conn)
+	}
+	return counts, conns
+}
+
+func TestParseBalancing(t *testing.T) {
+	for name, expected := range map[string]Balancing{
+		"":                  Failover,
+		"failover":          Failover,
+		"Round-Robin":       RoundRobin,
+		"least-outstanding": LeastOutstanding,
+	} {
+		if balancing, err := ParseBalancing(name); err != nil || balancing != expected {
+			t.Errorf("%q: expected %d, got %d (%v)", name, expected, balancing, err)
+		}
+	}
+	if _, err := ParseBalancing("random"); err == nil {
+		t.Error("expected unknown balancing to be rejected")
+	}
+}
+
+func TestPoolFailover(t *testing.T) {
+	server := startSinkServer()
+	defer server.Close()
+
+	// Nothing listens on the primary
+	pool := NewWebSocketConnPool(2, ReconnectPolicy{InitialDelay: time.Minute}, 0, Failover, nil, nil,
+		wsConfig(t, "ws://127.0.0.1:1/"), serverConfig(t, server))
+	counts, conns := checkoutAll(pool, 2)
+	if len(conns) != 2 || counts[pool.endpoints[1]] != 2 {
+		t.Fatalf("expected both connections to fail over to the secondary, got %v", counts)
+	}
+	if pool.endpoints[0].Healthy.Value() != 0 || pool.endpoints[1].Healthy.Value() != 1 {
+		t.Error("expected the primary to be unhealthy and the secondary healthy")
+	}
+	if pool.endpoints[0].failures != 1 {
+		t.Errorf("expected the primary to be skipped after failing, tried %d times", pool.endpoints[0].failures)
+	}
+}
+
+func TestPoolRoundRobin(t *testing.T) {
+	first, second := startSinkServer(), startSinkServer()
+	defer first.Close()
+	defer second.Close()
+
+	pool := NewWebSocketConnPool(4, ReconnectPolicy{InitialDelay: time.Millisecond}, 0, RoundRobin, nil, nil,
+		serverConfig(t, first), serverConfig(t, second))
+	counts, conns := checkoutAll(pool, 4)
+	if len(conns) != 4 || counts[pool.endpoints[0]] != 2 || counts[pool.endpoints[1]] != 2 {
+		t.Errorf("expected connections to be spread evenly, got %v", counts)
+	}
+	if pool.endpoints[0].inflight != 2 {
+		t.Errorf("expected 2 batches in flight, got %d", pool.endpoints[0].inflight)
+	}
+	for _, conn := range conns {
+		pool.Put(conn)
+	}
+	if pool.endpoints[0].inflight != 0 || pool.endpoints[0].connections != 2 {
+		t.Error("expected connections to be returned to the pool")
+	}
+}
+
+func TestPoolLeastOutstanding(t *testing.T) {
+	pool := &WebSocketConnPool{balancing: LeastOutstanding}
+	busy := &Endpoint{inflight: 3, connections: 1}
+	idle := &Endpoint{inflight: 1, connections: 4}
+	lessConnected := &Endpoint{inflight: 1, connections: 2}
+	down := &Endpoint{retryAt: time.Now().Add(time.Minute)}
+	pool.endpoints = []*Endpoint{busy, down, idle, lessConnected}
+	if endpoint := pool.pick(); endpoint != lessConnected {
+		t.Errorf("expected the endpoint with the fewest batches and connections, got %+v", endpoint)
+	}
+
+	pool.endpoints = []*Endpoint{down}
+	if endpoint := pool.pick(); endpoint != nil {
+		t.Errorf("expected unhealthy endpoints to be skipped, got %+v", endpoint)
+	}
+}
+
+func TestBinaryVersionNegotiation(t *testing.T) {
+	for _, picked := range []string{protocolBinaryV1, protocolBinaryV0, ""} {
+		offered := make(chan []string, 1)
+		server := httptest.NewServer(websocket.Server{
+			Handshake: func(config *websocket.Config, r *http.Request) error {
+				offered <- config.Protocol
+				config.Protocol = nil
+				if picked != "" {
+					config.Protocol = []string{picked}
+				}
+				return nil
+			},
+			Handler: func(ws *websocket.Conn) { io.Copy(ioutil.Discard, ws) },
+		})
+
+		w := &WebsocketPublisher{}
+		WithBinaryVersion(1, true)(w)
+		pool := NewWebSocketConnPool(1, ReconnectPolicy{InitialDelay: time.Minute}, 0, Failover, w.dialHooks, nil, serverConfig(t, server))
+		conn := pool.GetTimeout(time.Second)
+		if conn == nil {
+			t.Fatal("expected a connection")
+		}
+		if protocols := <-offered; len(protocols) != 2 || protocols[0] != protocolBinaryV1 {
+			t.Errorf("expected version 1 and 0 to be offered, got %v", protocols)
+		}
+		expected := binaryV0
+		if picked == protocolBinaryV1 {
+			expected = binaryV1
+		}
+		if conn.version != expected {
+			t.Errorf("expected version %d when the consumer picks %q, got %d", expected, picked, conn.version)
+		}
+		conn.Close()
+		server.Close()
+	}
+}
+
+func TestPoolIdle(t *testing.T) {
+	server := startSinkServer()
+	defer server.Close()
+
+	pool := NewWebSocketConnPool(2, ReconnectPolicy{InitialDelay: time.Minute}, 0, Failover, nil, nil, serverConfig(t, server))
+	_, conns := checkoutAll(pool, 2)
+	if len(conns) != 2 {
+		t.Fatalf("expected 2 connections, got %d", len(conns))
+	}
+	pool.Put(conns[0])
+	time.Sleep(50 * time.Millisecond)
+	pool.Put(conns[1])
+	idle := pool.Idle(40 * time.Millisecond)
+	if len(idle) != 1 || idle[0] != conns[0] {
+		t.Fatalf("expected only the first connection to be idle, got %d", len(idle))
+	}
+	if conn := pool.GetTimeout(time.Second); conn != conns[1] {
+		t.Error("expected the busy connection to be left in the pool")
+	}
+
+	evicted := pool.Evicted.Count()
+	pool.Evict(idle[0], "testing")
+	pool.Put(idle[0])
+	if pool.Evicted.Count() != evicted+1 {
+		t.Error("expected the eviction to be counted")
+	}
+	if conn := pool.GetTimeout(time.Second); conn == nil || conn == idle[0] {
+		t.Error("expected the evicted connection to be replaced")
+	}
+}
+
+func TestReconnectPolicyDelay(t *testing.T) {
+	policy := ReconnectPolicy{InitialDelay: time.Second, MaxDelay: 10 * time.Second}
+	for failures, expected := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 4: 8 * time.Second, 5: 10 * time.Second} {
+		if delay := policy.Delay(failures); delay != expected {
+			t.Errorf("expected %s after %d failures, got %s", expected, failures, delay)
+		}
+	}
+	if delay := (ReconnectPolicy{InitialDelay: time.Second}).Delay(10); delay != 32*time.Second {
+		t.Errorf("expected the default maximum of 32 delays, got %s", delay)
+	}
+
+	policy.Jitter = 0.5
+	delays := make(map[time.Duration]bool)
+	for i := 0; i < 20; i++ {
+		delay := policy.Delay(5)
+		if delay < 5*time.Second || delay > 10*time.Second {
+			t.Fatalf("expected a delay between 5 and 10 seconds, got %s", delay)
+		}
+		delays[delay] = true
+	}
+	if len(delays) < 2 {
+		t.Error("expected delays to vary")
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	server := startSinkServer()
+	location := server.Listener.Addr().String()
+	config := serverConfig(t, server)
+	server.Close()
+
+	pool := NewWebSocketConnPool(1, ReconnectPolicy{InitialDelay: 50 * time.Millisecond}, 0, Failover, nil, nil, config)
+	for i := 0; i < 100 && pool.State() != CircuitOpen; i++ {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if pool.State() != CircuitOpen {
+		t.Fatalf("expected the circuit to open while the consumer is down, got %s", pool.State())
+	}
+	if status := pool.Endpoints()[0]; status.Healthy || status.Failures == 0 {
+		t.Errorf("expected the endpoint to be unhealthy, got %+v", status)
+	}
+
+	// The consumer comes back on the same address
+	listener, err := net.Listen("tcp", location)
+	if err != nil {
+		t.Skipf("unable to listen on %s again: %s", location, err)
+	}
+	restarted := httptest.NewUnstartedServer(websocket.Handler(func(ws *websocket.Conn) {
+		io.Copy(ioutil.Discard, ws)
+	}))
+	restarted.Listener.Close()
+	restarted.Listener = listener
+	restarted.Start()
+	defer restarted.Close()
+	if conn := pool.GetTimeout(5 * time.Second); conn == nil {
+		t.Fatal("expected to reconnect")
+	}
+	if pool.State() != CircuitClosed {
+		t.Errorf("expected the circuit to close once connected, got %s", pool.State())
+	}
+}
@@ -1,38 +1,199 @@
 package metricshipper
 
 import (
+	"fmt"
+	"hash/fnv"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
 	"github.com/zenoss/glog"
 )
 
+// How often stages that hold metrics back are asked to release them
+const processorFlushInterval = 1 * time.Second
+
+// MetricStage is a single step of the processing pipeline. A stage may
+// return the metric unchanged, modify it, split it into several metrics, or
+// drop it by returning none.
+type MetricStage interface {
+	Process(metric Metric) ([]Metric, error)
+}
+
+// FlushingStage is implemented by stages that hold metrics back and need to
+// release them on a timer rather than only when new metrics arrive.
+type FlushingStage interface {
+	MetricStage
+	Flush(now time.Time) []Metric
+}
+
 type MetricProcessor struct {
+	Incoming      *chan Metric
+	Outgoing      *chan Metric
+	Stages        []MetricStage
+	Latency       metrics.Timer // Optional; time spent processing each metric
+	MTraceEnabled bool
+}
+
+// ProcessorPool spreads processing across several MetricProcessors. Metrics
+// are sharded by series, so every series is always handled by the same
+// worker: per-series order is preserved and stateful stages see the whole
+// series.
+type ProcessorPool struct {
 	Incoming *chan Metric
-	Outgoing *chan Metric
+	workers  []*MetricProcessor
 }
 
-func (m *MetricProcessor) Start() {
+func NewProcessorPool(incoming *chan Metric, outgoing *chan Metric, size int,
+	buffer_size int, config *ShipperConfig) (*ProcessorPool, error) {
+	if size < 1 {
+		size = 1
+	}
+	pool := &ProcessorPool{
+		Incoming: incoming,
+		workers:  make([]*MetricProcessor, size),
+	}
+	for i := range pool.workers {
+		// Stages are stateful, so every worker gets its own
+		stages, err := NewProcessorStages(config)
+		if err != nil {
+			return nil, err
+		}
+		in := make(chan Metric, buffer_size)
+		pool.workers[i] = &MetricProcessor{
+			Incoming:      &in,
+			Outgoing:      outgoing,
+			Stages:        stages,
+			Latency:       metrics.GetOrRegisterTimer(fmt.Sprintf("processorLatency.worker%d", i), StatsRegistry),
+			MTraceEnabled: config.MtraceEnabled,
+		}
+	}
+	return pool, nil
+}
+
+// Start starts every worker and dispatches incoming metrics to them
+func (p *ProcessorPool) Start() {
+	for _, worker := range p.workers {
+		go worker.Start()
+	}
 	for {
-		metric := <-*m.Incoming
+		metric := <-*p.Incoming
+		*p.worker(&metric).Incoming <- metric
+	}
+}
+
+func (p *ProcessorPool) worker(metric *Metric) *MetricProcessor {
+	if len(p.workers) == 1 {
+		return p.workers[0]
+	}
+	h := fnv.New32a()
+	h.Write([]byte(metric.SeriesKey()))
+	return p.workers[h.Sum32()%uint32(len(p.workers))]
+}
 
-		processed, err := m.Process(&metric)
+// NewProcessorStages builds the pipeline of processing stages described by
+// the configuration, in the order they should be applied.
+func NewProcessorStages(config *ShipperConfig) ([]MetricStage, error) {
+	stages := make([]MetricStage, 0)
+	if config.DedupWindow > 0 {
+		window := time.Duration(config.DedupWindow) * time.Second
+		stages = append(stages, NewDedupStage(window, config.DedupMaxEntries))
+	}
+	if len(config.Scripts) > 0 {
+		scripts, err := NewScriptStage(config.Scripts)
+		if err != nil {
+			return nil, err
+		}
+		stages = append(stages, scripts)
+	}
+	if len(config.Rates) > 0 {
+		rates, err := NewRateStage(config.Rates)
+		if err != nil {
+			return nil, err
+		}
+		stages = append(stages, rates)
+	}
+	if len(config.Aggregates) > 0 {
+		aggregates, err := NewAggregateStage(config.Aggregates)
 		if err != nil {
-			glog.V(3).Infof("There was an error processing a metric")
-			processed.Error = true
-			continue
-		} else {
-			processed.Error = false
+			return nil, err
 		}
+		stages = append(stages, aggregates)
+	}
+	return stages, nil
+}
 
-		*m.Outgoing <- *processed
+func (m *MetricProcessor) Start() {
+	ticker := time.NewTicker(processorFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case metric := <-*m.Incoming:
+			start := time.Now()
+			processed, err := m.Process(&metric)
+			if m.Latency != nil {
+				m.Latency.UpdateSince(start)
+			}
+			if err != nil {
+				glog.V(3).Infof("There was an error processing a metric: %s", err)
+				continue
+			}
+			m.send(processed)
+		case now := <-ticker.C:
+			m.send(m.Flush(now))
+		}
 	}
 }
 
-func (m *MetricProcessor) Process(metric *Metric) (met *Metric, err error) {
-	glog.V(1).Infof("MetricProcessor.Process() mtrace flag mtraceEnabled = %t", mtraceEnabled)
-	// POLICY GOES HERE
-	if met == nil {
+func (m *MetricProcessor) send(processed []Metric) {
+	for _, p := range processed {
+		p.Error = false
+		*m.Outgoing <- p
+	}
+}
+
+func (m *MetricProcessor) Process(metric *Metric) ([]Metric, error) {
+	glog.V(1).Infof("MetricProcessor.Process() mtrace flag mtraceEnabled = %t", m.MTraceEnabled)
+	if metric == nil {
 		glog.V(2).Infof("MetricProcessor.Process(): nil metric passed in")
-	} else if mtraceEnabled && met.HasTracer() {
-		met.TracerMessage("Process()")
+		return nil, nil
+	} else if m.MTraceEnabled && metric.HasTracer() {
+		metric.TracerMessage("Process()")
+	}
+	return runStages([]Metric{*metric}, m.Stages)
+}
+
+// Flush collects the metrics held back by flushing stages and passes them
+// through the stages that follow.
+func (m *MetricProcessor) Flush(now time.Time) []Metric {
+	var flushed []Metric
+	for i, stage := range m.Stages {
+		if fs, ok := stage.(FlushingStage); ok {
+			released := fs.Flush(now)
+			if len(released) == 0 {
+				continue
+			}
+			processed, err := runStages(released, m.Stages[i+1:])
+			if err != nil {
+				glog.V(3).Infof("There was an error processing flushed metrics: %s", err)
+				continue
+			}
+			flushed = append(flushed, processed...)
+		}
+	}
+	return flushed
+}
+
+func runStages(metrics []Metric, stages []MetricStage) ([]Metric, error) {
+	for _, stage := range stages {
+		next := make([]Metric, 0, len(metrics))
+		for _, met := range metrics {
+			out, err := stage.Process(met)
+			if err != nil {
+				return nil, err
+			}
+			next = append(next, out...)
+		}
+		metrics = next
 	}
-	return metric, nil
+	return metrics, nil
 }
@@ -0,0 +1,82 @@
+package metricshipper
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestProcessorPoolPreservesSeriesOrder(t *testing.T) {
+	incoming := make(chan Metric, 10)
+	outgoing := make(chan Metric, 1000)
+	pool, err := NewProcessorPool(&incoming, &outgoing, 4, 10, &ShipperConfig{})
+	if err != nil {
+		t.Fatalf("unable to create processor pool: %s", err)
+	}
+	go pool.Start()
+
+	devices, points := 8, 50
+	go func() {
+		for i := 0; i < points; i++ {
+			for d := 0; d < devices; d++ {
+				m := counter("octets", float64(i), float64(i))
+				m.Tags = map[string]interface{}{"device": fmt.Sprintf("dev%d", d)}
+				incoming <- m
+			}
+		}
+	}()
+
+	last := make(map[string]float64)
+	for i := 0; i < devices*points; i++ {
+		select {
+		case m := <-outgoing:
+			key := m.SeriesKey()
+			if prev, ok := last[key]; ok && m.Timestamp <= prev {
+				t.Fatalf("series %s out of order: %f after %f", key, m.Timestamp, prev)
+			}
+			last[key] = m.Timestamp
+		case <-time.After(time.Second):
+			t.Fatalf("timed out after %d metrics", i)
+		}
+	}
+}
+
+func TestProcessorPoolShardsBySeries(t *testing.T) {
+	incoming := make(chan Metric)
+	outgoing := make(chan Metric)
+	pool, err := NewProcessorPool(&incoming, &outgoing, 3, 1, &ShipperConfig{})
+	if err != nil {
+		t.Fatalf("unable to create processor pool: %s", err)
+	}
+
+	m := counter("octets", 1, 1)
+	worker := pool.worker(&m)
+	for i := 0; i < 10; i++ {
+		m.Timestamp = float64(i)
+		m.Value = float64(i)
+		if pool.worker(&m) != worker {
+			t.Fatal("series was assigned to a different worker")
+		}
+	}
+	if pool.workers[0].Latency == nil || pool.workers[0].Latency == pool.workers[1].Latency {
+		t.Error("expected every worker to have its own latency timer")
+	}
+}
+
+func TestProcessorPoolStagesPerWorker(t *testing.T) {
+	incoming := make(chan Metric)
+	outgoing := make(chan Metric)
+	config := &ShipperConfig{Rates: []RateRule{{Pattern: "octets"}}}
+	pool, err := NewProcessorPool(&incoming, &outgoing, 2, 1, config)
+	if err != nil {
+		t.Fatalf("unable to create processor pool: %s", err)
+	}
+	if pool.workers[0].Stages[0] == pool.workers[1].Stages[0] {
+		t.Error("expected workers not to share stateful stages")
+	}
+
+	config.Rates[0].Pattern = "("
+	if _, err := NewProcessorPool(&incoming, &outgoing, 2, 1, config); err == nil {
+		t.Error("expected invalid stage configuration to be rejected")
+	}
+}
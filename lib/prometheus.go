@@ -0,0 +1,138 @@
+package metricshipper
+
+import (
+	"math"
+	"sort"
+	"strings"
+
+	"code.google.com/p/snappy-go/snappy"
+)
+
+// Encoding of Prometheus remote write requests
+const encodingPrometheus = "prometheus"
+
+// Message fields of the remote write protocol
+const (
+	writeRequestTimeseries = 1
+	timeSeriesLabels       = 1
+	timeSeriesSamples      = 2
+	labelName              = 1
+	labelValue             = 2
+	sampleValue            = 1
+	sampleTimestamp        = 2
+)
+
+type promLabel struct {
+	name, value string
+}
+
+type promSample struct {
+	value     float64
+	timestamp int64
+}
+
+type promSeries struct {
+	labels  []promLabel
+	samples []promSample
+}
+
+type byLabelName []promLabel
+
+func (l byLabelName) Len() int           { return len(l) }
+func (l byLabelName) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+func (l byLabelName) Less(i, j int) bool { return l[i].name < l[j].name }
+
+type byTimestamp []promSample
+
+func (s byTimestamp) Len() int           { return len(s) }
+func (s byTimestamp) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byTimestamp) Less(i, j int) bool { return s[i].timestamp < s[j].timestamp }
+
+// Prometheus metric names may also contain colons, label names may not
+func isPrometheusChar(r rune) bool {
+	return r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_'
+}
+
+func isPrometheusNameChar(r rune) bool {
+	return isPrometheusChar(r) || r == ':'
+}
+
+// prometheusName sanitizes a metric name or label name, which may not start
+// with a digit
+func prometheusName(s string, valid func(rune) bool) string {
+	s = sanitize(s, valid)
+	if s == "" || s[0] >= '0' && s[0] <= '9' {
+		s = "_" + s
+	}
+	return s
+}
+
+// promSeriesFor groups the metrics of a batch into series, each identified by
+// its sorted labels, with their samples in time order
+func promSeriesFor(batch *MetricBatch) []*promSeries {
+	var (
+		order  []string
+		series = make(map[string]*promSeries)
+	)
+	for i := range batch.Metrics {
+		m := &batch.Metrics[i]
+		keys, values := sortedTags(m)
+		labels := make([]promLabel, 0, len(keys)+1)
+		labels = append(labels, promLabel{"__name__", prometheusName(m.Metric, isPrometheusNameChar)})
+		seen := map[string]bool{"__name__": true}
+		for _, k := range keys {
+			name := prometheusName(k, isPrometheusChar)
+			// Names beginning with __ are reserved, and tags may collide
+			// once sanitized
+			if strings.HasPrefix(name, "__") || seen[name] {
+				continue
+			}
+			seen[name] = true
+			labels = append(labels, promLabel{name, values[k]})
+		}
+		sort.Sort(byLabelName(labels))
+
+		parts := make([]string, len(labels))
+		for j, l := range labels {
+			parts[j] = l.name + "\xff" + l.value
+		}
+		id := strings.Join(parts, "\xfe")
+		s, ok := series[id]
+		if !ok {
+			s = &promSeries{labels: labels}
+			series[id] = s
+			order = append(order, id)
+		}
+		s.samples = append(s.samples, promSample{
+			value:     m.Value,
+			timestamp: int64(math.Floor(m.Timestamp * 1000)),
+		})
+	}
+	result := make([]*promSeries, len(order))
+	for i, id := range order {
+		result[i] = series[id]
+		sort.Stable(byTimestamp(result[i].samples))
+	}
+	return result
+}
+
+// encodeRemoteWrite encodes a batch as a snappy compressed Prometheus remote
+// write request
+func encodeRemoteWrite(batch *MetricBatch) ([]byte, error) {
+	var request, series, message []byte
+	for _, s := range promSeriesFor(batch) {
+		series = series[:0]
+		for _, l := range s.labels {
+			message = appendProtoString(message[:0], labelName, l.name)
+			message = appendProtoString(message, labelValue, l.value)
+			series = appendProtoBytes(series, timeSeriesLabels, message)
+		}
+		for _, sample := range s.samples {
+			message = appendProtoDouble(message[:0], sampleValue, sample.value)
+			message = appendProtoInt64(message, sampleTimestamp, sample.timestamp)
+			series = appendProtoBytes(series, timeSeriesSamples, message)
+		}
+		request = appendProtoBytes(request, writeRequestTimeseries, series)
+	}
+	return snappy.Encode(nil, request)
+}
@@ -0,0 +1,160 @@
+package metricshipper
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"code.google.com/p/snappy-go/snappy"
+)
+
+// readProto splits a protobuf message into its fields, with varints and
+// doubles as uint64 and the rest as bytes
+func readProto(t *testing.T, data []byte) (fields []int, values []interface{}) {
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		data = data[n:]
+		switch key & 7 {
+		case protoVarint:
+			v, n := binary.Uvarint(data)
+			data = data[n:]
+			values = append(values, v)
+		case protoFixed64:
+			values = append(values, binary.LittleEndian.Uint64(data))
+			data = data[8:]
+		case protoBytes:
+			size, n := binary.Uvarint(data)
+			data = data[n:]
+			values = append(values, data[:size])
+			data = data[size:]
+		default:
+			t.Fatalf("unexpected wire type %d", key&7)
+		}
+		fields = append(fields, int(key>>3))
+	}
+	return
+}
+
+// decodeRemoteWrite decodes a remote write request into its series
+func decodeRemoteWrite(t *testing.T, data []byte) []promSeries {
+	data, err := snappy.Decode(nil, data)
+	if err != nil {
+		t.Fatalf("invalid snappy data: %s", err)
+	}
+	var result []promSeries
+	_, timeseries := readProto(t, data)
+	for _, ts := range timeseries {
+		var s promSeries
+		fields, values := readProto(t, ts.([]byte))
+		for i, field := range fields {
+			f, v := readProto(t, values[i].([]byte))
+			if field == timeSeriesLabels {
+				s.labels = append(s.labels, promLabel{string(v[0].([]byte)), string(v[1].([]byte))})
+				continue
+			}
+			var sample promSample
+			for j := range f {
+				if f[j] == sampleValue {
+					sample.value = math.Float64frombits(v[j].(uint64))
+				} else {
+					sample.timestamp = int64(v[j].(uint64))
+				}
+			}
+			s.samples = append(s.samples, sample)
+		}
+		result = append(result, s)
+	}
+	return result
+}
+
+func TestPrometheusNames(t *testing.T) {
+	cases := map[string]string{
+		"cpu.user":  "cpu_user",
+		"rate:5m":   "rate:5m",
+		"5min load": "_5min_load",
+		"":          "_",
+	}
+	for name, expected := range cases {
+		if actual := prometheusName(name, isPrometheusNameChar); actual != expected {
+			t.Errorf("expected %q to become %q, got %q", name, expected, actual)
+		}
+	}
+	if actual := prometheusName("rate:5m", isPrometheusChar); actual != "rate_5m" {
+		t.Errorf("expected label names to exclude colons, got %q", actual)
+	}
+}
+
+func TestEncodeRemoteWrite(t *testing.T) {
+	tags := map[string]interface{}{"device": "sw01", "if-name": "eth0", "__name__": "ignored"}
+	second := taggedMetric("if.octets", 2, tags)
+	second.Timestamp++
+	batch := &MetricBatch{Metrics: []Metric{
+		second,
+		taggedMetric("load", 0.25, nil),
+		taggedMetric("if.octets", 1, tags),
+	}}
+	data, err := encodeRemoteWrite(batch)
+	if err != nil {
+		t.Fatalf("unable to encode: %s", err)
+	}
+	expected := []promSeries{
+		{
+			labels: []promLabel{{"__name__", "if_octets"}, {"device", "sw01"}, {"if_name", "eth0"}},
+			samples: []promSample{
+				{value: 1, timestamp: 1500000000500},
+				{value: 2, timestamp: 1500000001500},
+			},
+		},
+		{
+			labels:  []promLabel{{"__name__", "load"}},
+			samples: []promSample{{value: 0.25, timestamp: 1500000000500}},
+		},
+	}
+	if actual := decodeRemoteWrite(t, data); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected %+v, got %+v", expected, actual)
+	}
+}
+
+func TestPrometheusSender(t *testing.T) {
+	status := http.StatusInternalServerError
+	requests := make(chan *http.Request, 2)
+	bodies := make(chan []byte, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		requests <- r
+		bodies <- body
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	sender := NewHTTPSender(server.URL, encodingPrometheus, 1, 0)
+	sender.Gzip = true
+	batch := &MetricBatch{Metrics: []Metric{taggedMetric("load", 1, nil)}}
+	if _, _, err := sender.SendBatch(batch, NewBackoff(1, 1, 1)); err == nil || isBatchError(err) {
+		t.Errorf("expected a server error to be retried, got %v", err)
+	}
+	<-requests
+	<-bodies
+
+	status = http.StatusNoContent
+	if _, _, err := sender.SendBatch(batch, NewBackoff(1, 1, 1)); err != nil {
+		t.Fatalf("unable to send: %s", err)
+	}
+	r := <-requests
+	for key, expected := range map[string]string{
+		"Content-Type":                      "application/x-protobuf",
+		"Content-Encoding":                  "snappy",
+		"X-Prometheus-Remote-Write-Version": "0.1.0",
+	} {
+		if actual := r.Header.Get(key); actual != expected {
+			t.Errorf("expected %s to be %q, got %q", key, expected, actual)
+		}
+	}
+	if series := decodeRemoteWrite(t, <-bodies); len(series) != 1 || len(series[0].samples) != 1 {
+		t.Errorf("expected a single sample, got %+v", series)
+	}
+}
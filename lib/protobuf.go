@@ -0,0 +1,394 @@
+package metricshipper
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// Minimal protocol buffers encoding, enough for the messages the shipper
+// sends without depending on generated code
+
+// Wire types
+const (
+	protoVarint  = 0
+	protoFixed64 = 1
+	protoBytes   = 2
+	protoFixed32 = 5
+)
+
+func appendVarint(buf []byte, v uint64) []byte {
+	for v >= 0x80 {
+		buf = append(buf, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(buf, byte(v))
+}
+
+func appendProtoKey(buf []byte, field, wireType int) []byte {
+	return appendVarint(buf, uint64(field<<3|wireType))
+}
+
+// appendProtoInt64 appends an int64 field, which is omitted if zero
+func appendProtoInt64(buf []byte, field int, v int64) []byte {
+	if v == 0 {
+		return buf
+	}
+	buf = appendProtoKey(buf, field, protoVarint)
+	return appendVarint(buf, uint64(v))
+}
+
+// appendProtoDouble appends a double field, which is omitted if zero
+func appendProtoDouble(buf []byte, field int, v float64) []byte {
+	bits := math.Float64bits(v)
+	if bits == 0 {
+		return buf
+	}
+	buf = appendProtoKey(buf, field, protoFixed64)
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], bits)
+	return append(buf, b[:]...)
+}
+
+// appendProtoBytes appends a bytes field or embedded message
+func appendProtoBytes(buf []byte, field int, v []byte) []byte {
+	buf = appendProtoKey(buf, field, protoBytes)
+	buf = appendVarint(buf, uint64(len(v)))
+	return append(buf, v...)
+}
+
+// appendProtoString appends a string field, which is omitted if empty
+func appendProtoString(buf []byte, field int, v string) []byte {
+	if v == "" {
+		return buf
+	}
+	buf = appendProtoKey(buf, field, protoBytes)
+	buf = appendVarint(buf, uint64(len(v)))
+	return append(buf, v...)
+}
+
+// appendProtoFixed64 appends a fixed64 field even if zero, as oneof fields
+// must be
+func appendProtoFixed64(buf []byte, field int, v uint64) []byte {
+	buf = appendProtoKey(buf, field, protoFixed64)
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], v)
+	return append(buf, b[:]...)
+}
+
+var errTruncatedProto = errors.New("truncated protobuf message")
+
+// protoReader reads the fields of a protobuf message in order
+type protoReader struct {
+	data []byte
+}
+
+// next returns the number and wire type of the next field, or 0 at the end
+// of the message
+func (r *protoReader) next() (field, wireType int, err error) {
+	if len(r.data) == 0 {
+		return 0, 0, nil
+	}
+	key, err := r.varint()
+	if err != nil {
+		return 0, 0, err
+	}
+	if key>>3 == 0 {
+		return 0, 0, errors.New("invalid protobuf field number 0")
+	}
+	return int(key >> 3), int(key & 7), nil
+}
+
+func (r *protoReader) varint() (uint64, error) {
+	v, n := binary.Uvarint(r.data)
+	if n <= 0 {
+		return 0, errTruncatedProto
+	}
+	r.data = r.data[n:]
+	return v, nil
+}
+
+func (r *protoReader) fixed64() (uint64, error) {
+	if len(r.data) < 8 {
+		return 0, errTruncatedProto
+	}
+	v := binary.LittleEndian.Uint64(r.data)
+	r.data = r.data[8:]
+	return v, nil
+}
+
+func (r *protoReader) bytes() ([]byte, error) {
+	size, err := r.varint()
+	if err != nil {
+		return nil, err
+	}
+	if size > uint64(len(r.data)) {
+		return nil, errTruncatedProto
+	}
+	v := r.data[:size]
+	r.data = r.data[size:]
+	return v, nil
+}
+
+// skip skips the value of a field that is not known
+func (r *protoReader) skip(wireType int) error {
+	var err error
+	switch wireType {
+	case protoVarint:
+		_, err = r.varint()
+	case protoFixed64:
+		_, err = r.fixed64()
+	case protoBytes:
+		_, err = r.bytes()
+	case protoFixed32:
+		if len(r.data) < 4 {
+			return errTruncatedProto
+		}
+		r.data = r.data[4:]
+	default:
+		return fmt.Errorf("unsupported protobuf wire type %d", wireType)
+	}
+	return err
+}
+
+// Encoding of batches as the MetricBatch message of metricbatch.proto, for
+// consumers that would rather use generated code than decode the binary
+// encoding
+const encodingProtobuf = "protobuf"
+
+// Field numbers of metricbatch.proto
+const (
+	batchMetrics = 1
+	batchControl = 2
+
+	metricTimestamp = 1
+	metricName      = 2
+	metricValue     = 3
+	metricTags      = 4
+	metricError     = 5
+
+	tagKey         = 1
+	tagStringValue = 2
+	tagIntValue    = 3
+	tagDoubleValue = 4
+	tagBoolValue   = 5
+
+	controlType  = 1
+	controlId    = 2
+	controlValue = 3
+)
+
+// MarshalProtobuf encodes the batch as a MetricBatch message
+func (batch *MetricBatch) MarshalProtobuf() ([]byte, error) {
+	var buf, metric, tag []byte
+	for i := range batch.Metrics {
+		m := &batch.Metrics[i]
+		metric = appendProtoDouble(metric[:0], metricTimestamp, m.Timestamp)
+		metric = appendProtoString(metric, metricName, m.Metric)
+		metric = appendProtoDouble(metric, metricValue, m.Value)
+		keys := make([]string, 0, len(m.Tags))
+		for key := range m.Tags {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			tag = appendProtoString(tag[:0], tagKey, key)
+			switch kind, value := tagValue(m.Tags[key]); kind {
+			case tagString:
+				tag = appendProtoBytes(tag, tagStringValue, []byte(value.(string)))
+			case tagInt:
+				tag = appendProtoKey(tag, tagIntValue, protoVarint)
+				tag = appendVarint(tag, uint64(value.(int64)))
+			case tagFloat:
+				tag = appendProtoFixed64(tag, tagDoubleValue, math.Float64bits(value.(float64)))
+			case tagBool:
+				tag = appendProtoKey(tag, tagBoolValue, protoVarint)
+				if value.(bool) {
+					tag = appendVarint(tag, 1)
+				} else {
+					tag = appendVarint(tag, 0)
+				}
+			}
+			metric = appendProtoBytes(metric, metricTags, tag)
+		}
+		if m.Error {
+			metric = appendProtoInt64(metric, metricError, 1)
+		}
+		buf = appendProtoBytes(buf, batchMetrics, metric)
+	}
+	if control, ok := batch.Control.(*Control); ok && control != nil {
+		var c []byte
+		c = appendProtoString(c, controlType, control.Type)
+		c = appendProtoString(c, controlId, control.Id)
+		c = appendProtoString(c, controlValue, control.Value)
+		buf = appendProtoBytes(buf, batchControl, c)
+	}
+	return buf, nil
+}
+
+// UnmarshalProtobuf decodes a MetricBatch message. Tags with integer values
+// are decoded as int64.
+func (batch *MetricBatch) UnmarshalProtobuf(data []byte) error {
+	batch.Metrics = batch.Metrics[:0]
+	batch.Control = nil
+	r := &protoReader{data: data}
+	for {
+		field, wireType, err := r.next()
+		if err != nil || field == 0 {
+			return err
+		}
+		switch {
+		case field == batchMetrics && wireType == protoBytes:
+			data, err := r.bytes()
+			if err != nil {
+				return err
+			}
+			m, err := unmarshalProtoMetric(data)
+			if err != nil {
+				return err
+			}
+			batch.Metrics = append(batch.Metrics, m)
+		case field == batchControl && wireType == protoBytes:
+			data, err := r.bytes()
+			if err != nil {
+				return err
+			}
+			control, err := unmarshalProtoControl(data)
+			if err != nil {
+				return err
+			}
+			batch.Control = control
+		default:
+			if err := r.skip(wireType); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func unmarshalProtoMetric(data []byte) (Metric, error) {
+	var m Metric
+	r := &protoReader{data: data}
+	for {
+		field, wireType, err := r.next()
+		if err != nil || field == 0 {
+			return m, err
+		}
+		switch {
+		case field == metricTimestamp && wireType == protoFixed64:
+			v, err := r.fixed64()
+			if err != nil {
+				return m, err
+			}
+			m.Timestamp = math.Float64frombits(v)
+		case field == metricName && wireType == protoBytes:
+			v, err := r.bytes()
+			if err != nil {
+				return m, err
+			}
+			m.Metric = string(v)
+		case field == metricValue && wireType == protoFixed64:
+			v, err := r.fixed64()
+			if err != nil {
+				return m, err
+			}
+			m.Value = math.Float64frombits(v)
+		case field == metricTags && wireType == protoBytes:
+			v, err := r.bytes()
+			if err != nil {
+				return m, err
+			}
+			key, value, err := unmarshalProtoTag(v)
+			if err != nil {
+				return m, err
+			}
+			if m.Tags == nil {
+				m.Tags = make(map[string]interface{})
+			}
+			m.Tags[key] = value
+		case field == metricError && wireType == protoVarint:
+			v, err := r.varint()
+			if err != nil {
+				return m, err
+			}
+			m.Error = v != 0
+		default:
+			if err := r.skip(wireType); err != nil {
+				return m, err
+			}
+		}
+	}
+}
+
+func unmarshalProtoTag(data []byte) (key string, value interface{}, err error) {
+	r := &protoReader{data: data}
+	for {
+		field, wireType, err := r.next()
+		if err != nil || field == 0 {
+			return key, value, err
+		}
+		switch {
+		case (field == tagKey || field == tagStringValue) && wireType == protoBytes:
+			v, err := r.bytes()
+			if err != nil {
+				return key, value, err
+			}
+			if field == tagKey {
+				key = string(v)
+			} else {
+				value = string(v)
+			}
+		case (field == tagIntValue || field == tagBoolValue) && wireType == protoVarint:
+			v, err := r.varint()
+			if err != nil {
+				return key, value, err
+			}
+			if field == tagIntValue {
+				value = int64(v)
+			} else {
+				value = v != 0
+			}
+		case field == tagDoubleValue && wireType == protoFixed64:
+			v, err := r.fixed64()
+			if err != nil {
+				return key, value, err
+			}
+			value = math.Float64frombits(v)
+		default:
+			if err := r.skip(wireType); err != nil {
+				return key, value, err
+			}
+		}
+	}
+}
+
+func unmarshalProtoControl(data []byte) (*Control, error) {
+	control := &Control{}
+	r := &protoReader{data: data}
+	for {
+		field, wireType, err := r.next()
+		if err != nil || field == 0 {
+			return control, err
+		}
+		if wireType != protoBytes || field > controlValue {
+			if err := r.skip(wireType); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		v, err := r.bytes()
+		if err != nil {
+			return nil, err
+		}
+		switch field {
+		case controlType:
+			control.Type = string(v)
+		case controlId:
+			control.Id = string(v)
+		case controlValue:
+			control.Value = string(v)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package metricshipper
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+// typedBatch has tag values of every type the encodings keep
+func typedBatch() *MetricBatch {
+	return &MetricBatch{
+		Control: &Control{Type: "BATCH", Id: "b1"},
+		Metrics: []Metric{
+			{Timestamp: 1500000000.5, Metric: "cpu", Value: 2.5, Tags: map[string]interface{}{
+				"device":  "sw01",
+				"cpu":     int64(-2),
+				"weight":  0.5,
+				"enabled": true,
+				"missing": nil,
+				"empty":   "",
+				"zero":    int64(0),
+			}},
+			{Timestamp: 1500000001, Metric: "load", Value: math.Inf(1), Error: true},
+		},
+	}
+}
+
+func TestProtobufRoundTrip(t *testing.T) {
+	batch := typedBatch()
+	data, err := batch.MarshalProtobuf()
+	if err != nil {
+		t.Fatalf("unable to marshal protobuf: %s", err)
+	}
+	decoded := &MetricBatch{}
+	if err := decoded.UnmarshalProtobuf(data); err != nil {
+		t.Fatalf("unable to unmarshal protobuf: %s", err)
+	}
+	if !reflect.DeepEqual(batch, decoded) {
+		t.Errorf("expected %+v, got %+v", batch, decoded)
+	}
+
+	// Fields added to the schema later are skipped
+	data = appendProtoString(data, 15, "unknown")
+	if err := decoded.UnmarshalProtobuf(data); err != nil || len(decoded.Metrics) != 2 {
+		t.Errorf("expected unknown fields to be skipped, got %v", err)
+	}
+	if err := decoded.UnmarshalProtobuf(data[:len(data)-3]); err == nil {
+		t.Error("expected a truncated message to be an error")
+	}
+}
+
+func TestProtobufFields(t *testing.T) {
+	data, _ := (&MetricBatch{Metrics: []Metric{{Timestamp: 1, Metric: "cpu", Value: 0}}}).MarshalProtobuf()
+	fields, values := readProto(t, data)
+	if !reflect.DeepEqual(fields, []int{batchMetrics}) {
+		t.Fatalf("expected a single metric, got fields %v", fields)
+	}
+	// A zero value is the default and is left out
+	fields, values = readProto(t, values[0].([]byte))
+	if !reflect.DeepEqual(fields, []int{metricTimestamp, metricName}) ||
+		values[0].(uint64) != math.Float64bits(1) || string(values[1].([]byte)) != "cpu" {
+		t.Errorf("unexpected metric fields %v: %v", fields, values)
+	}
+}
@@ -0,0 +1,168 @@
+package metricshipper
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/zenoss/websocket"
+)
+
+// Dialer opens the connection to a consumer
+type Dialer func(config *websocket.Config) (*websocket.Conn, error)
+
+// ProxyFunc returns the proxy to reach a consumer through, or nil to connect
+// directly
+type ProxyFunc func(location *url.URL) (*url.URL, error)
+
+// ProxyFromEnvironment uses the proxy from HTTPS_PROXY for wss:// consumers
+// and HTTP_PROXY for ws:// ones, except for hosts listed in NO_PROXY
+func ProxyFromEnvironment(location *url.URL) (*url.URL, error) {
+	target := *location
+	target.Scheme = strings.Replace(target.Scheme, "ws", "http", 1)
+	return http.ProxyFromEnvironment(&http.Request{URL: &target})
+}
+
+// FixedProxy reaches every consumer through proxy
+func FixedProxy(proxy *url.URL) ProxyFunc {
+	return func(*url.URL) (*url.URL, error) {
+		return proxy, nil
+	}
+}
+
+// HTTPProxy adapts proxyFor to HTTP requests, adding username and password
+// to the proxy URL if given
+func HTTPProxy(proxyFor ProxyFunc, username, password string) func(*http.Request) (*url.URL, error) {
+	return func(req *http.Request) (*url.URL, error) {
+		proxy, err := proxyFor(req.URL)
+		if proxy == nil || err != nil || username == "" {
+			return proxy, err
+		}
+		withCredentials := *proxy
+		withCredentials.User = url.UserPassword(username, password)
+		return &withCredentials, nil
+	}
+}
+
+// ProxyDialer connects to consumers through the proxy chosen by proxyFor,
+// tunneling the websocket handshake through CONNECT. Proxy credentials are
+// taken from username and password, or else from the proxy URL.
+func ProxyDialer(proxyFor ProxyFunc, username, password string) Dialer {
+	return func(config *websocket.Config) (*websocket.Conn, error) {
+		proxy, err := proxyFor(config.Location)
+		if err != nil {
+			return nil, err
+		}
+		if proxy == nil {
+			return websocket.DialConfig(config)
+		}
+		user, pass := username, password
+		if user == "" && proxy.User != nil {
+			user = proxy.User.Username()
+			pass, _ = proxy.User.Password()
+		}
+		conn, err := dialProxy(proxy, hostPort(config.Location), user, pass)
+		if err != nil {
+			return nil, &websocket.DialError{Config: config, Err: err}
+		}
+		if config.Location.Scheme == "wss" {
+			secure := tls.Client(conn, tunnelTLSConfig(config))
+			if err := secure.Handshake(); err != nil {
+				conn.Close()
+				return nil, &websocket.DialError{Config: config, Err: err}
+			}
+			conn = secure
+		}
+		ws, err := websocket.NewClient(config, conn)
+		if err != nil {
+			conn.Close()
+			return nil, &websocket.DialError{Config: config, Err: err}
+		}
+		return ws, nil
+	}
+}
+
+// tunnelTLSConfig returns the TLS configuration for a consumer reached
+// through a tunnel, which has to name the server itself
+func tunnelTLSConfig(config *websocket.Config) *tls.Config {
+	tlsConfig := &tls.Config{}
+	if config.TlsConfig != nil {
+		tlsConfig.RootCAs = config.TlsConfig.RootCAs
+		tlsConfig.Certificates = config.TlsConfig.Certificates
+		tlsConfig.ServerName = config.TlsConfig.ServerName
+		tlsConfig.MinVersion = config.TlsConfig.MinVersion
+	}
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName, _, _ = net.SplitHostPort(hostPort(config.Location))
+	}
+	return tlsConfig
+}
+
+// hostPort returns the host and port of a consumer, with the default port of
+// its scheme if there is none
+func hostPort(location *url.URL) string {
+	if _, _, err := net.SplitHostPort(location.Host); err == nil {
+		return location.Host
+	}
+	if location.Scheme == "wss" || location.Scheme == "https" {
+		return net.JoinHostPort(location.Host, "443")
+	}
+	return net.JoinHostPort(location.Host, "80")
+}
+
+// dialProxy opens a tunnel to target through an HTTP or HTTPS proxy
+func dialProxy(proxy *url.URL, target, username, password string) (net.Conn, error) {
+	conn, err := net.Dial("tcp", hostPort(proxy))
+	if err != nil {
+		return nil, err
+	}
+	if proxy.Scheme == "https" {
+		host, _, _ := net.SplitHostPort(hostPort(proxy))
+		secure := tls.Client(conn, &tls.Config{ServerName: host})
+		if err := secure.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = secure
+	}
+
+	req := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: target},
+		Host:   target,
+		Header: make(http.Header),
+	}
+	if username != "" {
+		credentials := base64.StdEncoding.EncodeToString([]byte(username + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	// The proxy sends nothing past the response until the tunnel is used,
+	// so the reader can't consume any of the handshake
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("Proxy %s refused tunnel to %s: %s", proxy.Host, target, resp.Status)
+	}
+	return conn, nil
+}
+
+// WithProxy connects to consumers through proxies, see ProxyDialer
+func WithProxy(proxyFor ProxyFunc, username, password string) PublisherOption {
+	return func(w *WebsocketPublisher) {
+		w.dialer = ProxyDialer(proxyFor, username, password)
+	}
+}
@@ -0,0 +1,142 @@
+package metricshipper
+
+import (
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sync/atomic"
+	"testing"
+)
+
+// testProxy is a stand-in CONNECT proxy requiring the given credentials
+type testProxy struct {
+	*httptest.Server
+	tunnels int32
+}
+
+func startTestProxy(username, password string) *testProxy {
+	proxy := &testProxy{}
+	proxy.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "CONNECT" {
+			http.Error(w, "CONNECT only", http.StatusMethodNotAllowed)
+			return
+		}
+		req := &http.Request{Header: http.Header{"Authorization": r.Header["Proxy-Authorization"]}}
+		if user, pass, _ := req.BasicAuth(); user != username || pass != password {
+			http.Error(w, "Proxy authentication required", http.StatusProxyAuthRequired)
+			return
+		}
+		target, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		client, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			target.Close()
+			return
+		}
+		atomic.AddInt32(&proxy.tunnels, 1)
+		client.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+		go func() {
+			io.Copy(target, client)
+			target.Close()
+		}()
+		io.Copy(client, target)
+		client.Close()
+	}))
+	return proxy
+}
+
+func (p *testProxy) url(t *testing.T, userinfo string) *url.URL {
+	proxy, err := url.Parse("http://" + userinfo + p.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("invalid proxy URL: %s", err)
+	}
+	return proxy
+}
+
+func TestProxyTunnel(t *testing.T) {
+	proxy := startTestProxy("shipper", "s3cret")
+	defer proxy.Close()
+	server := startSinkServer()
+	defer server.Close()
+
+	// Credentials from the URL
+	dial := ProxyDialer(FixedProxy(proxy.url(t, "shipper:s3cret@")), "", "")
+	conn, err := dial(serverConfig(t, server))
+	if err != nil {
+		t.Fatalf("unable to connect through the proxy: %s", err)
+	}
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Errorf("unable to write through the tunnel: %s", err)
+	}
+	conn.Close()
+
+	// Explicit credentials
+	dial = ProxyDialer(FixedProxy(proxy.url(t, "")), "shipper", "s3cret")
+	if conn, err := dial(serverConfig(t, server)); err != nil {
+		t.Errorf("unable to connect with explicit proxy credentials: %s", err)
+	} else {
+		conn.Close()
+	}
+	if tunnels := atomic.LoadInt32(&proxy.tunnels); tunnels != 2 {
+		t.Errorf("expected 2 tunnels through the proxy, got %d", tunnels)
+	}
+
+	dial = ProxyDialer(FixedProxy(proxy.url(t, "")), "shipper", "wrong")
+	if conn, err := dial(serverConfig(t, server)); err == nil {
+		conn.Close()
+		t.Error("expected the proxy to refuse wrong credentials")
+	}
+}
+
+func TestProxyTunnelTLS(t *testing.T) {
+	proxy := startTestProxy("", "")
+	defer proxy.Close()
+	dir, _ := ioutil.TempDir("", "tls")
+	defer os.RemoveAll(dir)
+	ca := newTestCert(t, "ca", nil)
+	caFile, _ := ca.write(t, dir, "ca")
+	certFile, keyFile := newTestCert(t, "shipper", ca).write(t, dir, "client")
+	server := startTLSServer(newTestCert(t, "consumer.example.com", ca), ca)
+	defer server.Close()
+
+	loader, err := NewTLSLoader(TLSOptions{CAFile: caFile, CertFile: certFile, KeyFile: keyFile,
+		ServerName: "consumer.example.com", MinVersion: tls.VersionTLS12})
+	if err != nil {
+		t.Fatalf("unable to load certificates: %s", err)
+	}
+	var w WebsocketPublisher
+	WithTLS(loader)(&w)
+	WithProxy(FixedProxy(proxy.url(t, "")), "", "")(&w)
+	pool := &WebSocketConnPool{hooks: w.dialHooks, dialer: w.dialer}
+	conn, _, err := pool.dial(&Endpoint{config: wsConfig(t, "wss://"+server.Listener.Addr().String()+"/")})
+	if err != nil {
+		t.Fatalf("unable to connect to a wss:// consumer through the proxy: %s", err)
+	}
+	conn.Close()
+	if atomic.LoadInt32(&proxy.tunnels) != 1 {
+		t.Error("expected the connection to go through the proxy")
+	}
+}
+
+func TestProxyFromEnvironment(t *testing.T) {
+	// Loopback consumers are never proxied
+	location, _ := url.Parse("wss://localhost:8443/ws/metrics/store")
+	if proxy, err := ProxyFromEnvironment(location); proxy != nil || err != nil {
+		t.Errorf("expected no proxy for a local consumer, got %v (%v)", proxy, err)
+	}
+	if hostPort(location) != "localhost:8443" {
+		t.Errorf("unexpected host %s", hostPort(location))
+	}
+	location, _ = url.Parse("wss://consumer.example.com/ws")
+	if hostPort(location) != "consumer.example.com:443" {
+		t.Errorf("expected the default wss port, got %s", hostPort(location))
+	}
+}
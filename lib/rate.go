@@ -0,0 +1,155 @@
+package metricshipper
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"time"
+
+	"github.com/zenoss/glog"
+)
+
+// Series that have not reported for this long are forgotten.
+const rateStaleAfter = 1 * time.Hour
+
+// RateRule selects counter metrics that should be converted into rates.
+type RateRule struct {
+	Pattern     string  // Regular expression matched against the metric name
+	CounterBits int     // Counter width (32 or 64) used to detect wraps from the upper half of the range; 0 treats every decrease as a reset
+	MaxRate     float64 // Rates above this are treated as counter resets; 0 disables the check
+	KeepRaw     bool    // Emit the raw counter value alongside the rate
+	Suffix      string  // Appended to the rate's metric name when KeepRaw is set
+}
+
+type rateRule struct {
+	RateRule
+	pattern *regexp.Regexp
+	max     float64 // Counter wrap value; 0 if wraps are not expected
+}
+
+type counterSample struct {
+	timestamp float64
+	value     float64
+	seen      time.Time
+}
+
+// RateStage converts monotonically increasing counters into per-second
+// rates. It keeps the previous value of every matched series, so it must only
+// be used from a single goroutine.
+type RateStage struct {
+	rules      []*rateRule
+	series     map[string]counterSample
+	staleAfter time.Duration
+	lastSweep  time.Time
+}
+
+func NewRateStage(rules []RateRule) (*RateStage, error) {
+	stage := &RateStage{
+		series:     make(map[string]counterSample),
+		staleAfter: rateStaleAfter,
+		lastSweep:  time.Now(),
+	}
+	for _, r := range rules {
+		pattern, err := regexp.Compile(r.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid rate pattern %q: %s", r.Pattern, err)
+		}
+		rule := &rateRule{RateRule: r, pattern: pattern}
+		switch r.CounterBits {
+		case 0:
+		case 32:
+			rule.max = math.Pow(2, 32)
+		case 64:
+			rule.max = math.Pow(2, 64)
+		default:
+			return nil, fmt.Errorf("Invalid counter bits for rate pattern %q: %d", r.Pattern, r.CounterBits)
+		}
+		if rule.KeepRaw && rule.Suffix == "" {
+			rule.Suffix = "_rate"
+		}
+		stage.rules = append(stage.rules, rule)
+	}
+	return stage, nil
+}
+
+func (s *RateStage) match(name string) *rateRule {
+	for _, rule := range s.rules {
+		if rule.pattern.MatchString(name) {
+			return rule
+		}
+	}
+	return nil
+}
+
+func (s *RateStage) Process(metric Metric) ([]Metric, error) {
+	rule := s.match(metric.Metric)
+	if rule == nil {
+		return []Metric{metric}, nil
+	}
+
+	now := time.Now()
+	s.sweep(now)
+
+	out := make([]Metric, 0, 2)
+	if rule.KeepRaw {
+		out = append(out, metric)
+	}
+
+	key := metric.SeriesKey()
+	prev, ok := s.series[key]
+	if ok && metric.Timestamp <= prev.timestamp {
+		// Duplicate or out of order sample; keep the newer state
+		glog.V(3).Infof("Ignoring out of order counter sample for %s", key)
+		return out, nil
+	}
+	s.series[key] = counterSample{timestamp: metric.Timestamp, value: metric.Value, seen: now}
+	if !ok {
+		return out, nil
+	}
+
+	rate, ok := rule.rate(prev, metric)
+	if !ok {
+		glog.V(2).Infof("Counter reset detected for %s", key)
+		return out, nil
+	}
+
+	derived := metric
+	derived.Value = rate
+	if rule.KeepRaw {
+		derived.Metric += rule.Suffix
+	}
+	return append(out, derived), nil
+}
+
+// rate computes the per-second rate between two samples of a counter. It
+// returns false if the counter appears to have been reset.
+func (r *rateRule) rate(prev counterSample, cur Metric) (float64, bool) {
+	delta := cur.Value - prev.value
+	if delta < 0 {
+		// Only a counter close to its maximum can have wrapped; anything
+		// else, such as a device rebooting, is a reset
+		if r.max == 0 || prev.value >= r.max || prev.value < r.max/2 {
+			return 0, false
+		}
+		delta += r.max
+	}
+	rate := delta / (cur.Timestamp - prev.timestamp)
+	if r.MaxRate > 0 && rate > r.MaxRate {
+		return 0, false
+	}
+	return rate, true
+}
+
+// sweep forgets series that have not been seen recently so that memory use
+// stays bounded as devices and components come and go.
+func (s *RateStage) sweep(now time.Time) {
+	if now.Sub(s.lastSweep) < s.staleAfter {
+		return
+	}
+	s.lastSweep = now
+	for key, sample := range s.series {
+		if now.Sub(sample.seen) > s.staleAfter {
+			delete(s.series, key)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package metricshipper
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+func counter(name string, timestamp, value float64) Metric {
+	return Metric{
+		Timestamp: timestamp,
+		Metric:    name,
+		Value:     value,
+		Tags:      map[string]interface{}{"device": "dev1"},
+	}
+}
+
+func processAll(t *testing.T, stage MetricStage, metrics ...Metric) []Metric {
+	out := make([]Metric, 0)
+	for _, m := range metrics {
+		processed, err := stage.Process(m)
+		if err != nil {
+			t.Fatalf("unexpected error processing %+v: %s", m, err)
+		}
+		out = append(out, processed...)
+	}
+	return out
+}
+
+func TestRateStage(t *testing.T) {
+	stage, err := NewRateStage([]RateRule{{Pattern: "^ifHCInOctets"}})
+	if err != nil {
+		t.Fatalf("unable to create rate stage: %s", err)
+	}
+
+	out := processAll(t, stage,
+		counter("ifHCInOctets-1", 100, 1000),
+		counter("ifHCInOctets-1", 110, 1500),
+		counter("ifHCInOctets-1", 120, 1600),
+		counter("sysUpTime", 120, 42),
+	)
+	if len(out) != 3 {
+		t.Fatalf("expected 3 metrics, got %d: %+v", len(out), out)
+	}
+	if out[0].Metric != "ifHCInOctets-1" || out[0].Value != 50 || out[0].Timestamp != 110 {
+		t.Errorf("unexpected first rate %+v", out[0])
+	}
+	if out[1].Value != 10 {
+		t.Errorf("expected rate of 10, got %v", out[1].Value)
+	}
+	if out[2].Metric != "sysUpTime" || out[2].Value != 42 {
+		t.Errorf("unmatched metric was modified: %+v", out[2])
+	}
+}
+
+func TestRateStageSeparatesSeries(t *testing.T) {
+	stage, _ := NewRateStage([]RateRule{{Pattern: "octets"}})
+	other := counter("octets", 110, 5000)
+	other.Tags = map[string]interface{}{"device": "dev2"}
+
+	out := processAll(t, stage,
+		counter("octets", 100, 1000),
+		other,
+		counter("octets", 110, 2000),
+	)
+	if len(out) != 1 || out[0].Value != 100 {
+		t.Errorf("expected a single rate of 100, got %+v", out)
+	}
+}
+
+func TestRateStageCounterWrap(t *testing.T) {
+	stage, _ := NewRateStage([]RateRule{{Pattern: "octets", CounterBits: 32}})
+	max := math.Pow(2, 32)
+
+	out := processAll(t, stage,
+		counter("octets", 100, max-100),
+		counter("octets", 110, 900),
+	)
+	if len(out) != 1 || out[0].Value != 100 {
+		t.Errorf("expected wrapped rate of 100, got %+v", out)
+	}
+}
+
+func TestRateStageReset(t *testing.T) {
+	stage, _ := NewRateStage([]RateRule{{Pattern: "octets"}})
+	out := processAll(t, stage,
+		counter("octets", 100, 5000),
+		counter("octets", 110, 100),
+		counter("octets", 120, 200),
+	)
+	if len(out) != 1 || out[0].Value != 10 {
+		t.Errorf("expected reset to be skipped and a rate of 10, got %+v", out)
+	}
+
+	// A wrap that yields an implausible rate is a reset as well
+	stage, _ = NewRateStage([]RateRule{{Pattern: "octets", CounterBits: 64, MaxRate: 1e9}})
+	out = processAll(t, stage,
+		counter("octets", 100, 5000),
+		counter("octets", 110, 100),
+	)
+	if len(out) != 0 {
+		t.Errorf("expected reset to be detected, got %+v", out)
+	}
+
+	// A 64-bit counter dropping to 0 without maxrate, as after a reboot
+	stage, _ = NewRateStage([]RateRule{{Pattern: "octets", CounterBits: 64}})
+	out = processAll(t, stage,
+		counter("octets", 100, 5000),
+		counter("octets", 110, 0),
+		counter("octets", 120, 100),
+	)
+	if len(out) != 1 || out[0].Value != 10 {
+		t.Errorf("expected reset to be skipped and a rate of 10, got %+v", out)
+	}
+}
+
+func TestRateStageKeepRaw(t *testing.T) {
+	stage, _ := NewRateStage([]RateRule{{Pattern: "octets", KeepRaw: true}})
+	out := processAll(t, stage,
+		counter("octets", 100, 1000),
+		counter("octets", 110, 2000),
+	)
+	if len(out) != 3 {
+		t.Fatalf("expected 3 metrics, got %+v", out)
+	}
+	if out[0].Value != 1000 || out[1].Value != 2000 {
+		t.Errorf("raw values were not kept: %+v", out)
+	}
+	if out[2].Metric != "octets_rate" || out[2].Value != 100 {
+		t.Errorf("unexpected rate metric %+v", out[2])
+	}
+}
+
+func TestRateStageOutOfOrder(t *testing.T) {
+	stage, _ := NewRateStage([]RateRule{{Pattern: "octets"}})
+	out := processAll(t, stage,
+		counter("octets", 100, 1000),
+		counter("octets", 110, 2000),
+		counter("octets", 105, 1500),
+		counter("octets", 120, 2500),
+	)
+	if len(out) != 2 || out[1].Value != 50 {
+		t.Errorf("expected out of order sample to be ignored, got %+v", out)
+	}
+}
+
+func TestRateStageInvalidRule(t *testing.T) {
+	if _, err := NewRateStage([]RateRule{{Pattern: "("}}); err == nil {
+		t.Error("expected an invalid pattern to be rejected")
+	}
+	_, err := NewRateStage([]RateRule{{Pattern: "x", CounterBits: 16}})
+	if err == nil || !strings.Contains(err.Error(), "counter bits") {
+		t.Errorf("expected invalid counter bits to be rejected, got %v", err)
+	}
+}
+
+func TestProcessorStages(t *testing.T) {
+	stage, _ := NewRateStage([]RateRule{{Pattern: "octets", KeepRaw: true}})
+	p := &MetricProcessor{Stages: []MetricStage{stage}}
+
+	m := counter("octets", 100, 1000)
+	out, err := p.Process(&m)
+	if err != nil || len(out) != 1 {
+		t.Fatalf("expected raw metric only, got %+v %v", out, err)
+	}
+	m = counter("octets", 101, 1001)
+	out, err = p.Process(&m)
+	if err != nil || len(out) != 2 {
+		t.Fatalf("expected raw and rate metrics, got %+v %v", out, err)
+	}
+}
@@ -0,0 +1,108 @@
+package metricshipper
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// RetryPolicy bounds how often a batch the consumer can't accept is sent
+// again, and how long to wait between attempts.
+type RetryPolicy struct {
+	MaxAttempts  int
+	InitialDelay time.Duration
+	MaxDelay     time.Duration
+}
+
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:  3,
+	InitialDelay: 100 * time.Millisecond,
+	MaxDelay:     10 * time.Second,
+}
+
+// Delay returns how long to wait after the given failed attempt, doubling
+// with every attempt up to the maximum delay
+func (p RetryPolicy) Delay(attempt int) time.Duration {
+	delay := p.InitialDelay
+	for i := 1; i < attempt && delay < p.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	return delay
+}
+
+// BatchError is returned when a batch can't be sent because of its contents,
+// such as a metric that fails to encode
+type BatchError struct {
+	Err error
+}
+
+func (e BatchError) Error() string {
+	return e.Err.Error()
+}
+
+// isBatchError returns whether err was caused by the contents of a batch
+// rather than by the connection to the consumer
+func isBatchError(err error) bool {
+	switch err.(type) {
+	case BatchError, BatchRejectedError:
+		return true
+	}
+	return false
+}
+
+// DeadLetterFile records metrics that were given up on, one JSON object per
+// line along with the error that caused it.
+type DeadLetterFile struct {
+	sync.Mutex
+	file *os.File
+}
+
+type deadLetter struct {
+	Time    int64       `json:"time"`
+	Error   string      `json:"error"`
+	Metrics interface{} `json:"metrics"`
+}
+
+// NewDeadLetterFile opens path for appending, creating it if needed
+func NewDeadLetterFile(path string) (*DeadLetterFile, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &DeadLetterFile{file: file}, nil
+}
+
+// Write appends the metrics of a batch with the error it failed with
+func (d *DeadLetterFile) Write(batch *MetricBatch, cause error) error {
+	record := deadLetter{
+		Time:    time.Now().Unix(),
+		Error:   cause.Error(),
+		Metrics: batch.Metrics,
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		// Metrics that can't be encoded, such as NaN values, are kept as text
+		text := make([]string, len(batch.Metrics))
+		for i, m := range batch.Metrics {
+			text[i] = fmt.Sprintf("%+v", m)
+		}
+		record.Metrics = text
+		if data, err = json.Marshal(record); err != nil {
+			return err
+		}
+	}
+	d.Lock()
+	defer d.Unlock()
+	_, err = d.file.Write(append(data, '\n'))
+	return err
+}
+
+// Close closes the underlying file
+func (d *DeadLetterFile) Close() error {
+	return d.file.Close()
+}
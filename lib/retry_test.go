@@ -0,0 +1,70 @@
+package metricshipper
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"math"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestRetryPolicyDelay(t *testing.T) {
+	policy := RetryPolicy{InitialDelay: 100 * time.Millisecond, MaxDelay: time.Second}
+	expected := []time.Duration{100, 200, 400, 800, 1000, 1000}
+	for i, delay := range expected {
+		if actual := policy.Delay(i + 1); actual != delay*time.Millisecond {
+			t.Errorf("attempt %d: expected %s, got %s", i+1, delay*time.Millisecond, actual)
+		}
+	}
+}
+
+func TestBatchErrors(t *testing.T) {
+	if !isBatchError(BatchError{Err: errors.New("bad")}) || !isBatchError(BatchRejectedError{}) {
+		t.Error("expected batch errors to be recognized")
+	}
+	if isBatchError(errNoConnection) {
+		t.Error("expected connection errors not to be batch errors")
+	}
+}
+
+func TestDeadLetterFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "deadletter")
+	if err != nil {
+		t.Fatalf("unable to create dead letter file: %s", err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+
+	deadLetters, err := NewDeadLetterFile(f.Name())
+	if err != nil {
+		t.Fatalf("unable to open dead letter file: %s", err)
+	}
+	unencodable := counter("cpu", 1, math.NaN())
+	deadLetters.Write(spoolBatch("memory"), errors.New("rejected"))
+	deadLetters.Write(&MetricBatch{Metrics: []Metric{unencodable}}, errors.New("unencodable"))
+	deadLetters.Close()
+
+	file, _ := os.Open(f.Name())
+	defer file.Close()
+	var records []map[string]interface{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var record map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatalf("invalid dead letter %q: %s", scanner.Text(), err)
+		}
+		records = append(records, record)
+	}
+	if len(records) != 2 {
+		t.Fatalf("expected 2 dead letters, got %d", len(records))
+	}
+	if records[0]["error"] != "rejected" || len(records[0]["metrics"].([]interface{})) != 1 {
+		t.Errorf("unexpected dead letter %v", records[0])
+	}
+	if text, ok := records[1]["metrics"].([]interface{})[0].(string); !ok || text == "" {
+		t.Errorf("expected unencodable metric to be recorded as text, got %v", records[1])
+	}
+}
@@ -0,0 +1,1151 @@
+package metricshipper
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/zenoss/glog"
+)
+
+// Transform scripts are a small, sandboxed language for one-off metric
+// transforms. A script runs once per metric and can read and assign metric,
+// value, timestamp and tags, use local variables, emit additional metrics and
+// drop the metric:
+//
+//	# Convert octets to bits and derive the site from the device name
+//	if metric =~ "Octets" {
+//		value = value * 8
+//		tags["unit"] = "bits"
+//	}
+//	tags.site = split(tags.device, "-", 0)
+//	if value < 0 { drop }
+//	emit metric + "_kb", value / 1024
+//
+// Scripts have no loops and no access to anything but the metric, and each
+// run is limited in both steps and wall-clock time.
+
+const (
+	defaultScriptTimeout = 10 * time.Millisecond
+	maxScriptSteps       = 100000
+)
+
+var errScriptTimeout = errors.New("script exceeded its time limit")
+
+// ScriptRule runs a transform script on metrics whose name matches Pattern.
+type ScriptRule struct {
+	Pattern string // Regular expression matched against the metric name; empty matches every metric
+	Script  string // Script source
+	File    string // Path to the script source, used when Script is empty
+	Timeout int    // Maximum run time per metric in milliseconds
+}
+
+type scriptRule struct {
+	pattern *regexp.Regexp
+	script  *Script
+	timeout time.Duration
+}
+
+// ScriptStage applies transform scripts to metrics. A script that fails or
+// runs out of time leaves the metric untouched and is counted in the
+// scriptErrors and scriptTimeouts meters.
+type ScriptStage struct {
+	rules    []*scriptRule
+	Errors   metrics.Meter
+	Timeouts metrics.Meter
+}
+
+func NewScriptStage(rules []ScriptRule) (*ScriptStage, error) {
+	stage := &ScriptStage{
+		Errors:   metrics.GetOrRegisterMeter("scriptErrors", StatsRegistry),
+		Timeouts: metrics.GetOrRegisterMeter("scriptTimeouts", StatsRegistry),
+	}
+	for _, r := range rules {
+		rule := &scriptRule{timeout: defaultScriptTimeout}
+		if r.Pattern != "" {
+			pattern, err := regexp.Compile(r.Pattern)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid script pattern %q: %s", r.Pattern, err)
+			}
+			rule.pattern = pattern
+		}
+		source := r.Script
+		if source == "" && r.File != "" {
+			contents, err := ioutil.ReadFile(r.File)
+			if err != nil {
+				return nil, fmt.Errorf("Unable to read script %s: %s", r.File, err)
+			}
+			source = string(contents)
+		}
+		script, err := CompileScript(source)
+		if err != nil {
+			return nil, err
+		}
+		rule.script = script
+		if r.Timeout > 0 {
+			rule.timeout = time.Duration(r.Timeout) * time.Millisecond
+		}
+		stage.rules = append(stage.rules, rule)
+	}
+	return stage, nil
+}
+
+func (s *ScriptStage) Process(metric Metric) ([]Metric, error) {
+	out := []Metric{metric}
+	for _, rule := range s.rules {
+		next := make([]Metric, 0, len(out))
+		for _, m := range out {
+			if rule.pattern != nil && !rule.pattern.MatchString(m.Metric) {
+				next = append(next, m)
+				continue
+			}
+			result, err := rule.script.Run(m, rule.timeout)
+			if err != nil {
+				if err == errScriptTimeout {
+					s.Timeouts.Mark(1)
+				} else {
+					s.Errors.Mark(1)
+				}
+				glog.V(2).Infof("Script failed for metric %s: %s", m.Metric, err)
+				next = append(next, m)
+				continue
+			}
+			next = append(next, result...)
+		}
+		out = next
+	}
+	return out, nil
+}
+
+// Patterns computed while running a script are cached up to this many; the
+// cache starts over beyond that, as patterns taken from tags may vary without
+// limit
+const scriptRegexpCacheSize = 256
+
+// Script is a compiled transform script.
+type Script struct {
+	body    []scriptStmt
+	regexps map[string]*regexp.Regexp
+}
+
+// CompileScript parses a transform script.
+func CompileScript(source string) (*Script, error) {
+	tokens, err := lexScript(source)
+	if err != nil {
+		return nil, err
+	}
+	p := &scriptParser{tokens: tokens}
+	body, err := p.parseStatements(tokEOF)
+	if err != nil {
+		return nil, err
+	}
+	return &Script{body: body, regexps: make(map[string]*regexp.Regexp)}, nil
+}
+
+// Run executes the script against a copy of the metric and returns the
+// resulting metrics: the transformed metric unless it was dropped, followed
+// by any emitted metrics.
+func (s *Script) Run(metric Metric, timeout time.Duration) ([]Metric, error) {
+	tags := make(map[string]interface{}, len(metric.Tags))
+	for k, v := range metric.Tags {
+		tags[k] = v
+	}
+	metric.Tags = tags
+	env := &scriptEnv{
+		script:   s,
+		metric:   &metric,
+		vars:     make(map[string]interface{}),
+		deadline: time.Now().Add(timeout),
+	}
+	if err := execStatements(env, s.body); err != nil {
+		return nil, err
+	}
+	if env.dropped {
+		return env.emitted, nil
+	}
+	return append([]Metric{metric}, env.emitted...), nil
+}
+
+func (s *Script) regexp(pattern string) (*regexp.Regexp, error) {
+	if re, ok := s.regexps[pattern]; ok {
+		return re, nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	if len(s.regexps) >= scriptRegexpCacheSize {
+		s.regexps = make(map[string]*regexp.Regexp)
+	}
+	s.regexps[pattern] = re
+	return re, nil
+}
+
+type scriptEnv struct {
+	script   *Script
+	metric   *Metric
+	vars     map[string]interface{}
+	emitted  []Metric
+	dropped  bool
+	steps    int
+	deadline time.Time
+}
+
+// step accounts for a unit of work and enforces the execution limits.
+func (env *scriptEnv) step() error {
+	env.steps++
+	if env.steps > maxScriptSteps {
+		return errScriptTimeout
+	}
+	if env.steps%64 == 0 && time.Now().After(env.deadline) {
+		return errScriptTimeout
+	}
+	return nil
+}
+
+// Lexer
+
+type scriptTokenType int
+
+const (
+	tokEOF scriptTokenType = iota
+	tokSep
+	tokIdent
+	tokNumber
+	tokString
+	tokOp
+)
+
+type scriptToken struct {
+	typ  scriptTokenType
+	text string
+	num  float64
+	line int
+}
+
+var scriptOperators = []string{
+	"==", "!=", "<=", ">=", "=~", "!~", "&&", "||",
+	"<", ">", "=", "!", "+", "-", "*", "/", "%",
+	"(", ")", "{", "}", "[", "]", ",", ".",
+}
+
+func lexScript(source string) ([]scriptToken, error) {
+	var tokens []scriptToken
+	line := 1
+	for i := 0; i < len(source); {
+		c := source[i]
+		switch {
+		case c == '\n' || c == ';':
+			tokens = append(tokens, scriptToken{typ: tokSep, text: string(c), line: line})
+			if c == '\n' {
+				line++
+			}
+			i++
+		case c == ' ' || c == '\t' || c == '\r':
+			i++
+		case c == '#':
+			for i < len(source) && source[i] != '\n' {
+				i++
+			}
+		case c == '"':
+			j := i + 1
+			for j < len(source) && source[j] != '"' {
+				if source[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j >= len(source) {
+				return nil, fmt.Errorf("script line %d: unterminated string", line)
+			}
+			s, err := strconv.Unquote(source[i : j+1])
+			if err != nil {
+				return nil, fmt.Errorf("script line %d: invalid string %s", line, source[i:j+1])
+			}
+			tokens = append(tokens, scriptToken{typ: tokString, text: s, line: line})
+			i = j + 1
+		case c >= '0' && c <= '9':
+			j := i
+			for j < len(source) && (source[j] >= '0' && source[j] <= '9' || source[j] == '.' ||
+				source[j] == 'e' || source[j] == 'E' ||
+				(source[j] == '-' || source[j] == '+') && (source[j-1] == 'e' || source[j-1] == 'E')) {
+				j++
+			}
+			n, err := strconv.ParseFloat(source[i:j], 64)
+			if err != nil {
+				return nil, fmt.Errorf("script line %d: invalid number %s", line, source[i:j])
+			}
+			tokens = append(tokens, scriptToken{typ: tokNumber, text: source[i:j], num: n, line: line})
+			i = j
+		case scriptIdentLength(source[i:]) > 0:
+			j := i + scriptIdentLength(source[i:])
+			tokens = append(tokens, scriptToken{typ: tokIdent, text: source[i:j], line: line})
+			i = j
+		default:
+			op := ""
+			for _, o := range scriptOperators {
+				if strings.HasPrefix(source[i:], o) {
+					op = o
+					break
+				}
+			}
+			if op == "" {
+				r, _ := utf8.DecodeRuneInString(source[i:])
+				return nil, fmt.Errorf("script line %d: unexpected character %q", line, r)
+			}
+			tokens = append(tokens, scriptToken{typ: tokOp, text: op, line: line})
+			i += len(op)
+		}
+	}
+	return append(tokens, scriptToken{typ: tokEOF, line: line}), nil
+}
+
+// scriptIdentLength returns the length in bytes of the identifier source
+// starts with, or 0. Identifiers are made of Unicode letters, digits and
+// underscores, and don't start with a digit.
+func scriptIdentLength(source string) int {
+	n := 0
+	for n < len(source) {
+		r, size := utf8.DecodeRuneInString(source[n:])
+		if r != '_' && !unicode.IsLetter(r) && (n == 0 || !unicode.IsDigit(r)) {
+			break
+		}
+		n += size
+	}
+	return n
+}
+
+// Parser
+
+type scriptParser struct {
+	tokens []scriptToken
+	pos    int
+}
+
+func (p *scriptParser) peek() scriptToken {
+	return p.tokens[p.pos]
+}
+
+func (p *scriptParser) next() scriptToken {
+	t := p.tokens[p.pos]
+	if t.typ != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+// back un-reads the token t returned by next
+func (p *scriptParser) back(t scriptToken) {
+	if t.typ != tokEOF {
+		p.pos--
+	}
+}
+
+func (p *scriptParser) is(text string) bool {
+	t := p.peek()
+	return (t.typ == tokOp || t.typ == tokIdent) && t.text == text
+}
+
+func (p *scriptParser) expect(text string) error {
+	if !p.is(text) {
+		return p.errorf("expected %q", text)
+	}
+	p.next()
+	return nil
+}
+
+func (p *scriptParser) errorf(format string, args ...interface{}) error {
+	t := p.peek()
+	found := t.text
+	if t.typ == tokEOF {
+		found = "end of script"
+	} else if t.typ == tokSep {
+		found = "end of statement"
+	}
+	return fmt.Errorf("script line %d: %s, found %q", t.line, fmt.Sprintf(format, args...), found)
+}
+
+func (p *scriptParser) skipSeparators() {
+	for p.peek().typ == tokSep {
+		p.next()
+	}
+}
+
+// parseStatements parses statements until the closing "}" or end of script.
+func (p *scriptParser) parseStatements(end scriptTokenType) ([]scriptStmt, error) {
+	var stmts []scriptStmt
+	for {
+		p.skipSeparators()
+		if end == tokEOF && p.peek().typ == tokEOF || end == tokOp && p.is("}") {
+			return stmts, nil
+		}
+		if p.peek().typ == tokEOF {
+			return nil, p.errorf("expected \"}\"")
+		}
+		stmt, err := p.parseStatement()
+		if err != nil {
+			return nil, err
+		}
+		stmts = append(stmts, stmt)
+		if t := p.peek(); t.typ != tokSep && t.typ != tokEOF && !p.is("}") {
+			return nil, p.errorf("expected end of statement")
+		}
+	}
+}
+
+func (p *scriptParser) parseBlock() ([]scriptStmt, error) {
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+	stmts, err := p.parseStatements(tokOp)
+	if err != nil {
+		return nil, err
+	}
+	return stmts, p.expect("}")
+}
+
+func (p *scriptParser) parseStatement() (scriptStmt, error) {
+	t := p.peek()
+	if t.typ == tokIdent {
+		switch t.text {
+		case "if":
+			return p.parseIf()
+		case "drop":
+			p.next()
+			return &dropStmt{}, nil
+		case "emit":
+			p.next()
+			name, err := p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect(","); err != nil {
+				return nil, err
+			}
+			value, err := p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			return &emitStmt{name: name, value: value}, nil
+		case "unset":
+			p.next()
+			target, err := p.parseTarget()
+			if err != nil {
+				return nil, err
+			}
+			if target.tag == nil {
+				return nil, fmt.Errorf("script line %d: only tags can be unset", t.line)
+			}
+			return &unsetStmt{target: target}, nil
+		}
+	}
+	target, err := p.parseTarget()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect("="); err != nil {
+		return nil, err
+	}
+	value, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	return &assignStmt{target: target, value: value}, nil
+}
+
+func (p *scriptParser) parseIf() (scriptStmt, error) {
+	p.next()
+	cond, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	body, err := p.parseBlock()
+	if err != nil {
+		return nil, err
+	}
+	stmt := &ifStmt{cond: cond, body: body}
+
+	// "else" may follow on the next line
+	pos := p.pos
+	p.skipSeparators()
+	if !p.is("else") {
+		p.pos = pos
+		return stmt, nil
+	}
+	p.next()
+	if p.is("if") {
+		elseIf, err := p.parseIf()
+		if err != nil {
+			return nil, err
+		}
+		stmt.orElse = []scriptStmt{elseIf}
+		return stmt, nil
+	}
+	stmt.orElse, err = p.parseBlock()
+	return stmt, err
+}
+
+func (p *scriptParser) parseTarget() (*scriptTarget, error) {
+	t := p.next()
+	if t.typ != tokIdent || scriptKeywords[t.text] {
+		p.back(t)
+		return nil, p.errorf("expected a variable, field or tag")
+	}
+	if t.text != "tags" {
+		return &scriptTarget{name: t.text}, nil
+	}
+	key, err := p.parseTagKey()
+	if err != nil {
+		return nil, err
+	}
+	return &scriptTarget{tag: key}, nil
+}
+
+// parseTagKey parses the key following "tags", either tags["key"] or tags.key
+func (p *scriptParser) parseTagKey() (scriptExpr, error) {
+	if p.is(".") {
+		p.next()
+		t := p.next()
+		if t.typ != tokIdent {
+			p.back(t)
+			return nil, p.errorf("expected a tag name")
+		}
+		return &literalExpr{value: t.text}, nil
+	}
+	if err := p.expect("["); err != nil {
+		return nil, err
+	}
+	key, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	return key, p.expect("]")
+}
+
+var scriptKeywords = map[string]bool{
+	"if": true, "else": true, "drop": true, "emit": true, "unset": true,
+	"true": true, "false": true, "nil": true,
+}
+
+var scriptPrecedence = map[string]int{
+	"||": 1,
+	"&&": 2,
+	"==": 3, "!=": 3, "<": 3, "<=": 3, ">": 3, ">=": 3, "=~": 3, "!~": 3,
+	"+": 4, "-": 4,
+	"*": 5, "/": 5, "%": 5,
+}
+
+func (p *scriptParser) parseExpr() (scriptExpr, error) {
+	return p.parseBinary(1)
+}
+
+func (p *scriptParser) parseBinary(precedence int) (scriptExpr, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t := p.peek()
+		prec, ok := scriptPrecedence[t.text]
+		if t.typ != tokOp || !ok || prec < precedence {
+			return left, nil
+		}
+		p.next()
+		right, err := p.parseBinary(prec + 1)
+		if err != nil {
+			return nil, err
+		}
+		expr := &binaryExpr{op: t.text, left: left, right: right}
+		if lit, ok := right.(*literalExpr); ok && (t.text == "=~" || t.text == "!~") {
+			pattern, ok := lit.value.(string)
+			if !ok {
+				return nil, fmt.Errorf("script line %d: regular expression must be a string", t.line)
+			}
+			if expr.re, err = regexp.Compile(pattern); err != nil {
+				return nil, fmt.Errorf("script line %d: invalid regular expression: %s", t.line, err)
+			}
+		}
+		left = expr
+	}
+}
+
+func (p *scriptParser) parseUnary() (scriptExpr, error) {
+	if p.is("!") || p.is("-") {
+		op := p.next().text
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &unaryExpr{op: op, operand: operand}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *scriptParser) parsePrimary() (scriptExpr, error) {
+	t := p.next()
+	switch t.typ {
+	case tokNumber:
+		return &literalExpr{value: t.num}, nil
+	case tokString:
+		return &literalExpr{value: t.text}, nil
+	case tokOp:
+		if t.text == "(" {
+			expr, err := p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			return expr, p.expect(")")
+		}
+	case tokIdent:
+		switch t.text {
+		case "true":
+			return &literalExpr{value: true}, nil
+		case "false":
+			return &literalExpr{value: false}, nil
+		case "nil":
+			return &literalExpr{value: nil}, nil
+		case "tags":
+			key, err := p.parseTagKey()
+			if err != nil {
+				return nil, err
+			}
+			return &tagExpr{key: key}, nil
+		}
+		if scriptKeywords[t.text] {
+			break
+		}
+		if p.is("(") {
+			return p.parseCall(t)
+		}
+		return &varExpr{name: t.text}, nil
+	}
+	p.back(t)
+	return nil, p.errorf("expected an expression")
+}
+
+func (p *scriptParser) parseCall(name scriptToken) (scriptExpr, error) {
+	fn, ok := scriptFunctions[name.text]
+	if !ok {
+		return nil, fmt.Errorf("script line %d: unknown function %s", name.line, name.text)
+	}
+	p.next()
+	call := &callExpr{name: name.text, fn: fn}
+	for !p.is(")") {
+		if len(call.args) > 0 {
+			if err := p.expect(","); err != nil {
+				return nil, err
+			}
+		}
+		arg, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		call.args = append(call.args, arg)
+	}
+	p.next()
+	return call, nil
+}
+
+// Statements
+
+type scriptStmt interface {
+	exec(env *scriptEnv) error
+}
+
+func execStatements(env *scriptEnv, stmts []scriptStmt) error {
+	for _, stmt := range stmts {
+		if env.dropped {
+			return nil
+		}
+		if err := env.step(); err != nil {
+			return err
+		}
+		if err := stmt.exec(env); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type scriptTarget struct {
+	name string     // Field or variable name
+	tag  scriptExpr // Tag key expression, if assigning a tag
+}
+
+type assignStmt struct {
+	target *scriptTarget
+	value  scriptExpr
+}
+
+func (s *assignStmt) exec(env *scriptEnv) error {
+	value, err := s.value.eval(env)
+	if err != nil {
+		return err
+	}
+	if s.target.tag != nil {
+		key, err := s.target.tag.eval(env)
+		if err != nil {
+			return err
+		}
+		env.metric.Tags[scriptString(key)] = value
+		return nil
+	}
+	switch s.target.name {
+	case "metric":
+		name := scriptString(value)
+		if name == "" {
+			return errors.New("metric name cannot be empty")
+		}
+		env.metric.Metric = name
+	case "value":
+		env.metric.Value, err = scriptNumber(value)
+	case "timestamp":
+		env.metric.Timestamp, err = scriptNumber(value)
+	default:
+		env.vars[s.target.name] = value
+	}
+	return err
+}
+
+type unsetStmt struct {
+	target *scriptTarget
+}
+
+func (s *unsetStmt) exec(env *scriptEnv) error {
+	key, err := s.target.tag.eval(env)
+	if err != nil {
+		return err
+	}
+	delete(env.metric.Tags, scriptString(key))
+	return nil
+}
+
+type ifStmt struct {
+	cond   scriptExpr
+	body   []scriptStmt
+	orElse []scriptStmt
+}
+
+func (s *ifStmt) exec(env *scriptEnv) error {
+	cond, err := s.cond.eval(env)
+	if err != nil {
+		return err
+	}
+	if scriptTruthy(cond) {
+		return execStatements(env, s.body)
+	}
+	return execStatements(env, s.orElse)
+}
+
+type dropStmt struct{}
+
+func (s *dropStmt) exec(env *scriptEnv) error {
+	env.dropped = true
+	return nil
+}
+
+type emitStmt struct {
+	name  scriptExpr
+	value scriptExpr
+}
+
+func (s *emitStmt) exec(env *scriptEnv) error {
+	name, err := s.name.eval(env)
+	if err != nil {
+		return err
+	}
+	value, err := s.value.eval(env)
+	if err != nil {
+		return err
+	}
+	m := *env.metric
+	if m.Metric = scriptString(name); m.Metric == "" {
+		return errors.New("metric name cannot be empty")
+	}
+	if m.Value, err = scriptNumber(value); err != nil {
+		return err
+	}
+	m.Tags = make(map[string]interface{}, len(env.metric.Tags))
+	for k, v := range env.metric.Tags {
+		m.Tags[k] = v
+	}
+	env.emitted = append(env.emitted, m)
+	return nil
+}
+
+// Expressions
+
+type scriptExpr interface {
+	eval(env *scriptEnv) (interface{}, error)
+}
+
+type literalExpr struct {
+	value interface{}
+}
+
+func (e *literalExpr) eval(env *scriptEnv) (interface{}, error) {
+	return e.value, env.step()
+}
+
+type varExpr struct {
+	name string
+}
+
+func (e *varExpr) eval(env *scriptEnv) (interface{}, error) {
+	if err := env.step(); err != nil {
+		return nil, err
+	}
+	switch e.name {
+	case "metric":
+		return env.metric.Metric, nil
+	case "value":
+		return env.metric.Value, nil
+	case "timestamp":
+		return env.metric.Timestamp, nil
+	}
+	value, ok := env.vars[e.name]
+	if !ok {
+		return nil, fmt.Errorf("undefined variable %s", e.name)
+	}
+	return value, nil
+}
+
+type tagExpr struct {
+	key scriptExpr
+}
+
+func (e *tagExpr) eval(env *scriptEnv) (interface{}, error) {
+	key, err := e.key.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	return env.metric.Tags[scriptString(key)], nil
+}
+
+type unaryExpr struct {
+	op      string
+	operand scriptExpr
+}
+
+func (e *unaryExpr) eval(env *scriptEnv) (interface{}, error) {
+	value, err := e.operand.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	if e.op == "!" {
+		return !scriptTruthy(value), nil
+	}
+	n, err := scriptNumber(value)
+	return -n, err
+}
+
+type binaryExpr struct {
+	op          string
+	left, right scriptExpr
+	re          *regexp.Regexp // Precompiled pattern for =~ and !~ with a literal pattern
+}
+
+func (e *binaryExpr) eval(env *scriptEnv) (interface{}, error) {
+	left, err := e.left.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	// Short circuit logical operators
+	switch e.op {
+	case "&&":
+		if !scriptTruthy(left) {
+			return false, nil
+		}
+	case "||":
+		if scriptTruthy(left) {
+			return true, nil
+		}
+	}
+	right, err := e.right.eval(env)
+	if err != nil {
+		return nil, err
+	}
+
+	switch e.op {
+	case "&&", "||":
+		return scriptTruthy(right), nil
+	case "=~", "!~":
+		re := e.re
+		if re == nil {
+			if re, err = env.script.regexp(scriptString(right)); err != nil {
+				return nil, err
+			}
+		}
+		return re.MatchString(scriptString(left)) == (e.op == "=~"), nil
+	case "==":
+		return scriptEqual(left, right), nil
+	case "!=":
+		return !scriptEqual(left, right), nil
+	}
+
+	// Strings concatenate and compare lexically, everything else is numeric
+	ls, lok := left.(string)
+	rs, rok := right.(string)
+	if lok || rok {
+		if !lok {
+			ls = scriptString(left)
+		}
+		if !rok {
+			rs = scriptString(right)
+		}
+		switch e.op {
+		case "+":
+			return ls + rs, nil
+		case "<":
+			return ls < rs, nil
+		case "<=":
+			return ls <= rs, nil
+		case ">":
+			return ls > rs, nil
+		case ">=":
+			return ls >= rs, nil
+		}
+		return nil, fmt.Errorf("operator %s is not defined for strings", e.op)
+	}
+
+	l, err := scriptNumber(left)
+	if err != nil {
+		return nil, err
+	}
+	r, err := scriptNumber(right)
+	if err != nil {
+		return nil, err
+	}
+	switch e.op {
+	case "+":
+		return l + r, nil
+	case "-":
+		return l - r, nil
+	case "*":
+		return l * r, nil
+	case "/":
+		return l / r, nil
+	case "%":
+		return math.Mod(l, r), nil
+	case "<":
+		return l < r, nil
+	case "<=":
+		return l <= r, nil
+	case ">":
+		return l > r, nil
+	case ">=":
+		return l >= r, nil
+	}
+	return nil, fmt.Errorf("unknown operator %s", e.op)
+}
+
+type callExpr struct {
+	name string
+	fn   func(env *scriptEnv, args []interface{}) (interface{}, error)
+	args []scriptExpr
+}
+
+func (e *callExpr) eval(env *scriptEnv) (interface{}, error) {
+	if err := env.step(); err != nil {
+		return nil, err
+	}
+	args := make([]interface{}, len(e.args))
+	for i, arg := range e.args {
+		value, err := arg.eval(env)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = value
+	}
+	value, err := e.fn(env, args)
+	if err != nil {
+		return nil, fmt.Errorf("%s(): %s", e.name, err)
+	}
+	return value, nil
+}
+
+func scriptArgs(args []interface{}, min, max int) error {
+	if len(args) < min || len(args) > max {
+		if min == max {
+			return fmt.Errorf("expected %d arguments, got %d", min, len(args))
+		}
+		return fmt.Errorf("expected %d to %d arguments, got %d", min, max, len(args))
+	}
+	return nil
+}
+
+var scriptFunctions map[string]func(env *scriptEnv, args []interface{}) (interface{}, error)
+
+func init() {
+	scriptFunctions = map[string]func(env *scriptEnv, args []interface{}) (interface{}, error){
+		"lower": func(env *scriptEnv, args []interface{}) (interface{}, error) {
+			if err := scriptArgs(args, 1, 1); err != nil {
+				return nil, err
+			}
+			return strings.ToLower(scriptString(args[0])), nil
+		},
+		"upper": func(env *scriptEnv, args []interface{}) (interface{}, error) {
+			if err := scriptArgs(args, 1, 1); err != nil {
+				return nil, err
+			}
+			return strings.ToUpper(scriptString(args[0])), nil
+		},
+		"contains": func(env *scriptEnv, args []interface{}) (interface{}, error) {
+			if err := scriptArgs(args, 2, 2); err != nil {
+				return nil, err
+			}
+			return strings.Contains(scriptString(args[0]), scriptString(args[1])), nil
+		},
+		// replace(s, pattern, replacement) replaces regular expression
+		// matches, with $1 style references to groups
+		"replace": func(env *scriptEnv, args []interface{}) (interface{}, error) {
+			if err := scriptArgs(args, 3, 3); err != nil {
+				return nil, err
+			}
+			re, err := env.script.regexp(scriptString(args[1]))
+			if err != nil {
+				return nil, err
+			}
+			return re.ReplaceAllString(scriptString(args[0]), scriptString(args[2])), nil
+		},
+		// split(s, separator, index) returns a single field, or "" if there
+		// are not enough fields; negative indexes count from the end
+		"split": func(env *scriptEnv, args []interface{}) (interface{}, error) {
+			if err := scriptArgs(args, 3, 3); err != nil {
+				return nil, err
+			}
+			fields := strings.Split(scriptString(args[0]), scriptString(args[1]))
+			n, err := scriptNumber(args[2])
+			if err != nil {
+				return nil, err
+			}
+			i := int(n)
+			if i < 0 {
+				i += len(fields)
+			}
+			if i < 0 || i >= len(fields) {
+				return "", nil
+			}
+			return fields[i], nil
+		},
+		"has": func(env *scriptEnv, args []interface{}) (interface{}, error) {
+			if err := scriptArgs(args, 1, 1); err != nil {
+				return nil, err
+			}
+			_, ok := env.metric.Tags[scriptString(args[0])]
+			return ok, nil
+		},
+		"number": func(env *scriptEnv, args []interface{}) (interface{}, error) {
+			if err := scriptArgs(args, 1, 1); err != nil {
+				return nil, err
+			}
+			return scriptNumber(args[0])
+		},
+		"string": func(env *scriptEnv, args []interface{}) (interface{}, error) {
+			if err := scriptArgs(args, 1, 1); err != nil {
+				return nil, err
+			}
+			return scriptString(args[0]), nil
+		},
+		"abs": func(env *scriptEnv, args []interface{}) (interface{}, error) {
+			if err := scriptArgs(args, 1, 1); err != nil {
+				return nil, err
+			}
+			n, err := scriptNumber(args[0])
+			return math.Abs(n), err
+		},
+		// round(n, digits) rounds to the given number of decimal digits
+		"round": func(env *scriptEnv, args []interface{}) (interface{}, error) {
+			if err := scriptArgs(args, 1, 2); err != nil {
+				return nil, err
+			}
+			n, err := scriptNumber(args[0])
+			if err != nil {
+				return nil, err
+			}
+			scale := 1.0
+			if len(args) > 1 {
+				digits, err := scriptNumber(args[1])
+				if err != nil {
+					return nil, err
+				}
+				scale = math.Pow(10, digits)
+			}
+			return math.Floor(n*scale+0.5) / scale, nil
+		},
+	}
+}
+
+// Values are nil, bool, float64 or string; tag values may be anything.
+
+func scriptString(v interface{}) string {
+	switch value := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return value
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64)
+	}
+	return fmt.Sprintf("%v", v)
+}
+
+func scriptNumber(v interface{}) (float64, error) {
+	switch value := v.(type) {
+	case float64:
+		return value, nil
+	case int:
+		return float64(value), nil
+	case bool:
+		if value {
+			return 1, nil
+		}
+		return 0, nil
+	case string:
+		n, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil {
+			return 0, fmt.Errorf("%q is not a number", value)
+		}
+		return n, nil
+	}
+	return 0, fmt.Errorf("%v is not a number", v)
+}
+
+func scriptTruthy(v interface{}) bool {
+	switch value := v.(type) {
+	case nil:
+		return false
+	case bool:
+		return value
+	case float64:
+		return value != 0
+	case string:
+		return value != ""
+	}
+	return true
+}
+
+func scriptEqual(a, b interface{}) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	// Compare numerically unless both sides are strings
+	_, as := a.(string)
+	_, bs := b.(string)
+	if !as || !bs {
+		if x, err := scriptNumber(a); err == nil {
+			if y, err := scriptNumber(b); err == nil {
+				return x == y
+			}
+		}
+	}
+	return scriptString(a) == scriptString(b)
+}
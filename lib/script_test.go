@@ -0,0 +1,210 @@
+package metricshipper
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func runScript(t *testing.T, source string, metric Metric) []Metric {
+	script, err := CompileScript(source)
+	if err != nil {
+		t.Fatalf("unable to compile script: %s", err)
+	}
+	out, err := script.Run(metric, time.Second)
+	if err != nil {
+		t.Fatalf("unable to run script: %s", err)
+	}
+	return out
+}
+
+func TestScriptTransforms(t *testing.T) {
+	source := `
+# convert to bits and derive the site
+if metric =~ "Octets$" {
+	value = value * 8
+	tags["unit"] = "bits"
+} else {
+	value = 0
+}
+tags.site = upper(split(tags.device, "-", 0))
+unset tags.device
+metric = replace(metric, "^if", "interface.")
+`
+	m := counter("ifHCInOctets", 100, 10)
+	m.Tags = map[string]interface{}{"device": "nyc-core-sw01"}
+	out := runScript(t, source, m)
+	if len(out) != 1 {
+		t.Fatalf("expected a single metric, got %+v", out)
+	}
+	expected := Metric{
+		Timestamp: 100,
+		Metric:    "interface.HCInOctets",
+		Value:     80,
+		Tags:      map[string]interface{}{"unit": "bits", "site": "NYC"},
+	}
+	if !out[0].Equal(expected) {
+		t.Errorf("expected %+v, got %+v", expected, out[0])
+	}
+	if m.Tags["device"] != "nyc-core-sw01" || len(m.Tags) != 1 {
+		t.Errorf("script modified the original tags: %+v", m.Tags)
+	}
+}
+
+func TestScriptEmitAndDrop(t *testing.T) {
+	source := `
+total = value
+emit metric + "_pct", round(value / total * 100, 1)
+emit "half", total / 2; value = value / 2
+if value > 1 && !has("keep") { drop }
+`
+	out := runScript(t, source, counter("used", 1, 50))
+	if len(out) != 2 {
+		t.Fatalf("expected 2 emitted metrics, got %+v", out)
+	}
+	if out[0].Metric != "used_pct" || out[0].Value != 100 {
+		t.Errorf("unexpected first emitted metric %+v", out[0])
+	}
+	if out[1].Metric != "half" || out[1].Value != 25 || out[1].Tags["device"] != "dev1" {
+		t.Errorf("unexpected second emitted metric %+v", out[1])
+	}
+}
+
+func TestScriptExpressions(t *testing.T) {
+	cases := map[string]float64{
+		"value = 1 + 2 * 3":                 7,
+		"value = (1 + 2) * 3":               9,
+		"value = -value + 10 % 4":           -8,
+		"value = number(\"1e3\")":           1000,
+		"value = 2 > 1 && \"b\" > \"a\"":    1,
+		"value = 1 == \"1.0\"":              1,
+		"value = \"x\" + 1 == \"x1\"":       1,
+		"value = nil == tags.missing":       1,
+		"value = metric !~ \"^c\" || false": 0,
+	}
+	for source, expected := range cases {
+		script, err := CompileScript(source)
+		if err != nil {
+			t.Errorf("unable to compile %q: %s", source, err)
+			continue
+		}
+		out, err := script.Run(counter("cpu", 1, 10), time.Second)
+		if err != nil {
+			t.Errorf("unable to run %q: %s", source, err)
+		} else if out[0].Value != expected {
+			t.Errorf("%q: expected %v, got %v", source, expected, out[0].Value)
+		}
+	}
+}
+
+func TestScriptUnicodeIdentifiers(t *testing.T) {
+	out := runScript(t, "débit = value * 8\nvalue = débit", counter("cpu", 1, 10))
+	if out[0].Value != 80 {
+		t.Errorf("expected 80, got %v", out[0].Value)
+	}
+	if _, err := CompileScript("x→ = 1"); err == nil || !strings.Contains(err.Error(), `'→'`) {
+		t.Errorf("expected an unexpected character error, got %v", err)
+	}
+}
+
+func TestScriptRegexpCache(t *testing.T) {
+	script, _ := CompileScript(`metric = replace(metric, tags.device, "")`)
+	for i := 0; i < 2*scriptRegexpCacheSize; i++ {
+		m := counter("cpu", 1, 10)
+		m.Tags["device"] = fmt.Sprintf("dev%d", i)
+		if _, err := script.Run(m, time.Second); err != nil {
+			t.Fatalf("unable to run script: %s", err)
+		}
+	}
+	if len(script.regexps) > scriptRegexpCacheSize {
+		t.Errorf("expected at most %d cached patterns, got %d", scriptRegexpCacheSize, len(script.regexps))
+	}
+}
+
+func TestScriptUndefinedVariable(t *testing.T) {
+	script, _ := CompileScript("value = abs(-3) + len")
+	_, err := script.Run(counter("cpu", 1, 10), time.Second)
+	if err == nil || !strings.Contains(err.Error(), "undefined variable len") {
+		t.Errorf("expected undefined variable error, got %v", err)
+	}
+}
+
+func TestScriptCompileErrors(t *testing.T) {
+	sources := []string{
+		"value = ",
+		"value 1",
+		"if value { drop",
+		"drop = 1",
+		"value = foo(1)",
+		"value = \"unterminated",
+		"metric =~ \"(\"",
+		"value = metric =~ \"(\"",
+		"unset value",
+		"value = 1 @ 2",
+	}
+	for _, source := range sources {
+		if _, err := CompileScript(source); err == nil {
+			t.Errorf("expected %q not to compile", source)
+		}
+	}
+}
+
+func TestScriptStage(t *testing.T) {
+	stage, err := NewScriptStage([]ScriptRule{
+		{Pattern: "^cpu", Script: "value = value / 100"},
+		{Script: "value = number(tags.device)"},
+	})
+	if err != nil {
+		t.Fatalf("unable to create script stage: %s", err)
+	}
+	errors := stage.Errors.Count()
+
+	out := processAll(t, stage, counter("cpu", 1, 50), counter("memory", 1, 50))
+	if len(out) != 2 || out[0].Value != 0.5 || out[1].Value != 50 {
+		t.Errorf("expected failing script to leave metrics untouched, got %+v", out)
+	}
+	if stage.Errors.Count()-errors != 2 {
+		t.Errorf("expected 2 script errors, got %d", stage.Errors.Count()-errors)
+	}
+}
+
+func TestScriptStageTimeout(t *testing.T) {
+	// Build a script that takes more steps than allowed
+	source := strings.Repeat("value = value + 1\n", maxScriptSteps)
+	stage, err := NewScriptStage([]ScriptRule{{Script: source}})
+	if err != nil {
+		t.Fatalf("unable to create script stage: %s", err)
+	}
+	timeouts := stage.Timeouts.Count()
+	out := processAll(t, stage, counter("cpu", 1, 50))
+	if len(out) != 1 || out[0].Value != 50 {
+		t.Errorf("expected metric to be untouched, got %+v", out)
+	}
+	if stage.Timeouts.Count()-timeouts != 1 {
+		t.Error("expected the timeout to be counted")
+	}
+}
+
+func TestScriptStageFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "script")
+	if err != nil {
+		t.Fatalf("unable to create script file: %s", err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("drop\n")
+	f.Close()
+
+	stage, err := NewScriptStage([]ScriptRule{{File: f.Name()}})
+	if err != nil {
+		t.Fatalf("unable to create script stage: %s", err)
+	}
+	if out := processAll(t, stage, counter("cpu", 1, 50)); len(out) != 0 {
+		t.Errorf("expected metric to be dropped, got %+v", out)
+	}
+	if _, err := NewScriptStage([]ScriptRule{{File: f.Name() + ".missing"}}); err == nil {
+		t.Error("expected missing script file to be rejected")
+	}
+}
@@ -0,0 +1,295 @@
+package metricshipper
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/zenoss/glog"
+)
+
+const spoolSuffix = ".spool"
+
+type spoolSegment struct {
+	path    string
+	size    int64
+	created time.Time
+}
+
+// Spool is an on-disk FIFO of batches that could not be delivered. Batches
+// are appended to segment files of bounded size, named after their creation
+// time so they survive restarts and are replayed in order. Once the total
+// size exceeds the limit the oldest segments are discarded.
+//
+// Delivery is at least once: a segment that was partially replayed when the
+// shipper stopped is replayed from its start.
+type Spool struct {
+	sync.Mutex
+	dir         string
+	segmentSize int64
+	maxSize     int64
+	size        int64
+	segments    []*spoolSegment // Oldest first; new batches go to the last
+	writer      *os.File        // Open on the last segment, if it is being written
+	reader      *os.File        // Open on the first segment, if it is being replayed
+	readOffset  int64
+	pending     int64 // Length of the record returned by Next
+
+	SizeGauge metrics.Gauge // Bytes on disk
+	AgeGauge  metrics.Gauge // Age in seconds of the oldest segment
+	Spooled   metrics.Meter // Datapoints written to the spool
+	Replayed  metrics.Meter // Datapoints read back from the spool
+	Discarded metrics.Meter // Datapoints lost to the size limit or corruption
+}
+
+// NewSpool opens the spool in dir, creating the directory if needed and
+// picking up segments left behind by a previous run.
+func NewSpool(dir string, segmentSize int64, maxSize int64) (*Spool, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	spool := &Spool{
+		dir:         dir,
+		segmentSize: segmentSize,
+		maxSize:     maxSize,
+		SizeGauge:   metrics.GetOrRegisterGauge("spoolBytes", StatsRegistry),
+		AgeGauge:    metrics.GetOrRegisterGauge("spoolAgeSeconds", StatsRegistry),
+		Spooled:     metrics.GetOrRegisterMeter("spooledDatapoints", StatsRegistry),
+		Replayed:    metrics.GetOrRegisterMeter("replayedDatapoints", StatsRegistry),
+		Discarded:   metrics.GetOrRegisterMeter("discardedSpoolDatapoints", StatsRegistry),
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(files))
+	for _, f := range files {
+		if !f.IsDir() && strings.HasSuffix(f.Name(), spoolSuffix) {
+			names = append(names, f.Name())
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		nanos, err := strconv.ParseInt(strings.TrimSuffix(name, spoolSuffix), 10, 64)
+		if err != nil {
+			glog.Warningf("Ignoring unexpected file %s in spool directory", name)
+			continue
+		}
+		info, err := os.Stat(filepath.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+		spool.segments = append(spool.segments, &spoolSegment{
+			path:    filepath.Join(dir, name),
+			size:    info.Size(),
+			created: time.Unix(0, nanos),
+		})
+		spool.size += info.Size()
+	}
+	if len(spool.segments) > 0 {
+		glog.Infof("Found %d bytes of spooled metrics in %s", spool.size, dir)
+	}
+	spool.updateGauges()
+	return spool, nil
+}
+
+// Empty returns whether there is nothing left to replay
+func (s *Spool) Empty() bool {
+	s.Lock()
+	defer s.Unlock()
+	return len(s.segments) == 0
+}
+
+// Append adds a batch to the end of the spool
+func (s *Spool) Append(batch *MetricBatch) error {
+	data, err := json.Marshal(batch)
+	if err != nil {
+		return err
+	}
+	record := make([]byte, 4+len(data))
+	binary.BigEndian.PutUint32(record, uint32(len(data)))
+	copy(record[4:], data)
+
+	s.Lock()
+	defer s.Unlock()
+	if s.writer == nil || s.segments[len(s.segments)-1].size+int64(len(record)) > s.segmentSize {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+	if _, err := s.writer.Write(record); err != nil {
+		return err
+	}
+	s.segments[len(s.segments)-1].size += int64(len(record))
+	s.size += int64(len(record))
+	s.Spooled.Mark(int64(len(batch.Metrics)))
+
+	for s.maxSize > 0 && s.size > s.maxSize && len(s.segments) > 1 {
+		glog.Errorf("Spool exceeds %d bytes; discarding %s", s.maxSize, s.segments[0].path)
+		s.discardFirst()
+	}
+	s.updateGauges()
+	return nil
+}
+
+// rotate starts a new segment for writing
+func (s *Spool) rotate() error {
+	if s.writer != nil {
+		s.writer.Close()
+		s.writer = nil
+	}
+	now := time.Now()
+	path := filepath.Join(s.dir, fmt.Sprintf("%020d%s", now.UnixNano(), spoolSuffix))
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	s.writer = f
+	s.segments = append(s.segments, &spoolSegment{path: path, created: now})
+	return nil
+}
+
+// Next returns the oldest batch in the spool without removing it, or nil if
+// the spool is empty. Call Commit once the batch has been delivered.
+func (s *Spool) Next() (*MetricBatch, error) {
+	s.Lock()
+	defer s.Unlock()
+	defer s.updateGauges()
+	for len(s.segments) > 0 {
+		segment := s.segments[0]
+		if s.reader == nil {
+			f, err := os.Open(segment.path)
+			if err != nil {
+				return nil, err
+			}
+			s.reader = f
+			s.readOffset = 0
+		}
+		if s.readOffset >= segment.size {
+			if s.segments[0] == s.current() {
+				return nil, nil
+			}
+			s.removeFirst()
+			continue
+		}
+
+		batch, length, err := s.read()
+		if err != nil {
+			glog.Errorf("Discarding corrupt spool segment %s: %s", segment.path, err)
+			s.discardFirst()
+			continue
+		}
+		s.pending = length
+		return batch, nil
+	}
+	return nil, nil
+}
+
+func (s *Spool) read() (*MetricBatch, int64, error) {
+	header := make([]byte, 4)
+	if _, err := s.reader.ReadAt(header, s.readOffset); err != nil {
+		return nil, 0, err
+	}
+	// A torn or corrupt header must not be trusted with the allocation
+	length := int64(binary.BigEndian.Uint32(header))
+	if length > s.segments[0].size-s.readOffset-4 {
+		return nil, 0, fmt.Errorf("record of %d bytes overruns the segment", length)
+	}
+	data := make([]byte, length)
+	if _, err := s.reader.ReadAt(data, s.readOffset+4); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, 0, err
+	}
+	batch := &MetricBatch{}
+	if err := json.Unmarshal(data, batch); err != nil {
+		return nil, 0, err
+	}
+	return batch, int64(len(data) + 4), nil
+}
+
+// Commit removes the batch last returned by Next
+func (s *Spool) Commit(batch *MetricBatch) {
+	s.Lock()
+	defer s.Unlock()
+	if s.pending == 0 || len(s.segments) == 0 {
+		return
+	}
+	s.readOffset += s.pending
+	s.pending = 0
+	s.Replayed.Mark(int64(len(batch.Metrics)))
+	if s.readOffset >= s.segments[0].size {
+		s.removeFirst()
+	}
+	s.updateGauges()
+}
+
+// current returns the segment being written, if any
+func (s *Spool) current() *spoolSegment {
+	if s.writer == nil {
+		return nil
+	}
+	return s.segments[len(s.segments)-1]
+}
+
+// discardFirst drops the oldest segment before it has been fully replayed
+func (s *Spool) discardFirst() {
+	if s.reader == nil {
+		if f, err := os.Open(s.segments[0].path); err == nil {
+			s.reader = f
+			s.readOffset = 0
+		}
+	}
+	if s.reader != nil {
+		// Count what is lost, as far as it can be read
+		for {
+			batch, length, err := s.read()
+			if err != nil {
+				break
+			}
+			s.Discarded.Mark(int64(len(batch.Metrics)))
+			s.readOffset += length
+		}
+	}
+	s.removeFirst()
+}
+
+func (s *Spool) removeFirst() {
+	segment := s.segments[0]
+	if s.reader != nil {
+		s.reader.Close()
+		s.reader = nil
+	}
+	if segment == s.current() {
+		s.writer.Close()
+		s.writer = nil
+	}
+	if err := os.Remove(segment.path); err != nil {
+		glog.Errorf("Unable to remove spool segment %s: %s", segment.path, err)
+	}
+	s.size -= segment.size
+	s.segments = s.segments[1:]
+	s.readOffset = 0
+	s.pending = 0
+}
+
+func (s *Spool) updateGauges() {
+	s.SizeGauge.Update(s.size)
+	if len(s.segments) == 0 {
+		s.AgeGauge.Update(0)
+	} else {
+		s.AgeGauge.Update(int64(time.Since(s.segments[0].created).Seconds()))
+	}
+}
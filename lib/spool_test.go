@@ -0,0 +1,177 @@
+package metricshipper
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func newTestSpool(t *testing.T, segmentSize, maxSize int64) (*Spool, string) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatalf("unable to create spool directory: %s", err)
+	}
+	spool, err := NewSpool(dir, segmentSize, maxSize)
+	if err != nil {
+		t.Fatalf("unable to create spool: %s", err)
+	}
+	return spool, dir
+}
+
+func spoolBatch(name string) *MetricBatch {
+	return &MetricBatch{Metrics: []Metric{counter(name, 1, 2)}}
+}
+
+func appendBatches(t *testing.T, spool *Spool, names ...string) {
+	for _, name := range names {
+		if err := spool.Append(spoolBatch(name)); err != nil {
+			t.Fatalf("unable to append to spool: %s", err)
+		}
+	}
+}
+
+// replayAll reads and commits everything in the spool, returning the names
+// of the first metric of each batch
+func replayAll(t *testing.T, spool *Spool) []string {
+	var names []string
+	for {
+		batch, err := spool.Next()
+		if err != nil {
+			t.Fatalf("unable to read from spool: %s", err)
+		}
+		if batch == nil {
+			return names
+		}
+		names = append(names, batch.Metrics[0].Metric)
+		spool.Commit(batch)
+	}
+}
+
+func segmentFiles(t *testing.T, dir string) []string {
+	files, err := filepath.Glob(filepath.Join(dir, "*"+spoolSuffix))
+	if err != nil {
+		t.Fatalf("unable to list spool directory: %s", err)
+	}
+	return files
+}
+
+func TestSpoolOrder(t *testing.T) {
+	spool, dir := newTestSpool(t, 1<<20, 0)
+	defer os.RemoveAll(dir)
+
+	if !spool.Empty() {
+		t.Error("new spool is not empty")
+	}
+	appendBatches(t, spool, "a", "b")
+	batch, _ := spool.Next()
+	if batch == nil || batch.Metrics[0].Metric != "a" {
+		t.Fatalf("expected first batch, got %+v", batch)
+	}
+	// Without a commit the same batch is returned again
+	if again, _ := spool.Next(); again.Metrics[0].Metric != "a" {
+		t.Errorf("expected uncommitted batch again, got %+v", again)
+	}
+	spool.Commit(batch)
+	appendBatches(t, spool, "c")
+
+	names := replayAll(t, spool)
+	if fmt.Sprint(names) != "[b c]" {
+		t.Errorf("unexpected replay order %v", names)
+	}
+	if !spool.Empty() || len(segmentFiles(t, dir)) != 0 || spool.SizeGauge.Value() != 0 {
+		t.Error("expected replayed spool to be empty and removed from disk")
+	}
+}
+
+func TestSpoolSegments(t *testing.T) {
+	// Every batch fills a segment of its own
+	spool, dir := newTestSpool(t, 10, 0)
+	defer os.RemoveAll(dir)
+
+	appendBatches(t, spool, "a", "b", "c")
+	if files := segmentFiles(t, dir); len(files) != 3 {
+		t.Errorf("expected 3 segments, got %v", files)
+	}
+	if names := replayAll(t, spool); fmt.Sprint(names) != "[a b c]" {
+		t.Errorf("unexpected replay order %v", names)
+	}
+	if files := segmentFiles(t, dir); len(files) != 0 {
+		t.Errorf("expected segments to be removed, got %v", files)
+	}
+}
+
+func TestSpoolRestart(t *testing.T) {
+	spool, dir := newTestSpool(t, 1<<20, 0)
+	defer os.RemoveAll(dir)
+	appendBatches(t, spool, "a", "b")
+
+	reopened, err := NewSpool(dir, 1<<20, 0)
+	if err != nil {
+		t.Fatalf("unable to reopen spool: %s", err)
+	}
+	appendBatches(t, reopened, "c")
+	if names := replayAll(t, reopened); fmt.Sprint(names) != "[a b c]" {
+		t.Errorf("unexpected replay order after restart %v", names)
+	}
+}
+
+func TestSpoolMaxSize(t *testing.T) {
+	spool, dir := newTestSpool(t, 10, 250)
+	defer os.RemoveAll(dir)
+	discarded := spool.Discarded.Count()
+
+	appendBatches(t, spool, "a", "b", "c", "d", "e")
+	names := replayAll(t, spool)
+	if len(names) == 0 || len(names) == 5 || names[len(names)-1] != "e" {
+		t.Errorf("expected the oldest batches to be discarded, got %v", names)
+	}
+	if spool.Discarded.Count()-discarded != int64(5-len(names)) {
+		t.Errorf("expected %d discarded datapoints, got %d", 5-len(names), spool.Discarded.Count()-discarded)
+	}
+}
+
+func TestSpoolCorruptSegment(t *testing.T) {
+	spool, dir := newTestSpool(t, 1<<20, 0)
+	defer os.RemoveAll(dir)
+	appendBatches(t, spool, "a")
+
+	// A partial record, as left behind by a crash
+	files := segmentFiles(t, dir)
+	f, _ := os.OpenFile(files[0], os.O_WRONLY|os.O_APPEND, 0644)
+	f.Write([]byte{0, 0, 1, 0, '{'})
+	f.Close()
+
+	reopened, _ := NewSpool(dir, 1<<20, 0)
+	appendBatches(t, reopened, "b")
+	if names := replayAll(t, reopened); fmt.Sprint(names) != "[a b]" {
+		t.Errorf("expected corrupt record to be skipped, got %v", names)
+	}
+}
+
+func TestSpoolCorruptLength(t *testing.T) {
+	spool, dir := newTestSpool(t, 1<<20, 0)
+	defer os.RemoveAll(dir)
+	appendBatches(t, spool, "a")
+
+	// A header claiming nearly 4 GiB
+	files := segmentFiles(t, dir)
+	f, _ := os.OpenFile(files[0], os.O_WRONLY|os.O_APPEND, 0644)
+	f.Write([]byte{0xff, 0xff, 0xff, 0xf0, '{'})
+	f.Close()
+
+	reopened, _ := NewSpool(dir, 1<<20, 0)
+	appendBatches(t, reopened, "b")
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	names := replayAll(t, reopened)
+	runtime.ReadMemStats(&after)
+	if fmt.Sprint(names) != "[a b]" {
+		t.Errorf("expected corrupt record to be skipped, got %v", names)
+	}
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 1<<20 {
+		t.Errorf("expected the corrupt length not to be allocated, allocated %d bytes", allocated)
+	}
+}
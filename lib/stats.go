@@ -12,6 +12,11 @@ import (
 	"time"
 )
 
+// StatsRegistry holds internal metrics of optional features. Every metric
+// registered here is published along with the core meters, named after its
+// registration name.
+var StatsRegistry = metrics.NewRegistry()
+
 // MetricStats publishes and reports internal metrics
 type MetricStats struct {
 	MetricsChannel       *chan Metric
@@ -19,6 +24,7 @@ type MetricStats struct {
 	OutgoingMeter        *metrics.Meter
 	OutgoingBytes        *metrics.Meter
 	ErrorsMeter          *metrics.Meter
+	Registry             metrics.Registry
 	StatsInterval        int
 	ControlPlaneStatsURL string
 
@@ -56,6 +62,9 @@ func (ms *MetricStats) PublishInternalMetrics() {
 	metrics = append(metrics, generateMeterMetrics(ms.OutgoingMeter, "totalOutgoing", ms.tags)...)
 	metrics = append(metrics, generateMeterMetrics(ms.OutgoingBytes, "txBytes", ms.tags)...)
 	metrics = append(metrics, generateMeterMetrics(ms.ErrorsMeter,   "totalErrors", ms.tags)...)
+	if ms.Registry != nil {
+		metrics = append(metrics, generateRegistryMetrics(ms.Registry, ms.tags)...)
+	}
 
 	// set all timestamps to be the same as the first item
 	timestamp := metrics[0].Timestamp
@@ -133,6 +142,47 @@ func generateMeterMetrics(meter *metrics.Meter, infix string, tags map[string]in
 	return metrics
 }
 
+// generateTimerMetrics creates a slice of Metrics from a timer and name, with
+// durations in milliseconds
+func generateTimerMetrics(timer metrics.Timer, infix string, tags map[string]interface{}) []Metric {
+	prefix := fmt.Sprintf("ZEN_INF.org.zenoss.app.metricshipper.%s", infix)
+	snapshot := timer.Snapshot()
+	ms := float64(time.Millisecond)
+	ps := snapshot.Percentiles([]float64{0.5, 0.95, 0.99})
+
+	metrics := []Metric{}
+	metrics = append(metrics, toMetric(fmt.Sprintf("%s.count", prefix), float64(snapshot.Count()), tags))
+	metrics = append(metrics, toMetric(fmt.Sprintf("%s.mean", prefix), snapshot.Mean()/ms, tags))
+	metrics = append(metrics, toMetric(fmt.Sprintf("%s.max", prefix), float64(snapshot.Max())/ms, tags))
+	metrics = append(metrics, toMetric(fmt.Sprintf("%s.median", prefix), ps[0]/ms, tags))
+	metrics = append(metrics, toMetric(fmt.Sprintf("%s.95thPercentile", prefix), ps[1]/ms, tags))
+	metrics = append(metrics, toMetric(fmt.Sprintf("%s.99thPercentile", prefix), ps[2]/ms, tags))
+
+	glog.Infof("INTERNAL %s: %10.0f %8.3fms:mean %8.3fms:95th %8.3fms:99th",
+		infix, metrics[0].Value, metrics[1].Value, metrics[4].Value, metrics[5].Value)
+
+	return metrics
+}
+
+// generateRegistryMetrics creates a slice of Metrics from every metric in a
+// registry
+func generateRegistryMetrics(r metrics.Registry, tags map[string]interface{}) []Metric {
+	registered := []Metric{}
+	r.Each(func(name string, i interface{}) {
+		switch m := i.(type) {
+		case metrics.Meter:
+			registered = append(registered, generateMeterMetrics(&m, name, tags)...)
+		case metrics.Timer:
+			registered = append(registered, generateTimerMetrics(m, name, tags)...)
+		case metrics.Gauge:
+			prefix := fmt.Sprintf("ZEN_INF.org.zenoss.app.metricshipper.%s", name)
+			registered = append(registered, toMetric(fmt.Sprintf("%s.value", prefix), float64(m.Value()), tags))
+			glog.Infof("INTERNAL %s: %10d", name, m.Value())
+		}
+	})
+	return registered
+}
+
 // toMetric creates a Metric from a name and value
 func toMetric(name string, value float64, tags map[string]interface{}) Metric {
 	metric := Metric{}
@@ -0,0 +1,142 @@
+package metricshipper
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/zenoss/glog"
+	"github.com/zenoss/websocket"
+)
+
+// tls.VersionTLS13 is missing from older Go releases
+const versionTLS13 = 0x0304
+
+// TLSOptions configures connections to wss:// consumers
+type TLSOptions struct {
+	CAFile     string // PEM bundle of CAs to trust instead of the system ones
+	CertFile   string // PEM client certificate for mutual TLS
+	KeyFile    string // PEM key of the client certificate
+	ServerName string // Name to verify the consumer certificate against
+	MinVersion uint16
+}
+
+// ParseTLSVersion converts a version such as "1.2" from the configuration.
+// An empty version leaves the default minimum in place.
+func ParseTLSVersion(version string) (uint16, error) {
+	switch version {
+	case "":
+		return 0, nil
+	case "1.0":
+		return tls.VersionTLS10, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return versionTLS13, nil
+	}
+	return 0, fmt.Errorf("Unknown TLS version %q", version)
+}
+
+// TLSLoader builds the TLS configuration from TLSOptions. The certificate
+// files are loaded again when they change, so rotated certificates are used
+// for new connections without a restart.
+type TLSLoader struct {
+	sync.Mutex
+	options  TLSOptions
+	modified time.Time // Latest modification of the files loaded
+	config   *tls.Config
+}
+
+// NewTLSLoader loads the files in options, failing if any can't be used
+func NewTLSLoader(options TLSOptions) (*TLSLoader, error) {
+	loader := &TLSLoader{options: options}
+	modified, err := loader.lastModified()
+	if err != nil {
+		return nil, err
+	}
+	if loader.config, err = loader.load(); err != nil {
+		return nil, err
+	}
+	loader.modified = modified
+	return loader, nil
+}
+
+// Config returns the current TLS configuration. If the files changed but
+// can't be loaded, for instance halfway through a rotation, the previous
+// configuration is kept.
+func (l *TLSLoader) Config() *tls.Config {
+	l.Lock()
+	defer l.Unlock()
+	modified, err := l.lastModified()
+	if err != nil || !modified.After(l.modified) {
+		return l.config
+	}
+	config, err := l.load()
+	if err != nil {
+		glog.Errorf("Unable to reload TLS certificates: %s", err)
+		return l.config
+	}
+	glog.Info("Reloaded TLS certificates")
+	l.config = config
+	l.modified = modified
+	return config
+}
+
+func (l *TLSLoader) lastModified() (time.Time, error) {
+	var latest time.Time
+	for _, path := range []string{l.options.CAFile, l.options.CertFile, l.options.KeyFile} {
+		if path == "" {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return latest, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+func (l *TLSLoader) load() (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName: l.options.ServerName,
+		MinVersion: l.options.MinVersion,
+	}
+	if l.options.CAFile != "" {
+		pem, err := ioutil.ReadFile(l.options.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in %s", l.options.CAFile)
+		}
+	}
+	if l.options.CertFile != "" || l.options.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(l.options.CertFile, l.options.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// WithTLS secures connections to wss:// consumers with the configuration
+// from loader
+func WithTLS(loader *TLSLoader) PublisherOption {
+	return func(w *WebsocketPublisher) {
+		w.dialHooks = append(w.dialHooks, func(config *websocket.Config) (time.Time, error) {
+			config.TlsConfig = loader.Config()
+			return time.Time{}, nil
+		})
+	}
+}
@@ -0,0 +1,184 @@
+package metricshipper
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/zenoss/websocket"
+)
+
+// testCert is a certificate with its key, signed by a parent or itself
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+func newTestCert(t *testing.T, name string, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("unable to generate key: %s", err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{name},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatalf("unable to create certificate: %s", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCert{cert: cert, key: key, der: der}
+}
+
+func (c *testCert) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.der}, PrivateKey: c.key}
+}
+
+// write stores the certificate and key as PEM files in dir
+func (c *testCert) write(t *testing.T, dir, name string) (certFile, keyFile string) {
+	certFile = filepath.Join(dir, name+".pem")
+	keyFile = filepath.Join(dir, name+".key")
+	keyDER, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatalf("unable to marshal key: %s", err)
+	}
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	return certFile, keyFile
+}
+
+// startTLSServer starts a wss:// consumer requiring a client certificate
+// signed by ca
+func startTLSServer(server, ca *testCert) *httptest.Server {
+	s := httptest.NewUnstartedServer(websocket.Handler(func(ws *websocket.Conn) {
+		io.Copy(ioutil.Discard, ws)
+	}))
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca.cert)
+	s.TLS = &tls.Config{
+		Certificates: []tls.Certificate{server.tlsCertificate()},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+	}
+	s.StartTLS()
+	return s
+}
+
+// tlsDial connects the way the pool does with the TLS configuration of loader
+func tlsDial(t *testing.T, loader *TLSLoader, location string) (*websocket.Conn, error) {
+	var w WebsocketPublisher
+	WithTLS(loader)(&w)
+	pool := &WebSocketConnPool{hooks: w.dialHooks, dialer: websocket.DialConfig}
+	conn, _, err := pool.dial(&Endpoint{config: wsConfig(t, location)})
+	return conn, err
+}
+
+func TestParseTLSVersion(t *testing.T) {
+	for name, expected := range map[string]uint16{"": 0, "1.0": tls.VersionTLS10, "1.2": tls.VersionTLS12} {
+		if version, err := ParseTLSVersion(name); err != nil || version != expected {
+			t.Errorf("%q: expected %x, got %x (%v)", name, expected, version, err)
+		}
+	}
+	if _, err := ParseTLSVersion("3"); err == nil {
+		t.Error("expected unknown version to be rejected")
+	}
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "tls")
+	defer os.RemoveAll(dir)
+	ca := newTestCert(t, "ca", nil)
+	caFile, _ := ca.write(t, dir, "ca")
+	certFile, keyFile := newTestCert(t, "shipper", ca).write(t, dir, "client")
+	server := startTLSServer(newTestCert(t, "consumer.example.com", ca), ca)
+	defer server.Close()
+	location := "wss://" + server.Listener.Addr().String() + "/"
+
+	loader, err := NewTLSLoader(TLSOptions{
+		CAFile:     caFile,
+		CertFile:   certFile,
+		KeyFile:    keyFile,
+		ServerName: "consumer.example.com",
+		MinVersion: tls.VersionTLS12,
+	})
+	if err != nil {
+		t.Fatalf("unable to load certificates: %s", err)
+	}
+	conn, err := tlsDial(t, loader, location)
+	if err != nil {
+		t.Fatalf("unable to connect with a client certificate: %s", err)
+	}
+	conn.Close()
+
+	// Without the client certificate the consumer refuses the connection
+	loader, _ = NewTLSLoader(TLSOptions{CAFile: caFile, ServerName: "consumer.example.com"})
+	if conn, err := tlsDial(t, loader, location); err == nil {
+		conn.Close()
+		t.Error("expected connection without a client certificate to fail")
+	}
+}
+
+func TestTLSLoaderReload(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "tls")
+	defer os.RemoveAll(dir)
+	ca := newTestCert(t, "ca", nil)
+	certFile, keyFile := newTestCert(t, "old", ca).write(t, dir, "client")
+
+	loader, err := NewTLSLoader(TLSOptions{CertFile: certFile, KeyFile: keyFile})
+	if err != nil {
+		t.Fatalf("unable to load certificates: %s", err)
+	}
+	old := loader.Config()
+	if loader.Config() != old {
+		t.Error("expected unchanged files not to be loaded again")
+	}
+
+	// Rotate the certificate, but only the certificate at first
+	rotated := newTestCert(t, "new", ca)
+	rotated.write(t, dir, "rotated")
+	later := time.Now().Add(time.Minute)
+	os.Rename(filepath.Join(dir, "rotated.pem"), certFile)
+	os.Chtimes(certFile, later, later)
+	if loader.Config() != old {
+		t.Error("expected a mismatched certificate and key to be ignored")
+	}
+	os.Rename(filepath.Join(dir, "rotated.key"), keyFile)
+	os.Chtimes(keyFile, later.Add(time.Second), later.Add(time.Second))
+	config := loader.Config()
+	if leaf, _ := x509.ParseCertificate(config.Certificates[0].Certificate[0]); leaf.Subject.CommonName != "new" {
+		t.Errorf("expected the rotated certificate, got %s", leaf.Subject.CommonName)
+	}
+
+	if _, err := NewTLSLoader(TLSOptions{CAFile: filepath.Join(dir, "missing.pem")}); err == nil {
+		t.Error("expected a missing CA bundle to be rejected")
+	}
+}
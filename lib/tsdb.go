@@ -0,0 +1,196 @@
+package metricshipper
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How long to wait for a Graphite connection or write
+const graphiteTimeout = 10 * time.Second
+
+// Encodings of the time series databases batches can be sent to
+const (
+	encodingOpenTSDB = "opentsdb"
+	encodingInfluxDB = "influxdb"
+)
+
+// sortedTags returns the tag keys of a metric in order, with their values as
+// strings
+func sortedTags(m *Metric) ([]string, map[string]string) {
+	keys := make([]string, 0, len(m.Tags))
+	values := make(map[string]string, len(m.Tags))
+	for k, v := range m.Tags {
+		keys = append(keys, k)
+		values[k] = fmt.Sprintf("%v", v)
+	}
+	sort.Strings(keys)
+	return keys, values
+}
+
+// sanitize replaces the characters not allowed by valid with underscores
+func sanitize(s string, valid func(rune) bool) string {
+	return strings.Map(func(r rune) rune {
+		if valid(r) {
+			return r
+		}
+		return '_'
+	}, s)
+}
+
+func isAlphanumeric(r rune) bool {
+	return r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r == '-'
+}
+
+// OpenTSDB allows these characters in metric names and tags
+func isOpenTSDBChar(r rune) bool {
+	return isAlphanumeric(r) || r == '.' || r == '/'
+}
+
+type openTSDBPoint struct {
+	Metric    string            `json:"metric"`
+	Timestamp int64             `json:"timestamp"`
+	Value     float64           `json:"value"`
+	Tags      map[string]string `json:"tags"`
+}
+
+// encodeOpenTSDB encodes a batch for the OpenTSDB /api/put endpoint
+func encodeOpenTSDB(batch *MetricBatch) ([]byte, error) {
+	points := make([]openTSDBPoint, len(batch.Metrics))
+	for i := range batch.Metrics {
+		m := &batch.Metrics[i]
+		keys, values := sortedTags(m)
+		tags := make(map[string]string, len(keys))
+		for _, k := range keys {
+			tags[sanitize(k, isOpenTSDBChar)] = sanitize(values[k], isOpenTSDBChar)
+		}
+		points[i] = openTSDBPoint{
+			Metric:    sanitize(m.Metric, isOpenTSDBChar),
+			Timestamp: int64(m.Timestamp * 1000),
+			Value:     m.Value,
+			Tags:      tags,
+		}
+	}
+	return json.Marshal(points)
+}
+
+var (
+	influxMeasurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `)
+	influxTagEscaper         = strings.NewReplacer(",", `\,`, " ", `\ `, "=", `\=`)
+)
+
+// encodeInfluxDB encodes a batch in the InfluxDB line protocol, with the
+// datapoint as the value field and nanosecond timestamps
+func encodeInfluxDB(batch *MetricBatch) ([]byte, error) {
+	var buf bytes.Buffer
+	for i := range batch.Metrics {
+		m := &batch.Metrics[i]
+		if math.IsNaN(m.Value) || math.IsInf(m.Value, 0) {
+			return nil, fmt.Errorf("Value of %s can't be written to InfluxDB: %v", m.Metric, m.Value)
+		}
+		buf.WriteString(influxMeasurementEscaper.Replace(m.Metric))
+		keys, values := sortedTags(m)
+		for _, k := range keys {
+			if values[k] == "" {
+				continue // Empty tag values aren't allowed
+			}
+			buf.WriteByte(',')
+			buf.WriteString(influxTagEscaper.Replace(k))
+			buf.WriteByte('=')
+			buf.WriteString(influxTagEscaper.Replace(values[k]))
+		}
+		buf.WriteString(" value=")
+		buf.WriteString(strconv.FormatFloat(m.Value, 'g', -1, 64))
+		buf.WriteByte(' ')
+		buf.WriteString(strconv.FormatInt(int64(m.Timestamp*1e9), 10))
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes(), nil
+}
+
+// GraphiteSender writes batches in the Graphite plaintext protocol over TCP.
+// Tags are either flattened into the path, as their values in the order of
+// their keys, or sent as Graphite tags.
+type GraphiteSender struct {
+	sync.Mutex
+	address string
+	tagged  bool
+	conn    net.Conn
+}
+
+// NewGraphiteSender writes to address, given as host:port or
+// tcp://host:port. Tags are sent as Graphite tags if tagged is set.
+func NewGraphiteSender(address string, tagged bool) *GraphiteSender {
+	if u, err := url.Parse(address); err == nil && u.Scheme == "tcp" {
+		address = u.Host
+	}
+	return &GraphiteSender{address: address, tagged: tagged}
+}
+
+func (s *GraphiteSender) SendBatch(batch *MetricBatch, backoff *Backoff) (int, int, error) {
+	var buf bytes.Buffer
+	for i := range batch.Metrics {
+		m := &batch.Metrics[i]
+		if math.IsNaN(m.Value) || math.IsInf(m.Value, 0) {
+			return 0, 0, BatchError{Err: fmt.Errorf("Value of %s can't be written to Graphite: %v", m.Metric, m.Value)}
+		}
+		buf.WriteString(s.path(m))
+		fmt.Fprintf(&buf, " %s %d\n", strconv.FormatFloat(m.Value, 'g', -1, 64), int64(m.Timestamp))
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	if s.conn == nil {
+		conn, err := net.DialTimeout("tcp", s.address, graphiteTimeout)
+		if err != nil {
+			return 0, 0, err
+		}
+		s.conn = conn
+	}
+	batch.Tracer("publishing")
+	s.conn.SetWriteDeadline(time.Now().Add(graphiteTimeout))
+	n, err := s.conn.Write(buf.Bytes())
+	if err != nil {
+		s.conn.Close()
+		s.conn = nil
+		return len(batch.Metrics), n, err
+	}
+	batch.Tracer("sent")
+	return len(batch.Metrics), n, nil
+}
+
+// Graphite tag values can't contain these
+var graphiteTagEscaper = strings.NewReplacer(";", "_", "~", "_", " ", "_")
+
+// Graphite allows these characters in path nodes
+func isGraphiteChar(r rune) bool {
+	return isAlphanumeric(r) || r == '.' || r == ':'
+}
+
+// path returns the Graphite path of a metric
+func (s *GraphiteSender) path(m *Metric) string {
+	keys, values := sortedTags(m)
+	parts := []string{sanitize(m.Metric, isGraphiteChar)}
+	for _, k := range keys {
+		if s.tagged {
+			// Graphite tags can't be empty
+			if values[k] != "" {
+				parts = append(parts, sanitize(k, isAlphanumeric)+"="+graphiteTagEscaper.Replace(values[k]))
+			}
+		} else {
+			parts = append(parts, sanitize(values[k], isAlphanumeric))
+		}
+	}
+	if s.tagged {
+		return strings.Join(parts, ";")
+	}
+	return strings.Join(parts, ".")
+}
@@ -0,0 +1,107 @@
+package metricshipper
+
+import (
+	"bufio"
+	"encoding/json"
+	"math"
+	"net"
+	"testing"
+	"time"
+)
+
+func taggedMetric(name string, value float64, tags map[string]interface{}) Metric {
+	return Metric{Timestamp: 1500000000.5, Metric: name, Value: value, Tags: tags}
+}
+
+func TestEncodeOpenTSDB(t *testing.T) {
+	batch := &MetricBatch{Metrics: []Metric{
+		taggedMetric("cpu user", 1.5, map[string]interface{}{"device": "nyc sw01", "cpu": 2}),
+	}}
+	data, err := encodeOpenTSDB(batch)
+	if err != nil {
+		t.Fatalf("unable to encode: %s", err)
+	}
+	var points []openTSDBPoint
+	json.Unmarshal(data, &points)
+	expected := openTSDBPoint{
+		Metric:    "cpu_user",
+		Timestamp: 1500000000500,
+		Value:     1.5,
+		Tags:      map[string]string{"device": "nyc_sw01", "cpu": "2"},
+	}
+	if len(points) != 1 || points[0].Metric != expected.Metric || points[0].Timestamp != expected.Timestamp ||
+		points[0].Tags["device"] != "nyc_sw01" || points[0].Tags["cpu"] != "2" {
+		t.Errorf("expected %+v, got %s", expected, data)
+	}
+}
+
+func TestEncodeInfluxDB(t *testing.T) {
+	batch := &MetricBatch{Metrics: []Metric{
+		taggedMetric("if octets", 10, map[string]interface{}{"if": "eth0,1", "device": "a=b", "empty": ""}),
+		taggedMetric("load", 0.25, nil),
+	}}
+	data, err := encodeInfluxDB(batch)
+	if err != nil {
+		t.Fatalf("unable to encode: %s", err)
+	}
+	expected := "if\\ octets,device=a\\=b,if=eth0\\,1 value=10 1500000000500000000\n" +
+		"load value=0.25 1500000000500000000\n"
+	if string(data) != expected {
+		t.Errorf("expected\n%s\ngot\n%s", expected, data)
+	}
+
+	batch.Metrics[1].Value = math.Inf(1)
+	if _, err := encodeInfluxDB(batch); err == nil {
+		t.Error("expected an infinite value to be rejected")
+	}
+}
+
+func TestGraphitePaths(t *testing.T) {
+	m := taggedMetric("if.octets", 1, map[string]interface{}{"interface": "eth0/1", "device": "nyc sw01"})
+	if path := NewGraphiteSender("tcp://localhost:2003", false).path(&m); path != "if.octets.nyc_sw01.eth0_1" {
+		t.Errorf("unexpected flattened path %s", path)
+	}
+	if path := NewGraphiteSender("localhost:2003", true).path(&m); path != "if.octets;device=nyc_sw01;interface=eth0/1" {
+		t.Errorf("unexpected tagged path %s", path)
+	}
+}
+
+func TestGraphiteSender(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen: %s", err)
+	}
+	defer listener.Close()
+	lines := make(chan string, 10)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			scanner := bufio.NewScanner(conn)
+			for scanner.Scan() {
+				lines <- scanner.Text()
+			}
+		}
+	}()
+
+	sender := NewGraphiteSender("tcp://"+listener.Addr().String(), false)
+	batch := &MetricBatch{Metrics: []Metric{taggedMetric("load", 0.5, map[string]interface{}{"device": "a"})}}
+	if num, _, err := sender.SendBatch(batch, NewBackoff(1, 1, 1)); err != nil || num != 1 {
+		t.Fatalf("unable to send batch: %v", err)
+	}
+	select {
+	case line := <-lines:
+		if line != "load.a 0.5 1500000000" {
+			t.Errorf("unexpected line %q", line)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Graphite didn't receive the batch")
+	}
+
+	batch.Metrics[0].Value = math.NaN()
+	if _, _, err := sender.SendBatch(batch, NewBackoff(1, 1, 1)); !isBatchError(err) {
+		t.Errorf("expected a NaN value to be a batch error, got %v", err)
+	}
+}
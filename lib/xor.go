@@ -0,0 +1,179 @@
+package metricshipper
+
+import (
+	"errors"
+	"math"
+)
+
+// Float compression as described in "Gorilla: A Fast, Scalable, In-Memory
+// Time Series Database": each value is XORed with the previous one, and only
+// the meaningful bits of the result are written, reusing the previous window
+// of leading and trailing zeros when they fit in it.
+
+var errTruncatedValues = errors.New("truncated compressed values")
+
+type bitWriter struct {
+	buf  []byte
+	free uint // Unused bits in the last byte
+}
+
+func (w *bitWriter) writeBit(bit bool) {
+	if w.free == 0 {
+		w.buf = append(w.buf, 0)
+		w.free = 8
+	}
+	w.free--
+	if bit {
+		w.buf[len(w.buf)-1] |= 1 << w.free
+	}
+}
+
+// writeBits writes the lowest n bits of v, most significant first
+func (w *bitWriter) writeBits(v uint64, n uint) {
+	for n > 0 {
+		n--
+		w.writeBit(v>>n&1 == 1)
+	}
+}
+
+type bitReader struct {
+	buf []byte
+	pos uint // Bits read
+}
+
+func (r *bitReader) readBit() (bool, error) {
+	if r.pos >= uint(len(r.buf))*8 {
+		return false, errTruncatedValues
+	}
+	bit := r.buf[r.pos/8]>>(7-r.pos%8)&1 == 1
+	r.pos++
+	return bit, nil
+}
+
+func (r *bitReader) readBits(n uint) (uint64, error) {
+	var v uint64
+	for ; n > 0; n-- {
+		bit, err := r.readBit()
+		if err != nil {
+			return 0, err
+		}
+		v <<= 1
+		if bit {
+			v |= 1
+		}
+	}
+	return v, nil
+}
+
+func leadingZeros(v uint64) uint {
+	n := uint(0)
+	for ; n < 64 && v&(1<<(63-n)) == 0; n++ {
+	}
+	return n
+}
+
+func trailingZeros(v uint64) uint {
+	n := uint(0)
+	for ; n < 64 && v&(1<<n) == 0; n++ {
+	}
+	return n
+}
+
+// compressValues encodes values as a stream of XORs with their predecessors
+func compressValues(values []float64) []byte {
+	var (
+		w                 bitWriter
+		prev              uint64
+		leading, trailing uint
+		window            bool // Whether leading and trailing are set
+	)
+	for i, value := range values {
+		bits := math.Float64bits(value)
+		if i == 0 {
+			w.writeBits(bits, 64)
+			prev = bits
+			continue
+		}
+		xor := bits ^ prev
+		prev = bits
+		if xor == 0 {
+			w.writeBit(false)
+			continue
+		}
+		w.writeBit(true)
+		lz, tz := leadingZeros(xor), trailingZeros(xor)
+		// The count of leading zeros is written in 5 bits
+		if lz > 31 {
+			lz = 31
+		}
+		if window && lz >= leading && tz >= trailing {
+			w.writeBit(false)
+			w.writeBits(xor>>trailing, 64-leading-trailing)
+			continue
+		}
+		leading, trailing, window = lz, tz, true
+		w.writeBit(true)
+		w.writeBits(uint64(leading), 5)
+		// 64 meaningful bits don't fit in 6 bits and are written as 0
+		w.writeBits(uint64(64-leading-trailing)&63, 6)
+		w.writeBits(xor>>trailing, 64-leading-trailing)
+	}
+	return w.buf
+}
+
+// decompressValues decodes count values written by compressValues
+func decompressValues(data []byte, count int) ([]float64, error) {
+	var (
+		r                 = bitReader{buf: data}
+		prev              uint64
+		leading, trailing uint
+		window            bool
+		err               error
+	)
+	values := make([]float64, count)
+	for i := range values {
+		if i == 0 {
+			if prev, err = r.readBits(64); err != nil {
+				return nil, err
+			}
+			values[i] = math.Float64frombits(prev)
+			continue
+		}
+		changed, err := r.readBit()
+		if err != nil {
+			return nil, err
+		}
+		if changed {
+			newWindow, err := r.readBit()
+			if err != nil {
+				return nil, err
+			}
+			if newWindow {
+				lz, err := r.readBits(5)
+				if err != nil {
+					return nil, err
+				}
+				size, err := r.readBits(6)
+				if err != nil {
+					return nil, err
+				}
+				if size == 0 {
+					size = 64
+				}
+				if lz+size > 64 {
+					return nil, errors.New("invalid compressed value window")
+				}
+				leading, trailing, window = uint(lz), uint(64-lz-size), true
+			} else if !window {
+				return nil, errors.New("compressed value reuses a missing window")
+			}
+			xor, err := r.readBits(64 - leading - trailing)
+			if err != nil {
+				return nil, err
+			}
+			prev ^= xor << trailing
+		}
+		values[i] = math.Float64frombits(prev)
+	}
+	return values, nil
+}
@@ -0,0 +1,41 @@
+package metricshipper
+
+import (
+	"math"
+	"testing"
+)
+
+func TestCompressValues(t *testing.T) {
+	cases := [][]float64{
+		nil,
+		{42},
+		{1, 1, 1, 1},
+		{12, 12.5, 24, 15, 15, -3, 0, 1e300, math.Inf(1), math.Inf(-1), math.SmallestNonzeroFloat64},
+		{0, math.Float64frombits(1), math.Float64frombits(1 << 63), math.Float64frombits(math.MaxUint64)},
+	}
+	for _, values := range cases {
+		data := compressValues(values)
+		decoded, err := decompressValues(data, len(values))
+		if err != nil {
+			t.Fatalf("unable to decompress %v: %s", values, err)
+		}
+		for i := range values {
+			if math.Float64bits(values[i]) != math.Float64bits(decoded[i]) {
+				t.Errorf("expected %v, got %v", values, decoded)
+				break
+			}
+		}
+	}
+
+	nan := compressValues([]float64{math.NaN(), 1})
+	if decoded, err := decompressValues(nan, 2); err != nil || !math.IsNaN(decoded[0]) || decoded[1] != 1 {
+		t.Errorf("expected NaN to survive compression, got %v: %v", decoded, err)
+	}
+	if len(compressValues([]float64{5, 5, 5, 5, 5, 5, 5, 5, 5})) != 9 {
+		t.Error("expected repeated values to take a bit each")
+	}
+	// Padding of the last byte may read as unchanged values, but not beyond
+	if _, err := decompressValues(compressValues([]float64{1, 2, 3}), 20); err == nil {
+		t.Error("expected missing values to be an error")
+	}
+}
@@ -4,8 +4,12 @@ import (
 	"github.com/zenoss/glog"
 	"github.com/zenoss/metricshipper/lib"
 
+	"fmt"
+	"net/http"
+	"net/url"
 	"os"
 	"runtime"
+	"strings"
 	"time"
 
 	"github.com/control-center/serviced/logging"
@@ -52,11 +56,44 @@ func main() {
 	// First, connect to the websocket
 	glog.Infof("Initiating %d %s to consumer", config.Writers,
 		naive_pluralize(config.Writers, "connection"))
+	options, err := publisherOptions(config)
+	if err != nil {
+		glog.Errorf("Invalid configuration: %s", err)
+		return
+	}
+
+	// Report the health of the shipper from the start, as connecting to the
+	// consumer may take a while
+	health := metricshipper.NewHealthRegistry()
+	interval := time.Duration(config.HealthInterval) * time.Second
+	if interval > 0 {
+		health.AddReporter(&metricshipper.LogReporter{})
+	}
+	if config.HealthMarkerFile != "" {
+		// Supervisors rely on the marker file even without log reports
+		health.AddReporter(&metricshipper.MarkerFileReporter{Path: config.HealthMarkerFile, Check: "output"})
+		if interval == 0 {
+			interval = metricshipper.DefaultHealthInterval
+		}
+	}
+	if interval > 0 {
+		go health.Run(interval)
+	}
+	if config.HealthAddress != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/health", metricshipper.HealthHandler(health))
+		go func() {
+			glog.Errorf("Unable to serve health: %s", http.ListenAndServe(config.HealthAddress, mux))
+		}()
+	}
+	options = append(options, metricshipper.WithHealth(health))
+
 	w, err := metricshipper.NewWebsocketPublisher(config.ConsumerUrl,
 		config.Readers, config.MaxBufferSize, config.MaxBatchSize,
 		config.BatchTimeout, time.Duration(config.RetryConnectionTimeout)*time.Second,
 		time.Duration(config.MaxConnectionAge)*time.Second, config.Username, config.Password, config.Encoding,
-		config.BackoffWindow, config.MaxBackoffSteps, config.MaxBackoffDelay, config.MtraceEnabled)
+		config.BackoffWindow, config.MaxBackoffSteps, config.MaxBackoffDelay, config.MtraceEnabled,
+		options...)
 	if err != nil {
 		glog.Error("Unable to create WebSocket forwarder")
 		return
@@ -73,12 +110,21 @@ func main() {
 		glog.Error("Unable to create Redis reader")
 		return
 	}
+	r.MTraceEnabled = config.MtraceEnabled
+	health.Register("input", r.Check)
+	health.Register("buffers", metricshipper.BufferCheck(map[string]chan metricshipper.Metric{
+		"incoming": r.Incoming,
+		"outgoing": w.Outgoing,
+	}))
 
-	// Create a processor and start it going
-	glog.Info("Warming up the processor")
-	p := &metricshipper.MetricProcessor{
-		Incoming: &r.Incoming,
-		Outgoing: &w.Outgoing,
+	// Create the processors and start them going
+	glog.Infof("Warming up %d %s", config.ProcessorWorkers,
+		naive_pluralize(config.ProcessorWorkers, "processor worker"))
+	p, err := metricshipper.NewProcessorPool(&r.Incoming, &w.Outgoing,
+		config.ProcessorWorkers, config.MaxBufferSize, config)
+	if err != nil {
+		glog.Errorf("Unable to create processor: %s", err)
+		return
 	}
 	go p.Start()
 
@@ -91,6 +137,7 @@ func main() {
 		OutgoingBytes:        &w.OutgoingBytes,
 		StatsInterval:        config.StatsInterval,
 		ErrorsMeter:          &w.ErrorDatapoints,
+		Registry:             metricshipper.StatsRegistry,
 		ControlPlaneStatsURL: os.Getenv("CONTROLPLANE_CONSUMER_URL"),
 	}
 	go s.Start()
@@ -99,3 +146,150 @@ func main() {
 	glog.Info("Subscribing to metrics queue")
 	r.Subscribe()
 }
+
+// publisherOptions sets up the optional publisher features from config
+func publisherOptions(config *metricshipper.ShipperConfig) ([]metricshipper.PublisherOption, error) {
+	var options []metricshipper.PublisherOption
+	balancing, err := metricshipper.ParseBalancing(config.ConsumerBalancing)
+	if err != nil {
+		return nil, err
+	}
+	options = append(options, metricshipper.WithBalancing(balancing))
+	if config.BinaryVersion < 0 || config.BinaryVersion > 1 {
+		return nil, fmt.Errorf("Unknown binary encoding version %d", config.BinaryVersion)
+	}
+	options = append(options, metricshipper.WithBinaryVersion(config.BinaryVersion, config.BinaryXOR))
+	var codec metricshipper.Codec
+	if config.Compression != "" {
+		if codec, err = metricshipper.ParseCodec(config.Compression, config.CompressionLevel); err != nil {
+			return nil, err
+		}
+		options = append(options, metricshipper.WithCompression(codec))
+	}
+	if config.ReconnectJitter < 0 || config.ReconnectJitter > 1 {
+		return nil, fmt.Errorf("Invalid reconnect jitter %g", config.ReconnectJitter)
+	}
+	options = append(options, metricshipper.WithReconnectBackoff(
+		time.Duration(config.ReconnectMaxDelay)*time.Second, config.ReconnectJitter))
+	if config.KeepaliveInterval > 0 {
+		options = append(options, metricshipper.WithKeepalive(
+			time.Duration(config.KeepaliveInterval)*time.Second, time.Duration(config.PongTimeout)*time.Second))
+	}
+	if config.WriteTimeout > 0 {
+		options = append(options, metricshipper.WithWriteTimeout(time.Duration(config.WriteTimeout)*time.Second))
+	}
+	if config.MaxBatchBytes > 0 {
+		options = append(options, metricshipper.WithMaxBatchBytes(config.MaxBatchBytes))
+	}
+	if config.AdaptiveBatching {
+		options = append(options, metricshipper.WithAdaptiveBatching(config.MinBatchSize,
+			time.Duration(config.TargetBatchLatency)*time.Millisecond))
+	}
+	if config.DictionaryMaxEntries > 0 {
+		options = append(options, metricshipper.WithDictionaryLimit(config.DictionaryMaxEntries))
+	}
+	var proxyFor metricshipper.ProxyFunc = metricshipper.ProxyFromEnvironment
+	if config.ProxyURL != "" {
+		proxy, err := url.Parse(config.ProxyURL)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid proxy URL: %s", err)
+		}
+		proxyFor = metricshipper.FixedProxy(proxy)
+	}
+	options = append(options, metricshipper.WithProxy(proxyFor, config.ProxyUsername, config.ProxyPassword))
+	auth, err := metricshipper.NewAuthenticator(config)
+	if err != nil {
+		return nil, err
+	}
+	options = append(options, metricshipper.WithAuthenticator(auth))
+	var loader *metricshipper.TLSLoader
+	if config.TLSCAFile != "" || config.TLSCertFile != "" || config.TLSKeyFile != "" || config.TLSServerName != "" || config.TLSMinVersion != "" {
+		version, err := metricshipper.ParseTLSVersion(config.TLSMinVersion)
+		if err != nil {
+			return nil, err
+		}
+		loader, err = metricshipper.NewTLSLoader(metricshipper.TLSOptions{
+			CAFile:     config.TLSCAFile,
+			CertFile:   config.TLSCertFile,
+			KeyFile:    config.TLSKeyFile,
+			ServerName: config.TLSServerName,
+			MinVersion: version,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("Unable to load TLS certificates: %s", err)
+		}
+		options = append(options, metricshipper.WithTLS(loader))
+	}
+	if config.SpoolDir != "" {
+		glog.Infof("Spooling undeliverable metrics to %s", config.SpoolDir)
+		spool, err := metricshipper.NewSpool(config.SpoolDir,
+			int64(config.SpoolSegmentSize)<<20, int64(config.SpoolMaxSize)<<20)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to open spool: %s", err)
+		}
+		options = append(options, metricshipper.WithSpool(spool,
+			time.Duration(config.SpoolAfter)*time.Second))
+	}
+	if config.RetryAttempts < 1 {
+		return nil, fmt.Errorf("Invalid retry attempts %d; at least 1 is needed", config.RetryAttempts)
+	}
+	options = append(options, metricshipper.WithRetryPolicy(metricshipper.RetryPolicy{
+		MaxAttempts:  config.RetryAttempts,
+		InitialDelay: time.Duration(config.RetryDelay) * time.Millisecond,
+		MaxDelay:     time.Duration(config.MaxRetryDelay) * time.Millisecond,
+	}))
+	if config.DeadLetterFile != "" {
+		deadLetters, err := metricshipper.NewDeadLetterFile(config.DeadLetterFile)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to open dead letter file: %s", err)
+		}
+		options = append(options, metricshipper.WithDeadLetterFile(deadLetters))
+	}
+	if config.AckTimeout > 0 {
+		options = append(options, metricshipper.WithAcknowledgements(
+			time.Duration(config.AckTimeout)*time.Second))
+	}
+
+	output := strings.ToLower(config.Output)
+	switch output {
+	case "", "websocket":
+	case "http", "opentsdb", "influxdb", "prometheus":
+		encoding := config.Encoding
+		if output != "http" {
+			encoding = output
+		}
+		sender := metricshipper.NewHTTPSender(config.ConsumerUrl, encoding, config.Readers,
+			time.Duration(config.HTTPTimeout)*time.Second)
+		sender.Gzip = config.HTTPGzip
+		sender.Codec = codec
+		sender.Version = config.BinaryVersion
+		sender.XOR = config.BinaryXOR
+		sender.Auth = auth
+		sender.TLS = loader
+		sender.Proxy = metricshipper.HTTPProxy(proxyFor, config.ProxyUsername, config.ProxyPassword)
+		options = append(options, metricshipper.WithSender(sender))
+	case "graphite":
+		options = append(options, metricshipper.WithSender(
+			metricshipper.NewGraphiteSender(config.ConsumerUrl, config.GraphiteTags)))
+	case "file":
+		sender, err := metricshipper.NewFileSender(config.OutputFile,
+			int64(config.OutputFileMaxSize)*1024*1024,
+			time.Duration(config.OutputFileMaxAge)*time.Second, config.OutputFileGzip)
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, metricshipper.WithSender(sender))
+	case "stdout":
+		options = append(options, metricshipper.WithSender(metricshipper.NewStdoutSender()))
+	default:
+		return nil, fmt.Errorf("Unknown output %q", config.Output)
+	}
+	for _, rule := range config.Taps {
+		tap, err := metricshipper.NewTap(rule)
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, metricshipper.WithTap(tap))
+	}
+	return options, nil
+}
@@ -6,6 +6,7 @@ import (
 	"github.com/gorilla/websocket"
 	"github.com/zenoss/glog"
 	flags "github.com/zenoss/go-flags"
+	metricshipper "github.com/zenoss/metricshipper/lib"
 	"net/http"
 	"sync/atomic"
 )
@@ -27,33 +28,105 @@ func parse_consumer_args(args []string) (ConsumerConfig, error) {
 var total int32 = 0
 
 func consumerHandler(w http.ResponseWriter, r *http.Request) {
-	conn, err := websocket.Upgrade(w, r, nil, 4096, 4096)
+	// Pick binary encoding version 1 if the shipper offers it
+	var responseHeader http.Header
+	for _, protocol := range websocket.Subprotocols(r) {
+		if protocol == "metricshipper-binary-v1" {
+			responseHeader = http.Header{"Sec-Websocket-Protocol": {protocol}}
+		}
+	}
+	conn, err := websocket.Upgrade(w, r, responseHeader, 4096, 4096)
 	if err != nil {
-		glog.Errorf("Failed websocket.Upgrade():", err)
+		glog.Errorf("Failed websocket.Upgrade(): %s", err)
 		http.Error(w, "Bad request", 400)
 		return
 	}
 	defer conn.Close()
 
+	// Binary messages are compressed with snappy unless the shipper
+	// declares otherwise
+	compression := r.Header.Get("X-Metricshipper-Compression")
+	if compression == "" {
+		compression = "snappy"
+	}
+	codec, err := metricshipper.ParseCodec(compression, -1)
+	if err != nil {
+		glog.Errorf("Unsupported compression: %s", err)
+		return
+	}
+
+	// Binary messages are in the binary encoding unless the shipper declares
+	// protobuf or msgpack
+	encoding := r.Header.Get("X-Metricshipper-Encoding")
+
+	// Binary messages only carry the dictionary entries they add
+	dictionary := metricshipper.NewReceiverDictionary()
 	for {
 		messageType, payload, err := conn.ReadMessage()
 		if err != nil {
 			glog.Errorf("Failed reading message: %s", err)
 			break
 		}
+		if messageType == websocket.BinaryMessage {
+			if payload, err = codec.Decompress(payload); err != nil {
+				glog.Errorf("Failed to decompress payload: %s", err)
+				continue
+			}
+			// Compressed JSON batches are sent as binary messages
+			if len(payload) > 0 && payload[0] == '{' {
+				messageType = websocket.TextMessage
+			}
+		}
 
 		if messageType == websocket.TextMessage {
 			message := Message{}
 			err := json.Unmarshal(payload, &message)
-			if err == nil {
+			if err == nil && message.Control.Type == "RESET_DICTIONARY" {
+				glog.Infof("Resetting dictionary")
+				dictionary = metricshipper.NewReceiverDictionary()
+				response, _ := json.Marshal(Control{Type: "OK", Id: message.Control.Id})
+				conn.WriteMessage(websocket.TextMessage, response)
+			} else if err == nil {
 				var length int32 = int32(len(message.Metrics))
 				glog.Infof("len(Message.Metrics)=%d, total=%d", length, atomic.AddInt32(&total, length))
-				ok := Control{Type: "OK"}
+				ok := Control{Type: "OK", Id: message.Control.Id}
 				response, _ := json.Marshal(ok)
 				conn.WriteMessage(websocket.TextMessage, response)
 			} else {
 				glog.Errorf("Failed to unmarshal payload: %s", err)
 			}
+		} else if messageType == websocket.BinaryMessage {
+			batch := metricshipper.MetricBatch{}
+			response, _ := json.Marshal(Control{Type: "OK"})
+			if encoding == "protobuf" || encoding == "msgpack" {
+				if encoding == "protobuf" {
+					err = batch.UnmarshalProtobuf(payload)
+				} else {
+					err = batch.UnmarshalMsgpack(payload)
+				}
+				if err != nil {
+					// The id of the batch can't be known, so the error
+					// answers the oldest batch awaiting acknowledgement
+					glog.Errorf("Failed to decode %s payload: %s", encoding, err)
+					response, _ = json.Marshal(Control{Type: "ERROR", Value: err.Error()})
+				} else {
+					var length int32 = int32(len(batch.Metrics))
+					glog.Infof("len(Message.Metrics)=%d, total=%d", length, atomic.AddInt32(&total, length))
+					if control, ok := batch.Control.(*metricshipper.Control); ok {
+						response, _ = json.Marshal(Control{Type: "OK", Id: control.Id})
+					}
+				}
+			} else if err := batch.UnmarshalBinary(payload, dictionary, false); err != nil {
+				// Ask for every dictionary entry to be sent again
+				glog.Errorf("Failed to decode binary payload of %d bytes: %s", len(payload), err)
+				dictionary = metricshipper.NewReceiverDictionary()
+				response, _ = json.Marshal(Control{Type: "RESYNC", Value: err.Error()})
+			} else {
+				// Binary batches carry no id; they are acknowledged in order
+				var length int32 = int32(len(batch.Metrics))
+				glog.Infof("len(Message.Metrics)=%d, total=%d", length, atomic.AddInt32(&total, length))
+			}
+			conn.WriteMessage(websocket.TextMessage, response)
 		}
 	}
 }
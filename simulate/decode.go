@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/zenoss/glog"
+	flags "github.com/zenoss/go-flags"
+	metricshipper "github.com/zenoss/metricshipper/lib"
+)
+
+// binary decoder config parameters
+type DecodeConfig struct {
+	Encoding    string `long:"encoding" description:"Encoding of the messages (binary, protobuf or msgpack)" default:"binary"`
+	Compression string `long:"compression" description:"How the messages are compressed (none, snappy, gzip or deflate)" default:"snappy"`
+}
+
+// decode prints the metrics of captured binary messages as lines of JSON.
+// Each file holds one message; the files of a connection must be given in
+// the order they were sent, as later messages in the binary encoding refer to
+// dictionary entries sent with earlier ones.
+func decode(args []string) {
+	config := DecodeConfig{}
+	files, err := flags.ParseArgs(&config, args[1:])
+	if err != nil {
+		return
+	}
+	codec, err := metricshipper.ParseCodec(config.Compression, -1)
+	if err != nil {
+		glog.Errorf("Invalid compression: %s", err)
+		return
+	}
+	dictionary := metricshipper.NewReceiverDictionary()
+	encoder := json.NewEncoder(os.Stdout)
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			glog.Errorf("Failed reading %s: %s", file, err)
+			return
+		}
+		if data, err = codec.Decompress(data); err != nil {
+			glog.Errorf("Failed decompressing %s: %s", file, err)
+			return
+		}
+		batch := metricshipper.MetricBatch{}
+		switch config.Encoding {
+		case "protobuf":
+			err = batch.UnmarshalProtobuf(data)
+		case "msgpack":
+			err = batch.UnmarshalMsgpack(data)
+		default:
+			err = batch.UnmarshalBinary(data, dictionary, false)
+		}
+		if err != nil {
+			glog.Errorf("Failed decoding %s: %s", file, err)
+			return
+		}
+		for _, metric := range batch.Metrics {
+			if err := encoder.Encode(metric); err != nil {
+				fmt.Fprintf(os.Stdout, "%+v\n", metric)
+			}
+		}
+	}
+}
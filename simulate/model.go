@@ -3,6 +3,7 @@ package main
 type Control struct {
 	Type  string `json:"type"`
 	Value string `json:"value"`
+	Id    string `json:"id,omitempty"`
 }
 
 type Metric struct {
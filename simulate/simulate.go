@@ -12,7 +12,7 @@ import (
 
 func main() {
 	if len(os.Args) <= 1 {
-		glog.Errorf("Missing simulate argument (producer or consumer)")
+		glog.Errorf("Missing simulate argument (producer or consumer or perfproducer or decode)")
 		return
 	}
 
@@ -26,7 +26,9 @@ func main() {
 	} else if command == "perfproducer" {
 		glog.Infof("Simulating perfproducer")
 		perfproducer(os.Args[1:])
+	} else if command == "decode" {
+		decode(os.Args[1:])
 	} else {
-		glog.Errorf("Illegal simulate arguments %s, expected: (producer or consumer or perfproducer)", command)
+		glog.Errorf("Illegal simulate arguments %s, expected: (producer or consumer or perfproducer or decode)", command)
 	}
 }